@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchComponents is the size of the generated catalogs, several times the
+// official one.
+const benchComponents = 5000
+
+// bigIndex generates an index of n components in categories of 100, each
+// depending on the one before it in its category. Every tenth component
+// replaces an older one in the old category.
+func bigIndex(n int) []byte {
+	var b strings.Builder
+	b.WriteString("<list url=\"http://repo/\">\n")
+	for i := 0; i < n; i++ {
+		if i%100 == 0 {
+			if i > 0 {
+				b.WriteString(" </category>\n")
+			}
+			fmt.Fprintf(&b, " <category id=\"cat%d\" title=\"Category %d\">\n", i/100, i/100)
+		}
+		attrs := fmt.Sprintf(`id="c%d" title="Component %d" path="Data/c%d" hash="%08X" download-size="%d" install-size="%d"`, i, i, i, i, i*10, i*20)
+		if i%100 != 0 {
+			attrs += fmt.Sprintf(` depends="cat%d-c%d"`, i/100, i-1)
+		}
+		if i%10 == 0 {
+			attrs += fmt.Sprintf(` replaces="old-c%d"`, i)
+		}
+		fmt.Fprintf(&b, "  <component %s/>\n", attrs)
+	}
+	b.WriteString(" </category>\n <category id=\"old\">\n")
+	for i := 0; i < n; i += 10 {
+		fmt.Fprintf(&b, "  <component id=\"c%d\" hash=\"%08X\"/>\n", i, i)
+	}
+	b.WriteString(" </category>\n</list>\n")
+	return []byte(b.String())
+}
+
+func BenchmarkParseIndex(b *testing.B) {
+	data := bigIndex(benchComponents)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseIndex(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResolve plans the download of every category, with the old
+// components installed so that each replacement has to be found.
+func BenchmarkResolve(b *testing.B) {
+	list, _, err := parseIndex(bytes.NewReader(bigIndex(benchComponents)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	components, compMap = list, make(map[string]*Component)
+	for _, c := range list {
+		compMap[c.ID] = c
+		c.Downloaded = strings.HasPrefix(c.ID, "old-")
+	}
+	forgetIDIndex()
+	b.Cleanup(resetState)
+
+	var args []string
+	for i := 0; i < benchComponents/100; i++ {
+		args = append(args, fmt.Sprintf("cat%d", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue := resolveQueue(args, func(c *Component) bool { return !c.Downloaded })
+		if len(queue) != benchComponents {
+			b.Fatalf("%d components queued, want %d", len(queue), benchComponents)
+		}
+		if removed := resolveConflicts(queue); len(removed) != benchComponents/10 {
+			b.Fatalf("%d components replaced, want %d", len(removed), benchComponents/10)
+		}
+	}
+}
+
+// BenchmarkInstalledIDs reads the installed state of a tree with as many
+// info files as the generated catalogs have components.
+func BenchmarkInstalledIDs(b *testing.B) {
+	dir := b.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "Components"), 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < benchComponents; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "Components", fmt.Sprintf("cat%d-c%d", i/100, i)), []byte("0 0\n"), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	oldBase := basePath
+	basePath = dir
+	b.Cleanup(func() {
+		basePath = oldBase
+		forgetInstalled()
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		forgetInstalled()
+		if n := len(installedIDs()); n != benchComponents {
+			b.Fatalf("%d components installed, want %d", n, benchComponents)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzParseIndex(f *testing.F) {
+	repo := &testRepo{Server: &httptest.Server{URL: "http://repo"}}
+	repo.serve(catalog1)
+	f.Add(repo.index)
+	f.Add([]byte(`<list url="http://repo"><category id="a"><component id="b" depends="a-c"/></category></list>`))
+	f.Add([]byte(`<list><unknown><component id="x"/></unknown><profile id="p" components="x"/></list>`))
+	f.Add([]byte(strings.Repeat(`<category id="c">`, maxIndexDepth+1)))
+	f.Add([]byte(`<list>` + strings.Repeat(`<x>`, maxIndexDepth*2) + strings.Repeat(`</x>`, maxIndexDepth*2) + `</list>`))
+	f.Add([]byte(`<list><component id="big" title="` + strings.Repeat("a", maxAttrLength+1) + `"/></list>`))
+	f.Add([]byte(`<list url="%zz"><component id="u" url="//other/a.zip" hash="crc32:1 sha256:2"/></list>`))
+	f.Add([]byte(`<list><component id="a"></list>`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		list, cats, err := parseIndex(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, c := range list {
+			if c == nil {
+				t.Fatal("nil component")
+			}
+			if c.Category != "" && c.ID != c.Category && !strings.HasPrefix(c.ID, c.Category+"-") {
+				t.Errorf("component %q is not named after its category %q", c.ID, c.Category)
+			}
+		}
+		for _, cat := range cats {
+			if cat == nil {
+				t.Fatal("nil category")
+			}
+		}
+	})
+}
+
+func TestParseIndexLimits(t *testing.T) {
+	deep := `<list>` + strings.Repeat(`<category id="c">`, maxIndexDepth) + strings.Repeat(`</category>`, maxIndexDepth) + `</list>`
+	if _, _, err := parseIndex(strings.NewReader(deep)); err == nil {
+		t.Error("elements nested too deep were accepted")
+	}
+	long := `<list><component id="a" title="` + strings.Repeat("a", maxAttrLength+1) + `"/></list>`
+	if _, _, err := parseIndex(strings.NewReader(long)); err == nil {
+		t.Error("an attribute that is too long was accepted")
+	}
+}
+
+func FuzzReadZipStream(f *testing.F) {
+	f.Add(zipFiles(catalog1[2].Files))
+	f.Add(zipEntries([]string{"a", "a"}, zip.Store))
+	f.Add(zipEntries([]string{"dir/", "dir/a", "./dir/a"}, zip.Deflate))
+	f.Add([]byte("PK\x03\x04"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readZipStream(bufio.NewReader(bytes.NewReader(data)), func(name string, size int64, r io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		})
+	})
+}
+
+// zipEntries builds an archive with an entry for each name, in order, even
+// if names repeat.
+func zipEntries(names []string, method uint16) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   method,
+			Modified: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			panic(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			fmt.Fprintf(w, "entry %d", i)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// replaceArchive serves data as the archive of id, with the index changed
+// to give its hash and size.
+func (r *testRepo) replaceArchive(id string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := "/components/" + id + ".zip"
+	old := r.archives[key]
+	r.archives[key] = data
+	r.index = bytes.Replace(r.index,
+		[]byte(fmt.Sprintf(`download-size="%d" hash="%08X"`, len(old), crc32.ChecksumIEEE(old))),
+		[]byte(fmt.Sprintf(`download-size="%d" hash="%08X"`, len(data), crc32.ChecksumIEEE(data))), 1)
+}
+
+// FuzzArchiveNames installs archives whose entry names are the lines of
+// names, through both ways of extracting. An archive naming a file twice
+// must be refused without installing anything, and no archive may write
+// outside the component's directory.
+func FuzzArchiveNames(f *testing.F) {
+	f.Add("a.bin\nb.bin", false)
+	f.Add("a.bin\na.bin", false)
+	f.Add("a.bin\na.bin", true)
+	f.Add("lang/de.txt\n./lang/de.txt", true)
+	f.Add("lang/\nlang/de.txt\nlang//de.txt", false)
+	f.Add("../escape.bin", false)
+
+	f.Fuzz(func(t *testing.T, names string, stream bool) {
+		lines := strings.Split(names, "\n")
+		if len(lines) > 20 {
+			return
+		}
+		seen := make(map[string]bool)
+		duplicate := false
+		for _, name := range lines {
+			if name == "" || strings.ContainsAny(name, "\x00\\:") {
+				return
+			}
+			if strings.HasSuffix(name, "/") {
+				continue
+			}
+			key := path.Clean(name)
+			duplicate = duplicate || seen[key]
+			seen[key] = true
+		}
+
+		repo := newTestRepo(t, catalog1)
+		repo.replaceArchive("extra-flash", zipEntries(lines, zip.Deflate))
+		e := newTestEnv(t, repo)
+		args := []string{"-y", "download", "extra-flash"}
+		if stream {
+			args = append([]string{"--stream"}, args...)
+		}
+		e.run(args...)
+
+		installed := strings.Contains(e.run("list", "downloaded"), "* extra-flash")
+		if duplicate && installed {
+			t.Errorf("an archive with a repeated entry was installed:\n%s", e.tree())
+		}
+		outside := false
+		filepath.Walk(e.dir, func(p string, fi os.FileInfo, err error) error {
+			rel, _ := filepath.Rel(e.dir, p)
+			top := strings.Split(filepath.ToSlash(rel), "/")[0]
+			if err == nil && !fi.IsDir() && top != "Flashpoint" && top != "cache" && rel != "fpm.cfg" {
+				outside = true
+			}
+			if err == nil && !fi.IsDir() && top == "Flashpoint" && !strings.HasPrefix(filepath.ToSlash(rel), "Flashpoint/Data/Flash/") &&
+				!strings.HasPrefix(filepath.ToSlash(rel), "Flashpoint/.fpm/") && !strings.HasPrefix(filepath.ToSlash(rel), "Flashpoint/Components/") {
+				outside = true
+			}
+			return nil
+		})
+		if outside {
+			t.Errorf("files were written outside the component's directory:\n%s", e.tree())
+		}
+	})
+}
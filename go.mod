@@ -0,0 +1,3 @@
+module github.com/ksymph/fpm-go
+
+go 1.18
@@ -3,45 +3,134 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unsafe"
 )
 
 // --- Constants & Globals ---
 
 const (
 	defaultSource = "https://nexus-dev.unstable.life/repository/stable/components.xml"
-	configFile    = "fpm.cfg"
+
+	// In system mode, the Flashpoint tree, fpm's state and the cache are
+	// shared by all users of the machine.
+	systemConfigFile = "/etc/fpm.cfg"
+	systemBasePath   = "/opt/flashpoint"
+	systemStateDir   = "/var/lib/fpm"
+	systemCacheDir   = "/var/cache/fpm"
 )
 
 var (
-	basePath    string
-	sourceURL   string
-	components  []*Component
-	compMap     map[string]*Component
-	client      = &http.Client{Timeout: 0}
-	helpText    = `NAME:
+	configFile     = "fpm.cfg" // /etc/fpm.cfg if there is no fpm.cfg in the working directory
+	basePath       string
+	sourceURL      string
+	config         map[string]string
+	components     []*Component
+	categories     []*Category
+	profiles       map[string]*Category    // Profiles defined by the indexes
+	providers      map[string][]*Component // Every source's version of a component, in priority order
+	compMap        map[string]*Component
+	client         = &http.Client{Timeout: 0}
+	assumeYes      bool
+	assumeNo       bool // Print what would be done, but decline every prompt
+	report         *Report
+	exactSizes     bool
+	checkFiles     bool
+	sizeUnits      string // Overrides the size-units setting, from --si or --bytes
+	curlDebug      bool
+	debugOutput    bool     // Print diagnostics about the metadata, from --debug
+	statusFile     *os.File // Receives machine-readable progress, from --status-fd
+	streamArchives bool     // Extract archives while downloading them, from --stream
+	fsyncFlag      bool
+	allLocales     bool // Select every locale variant, from --all-locales
+	includes       []string
+	excludes       []string
+	helpText       = `NAME:
     fpm - Flashpoint Component Manager (Linux Port)
 
 USAGE:
-    fpm <command> [<arguments>...]
+    fpm [-y|--yes|--assume-no] [--report <file>] [--exact-sizes] [--check-files] [--si|--bytes]
+        [--curl] [--debug] [--stream] [--fsync] [--all-locales] [--status-fd <n>]
+        <command> [<arguments>...]
 
 COMMANDS:
-    list [available|downloaded|updates] [verbose]
-    info <component>
-    download <component...>
-    remove <component...>
-    update [component...]
+    list [tree] [available|downloaded|updates|broken|profiles] [verbose] [--kind <kind>] [--ids-only]
+         [--min-size <size>] [--updated-since <date>] [--installed-before <date>] [--tag <tag>]
+    info <component> [--contents] [--json]
+    diff <component>
+    which-source <component...>
+    owner <file...>
+    drift
+    download [--tree] [--simulate-layout] [--include <glob>] [--exclude <glob>]
+             [--category <id>] [--max-size <size>] [--order index|largest] [component...]
+    download <archive-url> [--id <id>] --dir <path>
+    remove [-t|--trash] [-f|--force] <component...>
+    rollback <component>
+    pin|unpin <component...>
+    tag|untag <component> <tag...>
+    note <component> [text]
+    snapshot <create|restore|delete> <name> | snapshot list
+    verify [-a|--all] [component...]
+    verify-downloads
+    update [-f|--force] [--critical-only] [--include <glob>] [--exclude <glob>] [component...]
+    resume
+    purge [--config]
+    trash <list|empty>
+    lint <archive.zip> [--path <dir>]
+    repo diff <old.xml|url> <new.xml|url>
+    status
+    refresh [--source <name>]
+    watch [--interval <seconds>]
+    shell
+    config <list|get|set|unset> [key] [value] | config migrate [--dry-run]
     path [value]
-    source [value]
+    source [value|edit] | source test [name]
+    channel [stable|unstable]
+    help [command]
+    generate-manpages [--markdown] [dir]
+
+COMPONENTS:
+    Components can be given by ID, by category (core), as a glob (core-*),
+    by kind (kind:required) or as @<name> for a group defined with the
+    group.<name> setting or a profile such as @minimal, @server or
+    @everything (see fpm list profiles). A - reads them from standard input,
+    one per line, e.g.
+    fpm list updates --ids-only | fpm update -
+
+OPTIONS:
+    Options can come before, between or after the arguments. Values are
+    given as --name value or --name=value, and single letter options can be
+    combined, e.g. remove -tf. Everything after -- is an argument, even if it
+    starts with a dash.
 `
 )
 
@@ -53,760 +142,9974 @@ type Component struct {
 	Description  string
 	URL          string
 	Directory    string
-	LastUpdated  string
+	LastUpdated  time.Time
 	DownloadSize int64
 	InstallSize  int64
+	FileCount    int // Number of files in the archive, if the index gives it
 	Hash         string
+	HashAlg      string            // Algorithm of Hash, see hashAlgorithms
+	Hashes       map[string]string // All hashes given by the index, by algorithm
 	Depends      []string
+	Conflicts    []string
+	Replaces     []string
+	RenamedFrom  []string // Former IDs, whose installations become this component's
+	Critical     bool     // The index flags this version as a critical or security update
 	Downloaded   bool
 	Outdated     bool
+	Broken       bool  // Files missing or changed, see checkInstalled
 	OldSize      int64 // For calculating diff during updates
+	Source       string
+	Offsite      bool       // URL is on another host than the repository, see archiveAuth
+	Category     string     // ID of the enclosing category, if any
+	Kind         string     // required, recommended or optional
+	Locale       string     // Language or region of a localized variant, e.g. de or pt-BR
+	Pinned       bool       // Kept at the installed version by update
+	Attrs        []xml.Attr // Every attribute the index gives, including unknown ones
+}
+
+// Category is a category element of the index. Its ID is the prefix of the
+// IDs of the components and categories inside it.
+//
+// Profiles, predefined selections such as "server", are kept as categories
+// with Members instead, which are resolved like the members of a group.
+type Category struct {
+	ID      string
+	Title   string
+	Parent  string
+	Members []string
+}
+
+// channels are the official repositories fpm channel switches the primary
+// source between, from the most to the least stable.
+var channels = []struct{ Name, URL string }{
+	{"stable", defaultSource},
+	{"unstable", "https://nexus-dev.unstable.life/repository/development/components.xml"},
+}
+
+// bundledProfiles are used when neither a group setting nor the index defines
+// a profile of the same name.
+var bundledProfiles = []*Category{
+	{ID: "minimal", Title: "Required components only", Members: []string{"kind:required"}},
+	{ID: "server", Title: "Required components and those of the game server", Members: []string{"kind:required", "*server*"}},
+	{ID: "everything", Title: "Every component", Members: []string{"*"}},
+}
+
+// IsMeta reports whether c installs no files of its own and only exists to
+// pull in its dependencies.
+func (c *Component) IsMeta() bool {
+	return c.InstallSize == 0 && c.Source != localSource
+}
+
+// defaultHashAlg is the algorithm of hashes written without a tag, as in
+// indexes and info files from before tags were introduced.
+const defaultHashAlg = "crc32"
+
+// hashAlgorithms are the algorithms archives can be verified with.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"sha256": sha256.New,
+}
+
+// splitHash splits a hash of the form algorithm:value. Untagged hashes are
+// of the default algorithm.
+func splitHash(s string) (alg, value string) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		return strings.ToLower(s[:i]), s[i+1:]
+	}
+	return defaultHashAlg, s
+}
+
+// hashAlgOf guesses the algorithm of an untagged hash by its length, for
+// hashes taken from cached archive names. It returns "" if none fits.
+func hashAlgOf(value string) string {
+	for alg, newHash := range hashAlgorithms {
+		if len(value) == newHash().Size()*2 {
+			return alg
+		}
+	}
+	return ""
+}
+
+// sameHash reports whether the tagged or untagged hashes a and b are equal.
+func sameHash(a, b string) bool {
+	algA, valueA := splitHash(a)
+	algB, valueB := splitHash(b)
+	return algA == algB && strings.EqualFold(valueA, valueB)
+}
+
+// TaggedHash returns c's hash with its algorithm, as written to info files.
+func (c *Component) TaggedHash() string {
+	if c.Hash == "" {
+		return ""
+	}
+	return c.HashAlg + ":" + strings.ToUpper(c.Hash)
+}
+
+// MatchesHash reports whether the tagged or untagged hash s is one of the
+// hashes of c's version. A hash of an algorithm the index does not give
+// cannot be compared and never matches.
+func (c *Component) MatchesHash(s string) bool {
+	alg, value := splitHash(s)
+	if value == "" || c.Hash == "" {
+		return value == c.Hash
+	}
+	if alg == c.HashAlg {
+		return strings.EqualFold(value, c.Hash)
+	}
+	return c.Hashes[alg] != "" && strings.EqualFold(c.Hashes[alg], value)
+}
+
+// Source is a configured component index. The primary source comes from the
+// "source" setting; additional ones from "source.<name>" settings.
+type Source struct {
+	Name string
+	URL  string
+}
+
+// Setting describes a key accepted in fpm.cfg and by the config command.
+// Parse validates a user-supplied value and returns its normalized form.
+type Setting struct {
+	Key         string
+	Default     string
+	Description string
+	Parse       func(string) (string, error)
 }
 
-// XML Parsing Structures
-type xmlNode struct {
-	XMLName xml.Name
-	Attrs   []xml.Attr `xml:",any,attr"`
-	Nodes   []xmlNode  `xml:",any"`
-	Content string     `xml:",chardata"`
+var knownSettings = []Setting{
+	{"version", "0", "Version of the layout of fpm.cfg, kept up to date by fpm", parseInt(0)},
+	{"mode", "user", "Install for the current user, or for all users of the machine under /opt/flashpoint with state in /var/lib/fpm: user or system", parseChoice("user", "system")},
+	{"path", "", "Flashpoint base path", parsePath},
+	{"source", defaultSource, "URL of the primary component index", nil},
+	{"source.*", "", "URL of an additional component index", parseURL},
+	{"source.*.user", "", "User name for HTTP basic authentication with a source", nil},
+	{"source.*.password", "", "Password for HTTP basic authentication with a source", nil},
+	{"source.*.token", "", "Bearer token for a source", nil},
+	{"source.*.keyring", "off", "Look up a source's password or token in the system keyring: on or off", parseChoice("on", "off")},
+	{"source.*.fetch-timeout", "", "Seconds allowed for fetching a source's index (default: fetch-timeout)", parseInt(1)},
+	{"source.*.retries", "", "Retries for a source's requests (default: retries)", parseInt(0)},
+	{"source.*.redirects", "", "Redirects followed for a source (default: redirects)", parseChoice("follow", "same-host", "none")},
+	{"source.*.index-ttl", "", "Minutes a source's fetched index is reused (default: index-ttl)", parseInt(0)},
+	{"source.*.ca-file", "", "PEM file with additional CA certificates trusted for a source (default: ca-file)", parsePath},
+	{"netrc", "", "netrc file with credentials for sources (default: ~/.netrc)", parsePath},
+	{"index-ttl", "0", "Minutes a fetched index is reused before it is fetched again (0: fetch every time)", parseInt(0)},
+	{"fetch-timeout", "60", "Seconds allowed for fetching each component index", parseInt(1)},
+	{"exact-sizes", "off", "Read install sizes from the archives before confirming: on or off", parseChoice("on", "off")},
+	{"check-files", "off", "Check that the files of installed components exist and have the right size: on or off", parseChoice("on", "off")},
+	{"path-checks", "on", "Refuse archives with files the target filesystem cannot hold apart, for case-insensitive or length-limited filesystems: on or off", parseChoice("on", "off")},
+	{"preallocate", "on", "Reserve the full size of downloads and extracted files before writing them, against fragmentation: on or off", parseChoice("on", "off")},
+	{"fsync", "off", "Flush installed files and their directories to disk before recording a component as installed: on or off", parseChoice("on", "off")},
+	{"download-window", "", "Hours in which unattended runs download, e.g. 01:00-07:00; they wait for the window to open (default: any time)", parseWindow},
+	{"concurrency", "1", "Number of components downloaded in parallel", parseInt(1)},
+	{"cache-dir", "", "Directory for downloaded archives (default: ~/.cache/fpm)", parsePath},
+	{"staging-dir", "", "Directory for partial downloads and extraction, on the same filesystem as the base path (default: <path>/.fpm/tmp)", parsePath},
+	{"trash", "off", "Move the files of removed components to the trash directory instead of deleting them: on or off", parseChoice("on", "off")},
+	{"trash-dir", "", "Directory removed files are moved to with trash = on or remove --trash (default: <path>/.fpm/trash)", parsePath},
+	{"audit-log", "", "File to which every deleted or overwritten file is logged (default: <path>/.fpm/audit.log)", parsePath},
+	{"cache-max-size", "0", "Maximum size of kept archives, e.g. 5G (0 keeps none)", parseSizeSetting},
+	{"cache-versions", "0", "Number of versions of each component kept in the cache for rollback (0: no limit)", parseInt(0)},
+	{"cache-compression", "none", "Recompress kept archives: none or zstd (requires the zstd tool)", parseChoice("none", "zstd")},
+	{"cache-compression-level", "3", "zstd compression level for kept archives", parseInt(1)},
+	{"download-command", "", "External command that downloads archives, e.g. curl -fsSL -o {output} {url}", parseCommandTemplate},
+	{"proxy", "", "HTTP proxy URL (default: taken from the environment)", parseURL},
+	{"doh", "", "DNS-over-HTTPS JSON endpoint used to resolve hosts, e.g. https://1.1.1.1/dns-query", parseURL},
+	{"doh-mode", "fallback", "When to use DNS-over-HTTPS: fallback (when the system resolver fails) or always", parseChoice("fallback", "always")},
+	{"redirects", "follow", "Redirects followed: follow (any), same-host or none", parseChoice("follow", "same-host", "none")},
+	{"ca-file", "", "PEM file with additional trusted CA certificates", parsePath},
+	{"retries", "2", "Number of retries for failed requests", parseInt(0)},
+	{"color", "auto", "Colored output: auto, always or never", parseChoice("auto", "always", "never")},
+	{"include.*", "", "Globs of archive entries to install for a component (default: all)", nil},
+	{"exclude.*", "", "Globs of archive entries to skip for a component", nil},
+	{"dedup", "off", "Hardlink identical files across components: on or off", parseChoice("on", "off")},
+	{"dedup-min-size", "1M", "Smallest file considered for deduplication", parseSizeSetting},
+	{"group.*", "", "Components, categories, globs and other @groups selected by @<name>", nil},
+	{"alias.*", "", "Command (and arguments) run by a custom command name", nil},
+	{"rename.*", "", "New ID of a renamed component; fpm update moves the installation of the old ID to it", nil},
+	{"update.exclude", "", "Components, categories and globs fpm update without arguments skips, e.g. animations-*; naming them still updates them, unlike pinning", nil},
+	{"plan-view", "flat", "How download shows what it will do: flat (a list) or tree (dependencies nested under what pulled them in)", parseChoice("flat", "tree")},
+	{"hooks", "on", "Run maintainer scripts and the post-transaction command at all: on or off", parseChoice("on", "off")},
+	{"hook-timeout", "300", "Seconds a maintainer script or the post-transaction command may run before it is killed", parseInt(1)},
+	{"maintainer-scripts", "off", "Offer to run the post-install and pre-remove scripts shipped in component archives: on or off", parseChoice("on", "off")},
+	{"post-transaction", "", "Shell command run after a successful download, update, remove or rollback; see FPM_* variables", nil},
+	{"confirm-default", "none", "Answer assumed when Enter is pressed at a prompt: none, yes or no", parseChoice("none", "yes", "no")},
+	{"confirm-timeout", "0", "Seconds before a prompt takes its default answer (0 waits forever)", parseInt(0)},
+	{"size-units", "binary", "Units of sizes: binary (1 KB = 1024 B), si (1 kB = 1000 B) or bytes", parseChoice("binary", "si", "bytes")},
+	{"date-format", "local", "Format of dates: local (local time) or iso (ISO 8601 in UTC)", parseChoice("local", "iso")},
+	{"watch-refresh", "60", "Minutes between index refreshes in fpm watch", parseInt(1)},
+	{"language", "auto", "Language of messages, e.g. de or pt_BR (auto: taken from LANG)", nil},
+	{"locales", "auto", "Locale variants of components selected by category, glob or kind, e.g. \"de en\" (auto: the language of LANG and English)", nil},
 }
 
 // --- Main Entry ---
 
 func main() {
-	args := os.Args[1:]
+	args := parseGlobalFlags(os.Args[1:])
 	if len(args) == 0 {
-		fmt.Println(helpText)
+		initLocale()
+		fmt.Println(tr(helpText))
 		os.Exit(0)
 	}
 
-	cmd := args[0]
-
 	// Initialize Config
 	initConfig()
+	initLocale()
+
+	runCommand(args)
+	writeReport()
+}
+
+// runCommand runs a single command line, without the global flags. The
+// report, if any, is given the name of the command after alias expansion.
+func runCommand(args []string) {
+	args = expandAlias(args, 0)
+	cmd := args[0]
+	if report != nil && report.Command == "" {
+		// In the shell, a report for the whole session is named after it
+		report.Command = cmd
+	}
+	var flags []FlagHelp
+	if h := findCommandHelp(cmd); h != nil {
+		flags = h.Flags
+	}
+	opts, operands := parseOptions(cmd, flags, args[1:], false)
+	args = append([]string{cmd}, operands...)
+
+	// Previewing a migration must not save it first
+	if migrationChanges != nil && !(cmd == "config" && len(args) > 1 && args[1] == "migrate") {
+		saveMigratedConfig()
+	}
 
 	// Handle config commands that don't require fetching components
-	if cmd == "path" {
-		handlePath(args)
+	switch cmd {
+	case "config":
+		handleConfig(opts, args[1:])
 		return
-	}
-	if cmd == "source" {
-		handleSource(args)
+	case "status":
+		handleStatus()
+		return
+	case "refresh":
+		handleRefresh(opts, args[1:])
+		return
+	case "purge":
+		handlePurge(opts, args[1:])
+		return
+	case "trash":
+		handleTrash(args[1:])
+		return
+	case "channel":
+		handleChannel(args[1:])
+		return
+	case "help":
+		handleHelp(args[1:])
+		return
+	case "generate-manpages":
+		handleGenerateManpages(opts, args[1:])
+		return
+	case "lint":
+		handleLint(opts, args[1:])
+		return
+	case "repo":
+		handleRepo(args[1:])
+		return
+	case "owner":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
+		}
+		handleOwner(args[1:])
+		return
+	case "path", "source":
+		if cmd == "source" && len(args) > 1 && args[1] == "edit" {
+			handleSourceEdit()
+			return
+		}
+		if cmd == "source" && len(args) > 1 && args[1] == "test" {
+			handleSourceTest(args[2:])
+			return
+		}
+		// Legacy aliases for `config get|set path|source`
+		if len(args) > 1 {
+			handleConfig(nil, []string{"set", cmd, args[1]})
+		} else {
+			handleConfig(nil, []string{"get", cmd})
+		}
 		return
 	}
 
-	// Fetch components for all other commands
-	if err := getComponents(); err != nil {
-		fatal(fmt.Sprintf("Error fetching components: %v", err))
+	// Fetch components for all other commands. The shell keeps them for all
+	// the commands run in it.
+	if baseMissing() && components == nil {
+		warn(fmt.Sprintf(tr("Warning: The base path %s does not exist, so no component is shown as installed. "+
+			"Is it on a drive that is not mounted?"), basePath))
+	}
+	if components == nil {
+		if err := getComponents(); err != nil {
+			fatal(fmt.Sprintf(tr("Could not fetch components: %v"), err))
+		}
 	}
 
 	switch cmd {
 	case "list":
-		handleList(args)
+		handleList(opts, args)
 	case "info":
 		if len(args) < 2 {
-			fatal("At least one argument is required")
+			fatal(tr("At least one argument is required"))
+		}
+		handleInfo(opts, args[1:])
+	case "diff":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
+		}
+		handleDiff(args[1])
+	case "drift":
+		handleDrift()
+	case "which-source":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
 		}
-		handleInfo(args[1])
+		handleWhichSource(args[1:])
 	case "download":
-		handleDownload(args[1:])
+		beginTransaction()
+		handleDownload(opts, expandSelection(args[1:]))
 	case "remove":
 		if len(args) < 2 {
-			fatal("At least one argument is required")
+			fatal(tr("At least one argument is required"))
 		}
-		handleRemove(args[1:])
+		beginTransaction()
+		handleRemove(opts, expandSelection(args[1:]))
 	case "update":
-		handleUpdate(args[1:])
+		beginTransaction()
+		handleUpdate(opts, expandSelection(args[1:]))
+	case "rollback":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
+		}
+		beginTransaction()
+		handleRollback(args[1])
+	case "pin", "unpin":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
+		}
+		beginTransaction()
+		handlePin(expandSelection(args[1:]), cmd == "pin")
+	case "tag", "untag":
+		if len(args) < 3 {
+			fatal(tr("A component and at least one tag are required"))
+		}
+		beginTransaction()
+		handleTag(args[1], args[2:], cmd == "tag")
+	case "note":
+		if len(args) < 2 {
+			fatal(tr("At least one argument is required"))
+		}
+		beginTransaction()
+		handleNote(args[1], strings.Join(args[2:], " "))
+	case "snapshot":
+		if len(args) > 1 && args[1] == "restore" {
+			beginTransaction()
+		}
+		handleSnapshot(args[1:])
+	case "verify":
+		handleVerify(opts, expandSelection(args[1:]))
+	case "verify-downloads":
+		beginTransaction()
+		handleVerifyDownloads()
+	case "resume":
+		beginTransaction()
+		handleResume()
+	case "watch":
+		handleWatch(opts)
+	case "shell":
+		handleShell()
 	default:
-		fmt.Println(helpText)
+		fmt.Println(tr(helpText))
 	}
+	releaseLock()
+	runPostTransaction(cmd)
 }
 
-// --- Handlers ---
-
-func handlePath(args []string) {
-	if len(args) > 1 {
-		absPath, err := filepath.Abs(args[1])
-		if err != nil {
-			fatal("Invalid path")
+// parseGlobalFlags removes the flags accepted by every command from args,
+// leaving the command's own options and -- to parseOptions.
+func parseGlobalFlags(args []string) []string {
+	opts, rest := parseOptions("", globalFlags, args, true)
+	for name := range opts {
+		switch name {
+		case "yes":
+			assumeYes = true
+		case "assume-no":
+			assumeNo = true
+		case "exact-sizes":
+			exactSizes = true
+		case "check-files":
+			checkFiles = true
+		case "curl":
+			curlDebug = true
+		case "debug":
+			debugOutput = true
+		case "stream":
+			streamArchives = true
+		case "fsync":
+			fsyncFlag = true
+		case "all-locales":
+			allLocales = true
+		case "si":
+			sizeUnits = "si"
+		case "bytes":
+			sizeUnits = "bytes"
+		case "report":
+			report = &Report{Path: opts.Value(name), Started: time.Now()}
+		case "include":
+			includes = append(includes, opts[name]...)
+		case "exclude":
+			excludes = append(excludes, opts[name]...)
+		case "status-fd":
+			statusFile = openStatusFD(opts.Value(name))
 		}
-		basePath = absPath
-		writeConfig()
-	} else {
-		fmt.Println(basePath)
 	}
-}
-
-func handleSource(args []string) {
-	if len(args) > 1 {
-		sourceURL = args[1]
-		writeConfig()
-	} else {
-		fmt.Println(sourceURL)
+	if assumeYes && assumeNo {
+		fatal(tr("--yes and --assume-no cannot be combined"))
 	}
+	return rest
 }
 
-func handleList(args []string) {
-	filter := ""
-	verbose := false
+// Options are the options given to a command by their long name, without
+// the dashes. Each occurrence adds a value, which is empty for options that
+// take none.
+type Options map[string][]string
 
-	for _, arg := range args[1:] {
-		if arg == "verbose" {
-			verbose = true
-		} else {
-			filter = arg
-		}
-	}
+// Has reports whether the option was given.
+func (o Options) Has(name string) bool {
+	_, ok := o[name]
+	return ok
+}
 
-	if len(components) == 0 {
-		fmt.Println("No components found. Please check your source URL or internet connection.")
-		return
+// Value returns the last value given for the option, or "".
+func (o Options) Value(name string) string {
+	if values := o[name]; len(values) > 0 {
+		return values[len(values)-1]
 	}
+	return ""
+}
 
-	for _, c := range components {
-		if filter == "available" && c.Downloaded {
-			continue
-		}
-		if filter == "downloaded" && !c.Downloaded {
-			continue
-		}
-		if filter == "updates" && !c.Outdated {
-			continue
-		}
+// optionSpec is an option as documented by a FlagHelp.
+type optionSpec struct {
+	name  string // Long name without the dashes
+	value bool   // Whether the option takes a value
+}
 
-		prefix := " "
-		if c.Downloaded {
-			if c.Outdated {
-				prefix = "!"
-			} else {
-				prefix = "*"
+// optionSpecs maps each spelling of the options documented in flags, such as
+// --trash and -t for "-t, --trash" or --kind for "--kind <kind>", to its
+// spec. Entries that are not options, like verbose for fpm list, are skipped.
+func optionSpecs(flags []FlagHelp) map[string]optionSpec {
+	specs := make(map[string]optionSpec)
+	for _, f := range flags {
+		var short []string
+		for _, part := range strings.Split(f.Flag, ", ") {
+			fields := strings.Fields(part)
+			switch {
+			case len(fields) == 0 || !strings.HasPrefix(fields[0], "-"):
+			case strings.HasPrefix(fields[0], "--"):
+				spec := optionSpec{strings.TrimPrefix(fields[0], "--"), len(fields) > 1}
+				specs[fields[0]] = spec
+				for _, name := range short {
+					specs[name] = spec
+				}
+				short = nil
+			default:
+				short = append(short, fields[0])
 			}
 		}
+	}
+	return specs
+}
 
-		output := fmt.Sprintf("%s %s", prefix, c.ID)
-		if verbose {
-			output += fmt.Sprintf(" (%s)", c.Title)
+// parseOptions separates the options documented in flags from the other
+// arguments of command cmd. Options can come anywhere, take their value as
+// --name value or --name=value, and single letters can be combined like
+// -tf. Everything after -- is an argument. Unknown options are an error,
+// unless passUnknown is set; then they are returned among the arguments,
+// like -- and everything after it, for the command to parse.
+func parseOptions(cmd string, flags []FlagHelp, args []string, passUnknown bool) (Options, []string) {
+	specs := optionSpecs(flags)
+	opts := make(Options)
+	var rest []string
+	unknown := func(option string) {
+		fatal(fmt.Sprintf(tr("Unknown option %s; see fpm help %s"), option, cmd))
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			if passUnknown {
+				return opts, append(rest, args[i:]...)
+			}
+			return opts, append(rest, args[i+1:]...)
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := arg, "", false
+			if eq := strings.Index(arg, "="); eq >= 0 {
+				name, value, hasValue = arg[:eq], arg[eq+1:], true
+			}
+			spec, ok := specs[name]
+			switch {
+			case !ok && passUnknown:
+				rest = append(rest, arg)
+				continue
+			case !ok:
+				unknown(name)
+			case !spec.value && hasValue:
+				fatal(fmt.Sprintf(tr("Option %s does not take a value"), name))
+			case spec.value && !hasValue:
+				if i+1 == len(args) {
+					fatal(fmt.Sprintf(tr("Option %s requires a value"), name))
+				}
+				i++
+				value = args[i]
+			}
+			opts[spec.name] = append(opts[spec.name], value)
+		case len(arg) > 1 && arg[0] == '-':
+			// Single letters, possibly combined. A letter that takes a value
+			// takes the rest of the group or the next argument.
+			var unknownLetters string
+			for j := 1; j < len(arg); j++ {
+				name := "-" + arg[j:j+1]
+				spec, ok := specs[name]
+				if !ok {
+					if !passUnknown {
+						unknown(name)
+					}
+					unknownLetters += arg[j : j+1]
+					continue
+				}
+				value := ""
+				if spec.value {
+					value = arg[j+1:]
+					if value == "" {
+						if i+1 == len(args) {
+							fatal(fmt.Sprintf(tr("Option %s requires a value"), name))
+						}
+						i++
+						value = args[i]
+					}
+					j = len(arg)
+				}
+				opts[spec.name] = append(opts[spec.name], value)
+			}
+			if unknownLetters != "" {
+				rest = append(rest, "-"+unknownLetters)
+			}
+		default:
+			rest = append(rest, arg)
 		}
-		fmt.Println(output)
 	}
+	return opts, rest
 }
 
-func handleInfo(id string) {
-	c, exists := compMap[id]
-	if !exists {
-		fatal("Specified component does not exist")
+// openStatusFD returns the file descriptor named by --status-fd, which
+// wrappers usually open as a pipe.
+func openStatusFD(value string) *os.File {
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		fatal(fmt.Sprintf(tr("Invalid file descriptor %s"), value))
+	}
+	f := os.NewFile(uintptr(fd), "status-fd")
+	if _, err := f.Stat(); err != nil {
+		fatal(fmt.Sprintf(tr("File descriptor %d is not open"), fd))
 	}
+	return f
+}
 
-	fmt.Printf("ID:             %s\n", c.ID)
-	fmt.Printf("Title:          %s\n", c.Title)
-	fmt.Printf("Description:    %s\n", c.Description)
-	fmt.Printf("Download size:  %s\n", formatBytes(c.DownloadSize))
-	fmt.Printf("Install size:   %s\n", formatBytes(c.InstallSize))
-	fmt.Printf("Last updated:   %s\n", c.LastUpdated)
-	fmt.Printf("CRC32:          %s\n\n", c.Hash)
+// commands lists the command names, for alias and prefix resolution.
+var commands = []string{"list", "info", "diff", "which-source", "owner", "drift", "download", "remove", "update", "rollback", "pin", "unpin", "tag", "untag", "note", "snapshot", "verify", "verify-downloads", "resume", "purge", "trash", "lint", "repo", "channel", "status", "refresh", "watch", "shell", "config", "path", "source", "help", "generate-manpages"}
 
-	if len(c.Depends) > 0 {
-		fmt.Printf("Dependencies: \n  %s\n\n", strings.Join(c.Depends, "\n  "))
-	}
+// builtinAliases can be overridden or extended with alias.<name> settings.
+var builtinAliases = map[string]string{
+	"install":   "download",
+	"uninstall": "remove",
+	"rm":        "remove",
+	"ls":        "list",
+	"up":        "update",
+}
 
-	req := "No"
-	if strings.HasPrefix(c.ID, "core-") {
-		req = "Yes"
+// expandAlias resolves the command name in args[0]. Aliases expand like git
+// aliases, so "alias.ups = list updates" makes `fpm ups` run `fpm list
+// updates`. Otherwise any unambiguous prefix of a command is accepted.
+func expandAlias(args []string, depth int) []string {
+	if len(args) == 0 {
+		fmt.Println(tr(helpText))
+		exit(0)
+	}
+	name := args[0]
+	for _, c := range commands {
+		if c == name {
+			return args
+		}
 	}
-	fmt.Printf("Required?       %s\n", req)
 
-	down := "No"
-	if c.Downloaded {
-		down = "Yes"
+	target := config["alias."+name]
+	if target == "" {
+		target = builtinAliases[name]
+	}
+	if target != "" {
+		if depth > 10 {
+			fatal(fmt.Sprintf(tr("Alias %s expands to itself"), name))
+		}
+		expanded := append(strings.Fields(target), args[1:]...)
+		return expandAlias(parseGlobalFlags(expanded), depth+1)
 	}
-	fmt.Printf("Downloaded?     %s\n", down)
 
-	if c.Downloaded {
-		upToDate := "Yes"
-		if c.Outdated {
-			upToDate = "No"
+	var matches []string
+	for _, c := range commands {
+		if strings.HasPrefix(c, name) {
+			matches = append(matches, c)
 		}
-		fmt.Printf("Up-to-date?     %s\n", upToDate)
 	}
+	switch len(matches) {
+	case 0:
+		fmt.Println(tr(helpText))
+		exit(0)
+	case 1:
+		return append([]string{matches[0]}, args[1:]...)
+	}
+	fatal(fmt.Sprintf(tr("Command %s is ambiguous; it could be %s"), name, strings.Join(matches, ", ")))
+	return nil
 }
 
-func handleDownload(args []string) {
-	toDownload := resolveQueue(args, func(c *Component) bool {
-		return !c.Downloaded
-	})
+// --- Command Help ---
 
-	if len(toDownload) == 0 {
-		fmt.Println("No components to download")
-		return
-	}
+// CommandHelp documents a command for fpm help <command> and the generated
+// man pages and Markdown reference. Usage holds one synopsis per form of the
+// command, without the leading "fpm".
+type CommandHelp struct {
+	Name     string
+	Usage    []string
+	Summary  string
+	Details  string
+	Flags    []FlagHelp
+	Examples []string
+}
 
-	var dlSize, instSize int64
-	fmt.Println(len(toDownload), "component(s) will be downloaded:")
-	for _, c := range toDownload {
-		fmt.Printf("  %s\n", c.ID)
-		dlSize += c.DownloadSize
-		instSize += c.InstallSize
+// FlagHelp documents an option, e.g. {"--kind <kind>", "Only show ..."}.
+type FlagHelp struct {
+	Flag        string
+	Description string
+}
+
+// globalFlags are accepted before or after any command.
+var globalFlags = []FlagHelp{
+	{"-y, --yes", "Answer yes to every prompt"},
+	{"--assume-no", "Print what would be done, but answer no to every prompt"},
+	{"--report <file>", "Write a JSON report of the changes, warnings and hooks to file"},
+	{"--exact-sizes", "Read install sizes from the archives before confirming"},
+	{"--check-files", "Check that the files of installed components exist and have the right size"},
+	{"--si, --bytes", "Show sizes in SI units (1 kB = 1000 B) or as plain numbers of bytes"},
+	{"--curl", "Print every request as an equivalent curl command line to stderr"},
+	{"--debug", "Print diagnostics about the metadata, such as duplicate component IDs, to stderr"},
+	{"--stream", "Extract archives while downloading them"},
+	{"--fsync", "Flush installed files to disk before recording a component as installed"},
+	{"--all-locales", "Select every locale variant of components, not only those in the locales setting"},
+	{"--status-fd <n>", "Write machine-readable progress lines to file descriptor n"},
+	{"--include <glob>, --exclude <glob>", "Only install, or skip, the archive entries matching glob"},
+}
+
+var commandHelp = []*CommandHelp{
+	{
+		Name:    "list",
+		Usage:   []string{"list [tree] [available|downloaded|updates|broken|profiles] [verbose] [--kind <kind>] [--ids-only] [--min-size <size>] [--updated-since <date>] [--installed-before <date>] [--tag <tag>]"},
+		Summary: "Show components",
+		Details: "Lists the components of all sources. Installed components are marked with * when up to date, ! when outdated and x when broken. " +
+			"available, downloaded, updates and broken narrow the list down; updates ends with the total download and changed size. " +
+			"profiles lists the predefined selections, and tree nests components under their categories.",
+		Flags: []FlagHelp{
+			{"verbose", "Also show titles and notes"},
+			{"--kind <kind>", "Only show required, recommended or optional components"},
+			{"--tag <tag>", "Only show components with the given tag"},
+			{"--ids-only", "Print bare IDs, for scripts"},
+			{"--min-size <size>", "Only show components with at least this install size, e.g. 1G"},
+			{"--updated-since <date>", "Only show components the index lists as updated since date"},
+			{"--installed-before <date>", "Only show components last installed or updated before date"},
+		},
+		Examples: []string{"fpm list updates", "fpm list downloaded --min-size 1G", "fpm list tree verbose"},
+	},
+	{
+		Name:    "info",
+		Usage:   []string{"info <component> [--contents] [--json]"},
+		Summary: "Show the details of a component",
+		Details: "Shows a component's title, sizes, hash, source, dependencies and whether it is installed and up to date.",
+		Flags: []FlagHelp{
+			{"--contents", "Read the archive's directory and show its largest file and file types"},
+			{"--json", "Print the details as JSON, including every attribute the index gives"},
+		},
+		Examples: []string{"fpm info core-launcher", "fpm info extra-ruffle --json"},
+	},
+	{
+		Name:     "diff",
+		Usage:    []string{"diff <component>"},
+		Summary:  "Compare an installed component with its archive",
+		Details:  "Shows which files an update would add, remove or replace, and which installed files were modified locally.",
+		Examples: []string{"fpm diff core-server-gamezip"},
+	},
+	{
+		Name:     "which-source",
+		Usage:    []string{"which-source <component...>"},
+		Summary:  "Show which sources provide components",
+		Details:  "Lists every source that provides each component and which of them wins: the primary source, then the others in name order.",
+		Examples: []string{"fpm which-source core-launcher"},
+	},
+	{
+		Name:     "owner",
+		Usage:    []string{"owner <file...>"},
+		Summary:  "Show the component that installed files",
+		Examples: []string{"fpm owner Data/Ruffle/ruffle.bin"},
+	},
+	{
+		Name:    "drift",
+		Usage:   []string{"drift"},
+		Summary: "Find installed versions no source knows",
+		Details: "Reports installed components whose version is in no source, or which come from a source that is no longer configured. " +
+			"Exits with status 1 if any are found.",
+	},
+	{
+		Name: "download",
+		Usage: []string{
+			"download [--tree] [--simulate-layout] [--include <glob>] [--exclude <glob>] [--category <id>] [--max-size <size>] [--order index|largest] [component...]",
+			"download <archive-url> [--id <id>] --dir <path>",
+		},
+		Summary: "Install components",
+		Details: "Downloads and installs the given components together with their dependencies, after showing what will be done. " +
+			"An archive URL installs a component that is in no repository.",
+		Flags: []FlagHelp{
+			{"--tree", "Show dependencies nested under what pulled them in"},
+			{"--simulate-layout", "Show where the files would go and what they would overwrite, without installing"},
+			{"--category <id>", "Select the components of a category"},
+			{"--max-size <size>", "Skip components that would exceed this total install size"},
+			{"--order index|largest", "Order in which components are taken for --max-size"},
+			{"--id <id>", "ID of a component installed from an archive URL"},
+			{"--dir <path>", "Directory under the base path a component from an archive URL is installed to"},
+		},
+		Examples: []string{"fpm download @server", "fpm download --category animations --max-size 20G", "fpm download https://mirror.example/foo.zip --id custom-foo --dir Data/Foo"},
+	},
+	{
+		Name:    "remove",
+		Usage:   []string{"remove [-t|--trash] [-f|--force] <component...>"},
+		Summary: "Remove installed components",
+		Details: "Deletes the files of the given components, except those another component has installed since.",
+		Flags: []FlagHelp{
+			{"-t, --trash", "Move the files to the trash instead of deleting them"},
+			{"-f, --force", "Remove files even if running programs have them open"},
+		},
+		Examples: []string{"fpm remove extra-ruffle", "fpm remove --trash 'extra-*'", "fpm remove -tf -- -odd-id"},
+	},
+	{
+		Name:    "update",
+		Usage:   []string{"update [-f|--force] [--critical-only] [--include <glob>] [--exclude <glob>] [component...]"},
+		Summary: "Update installed components",
+		Details: "Without arguments, updates every outdated component except pinned ones and those matching update.exclude, repairs broken ones and installs missing required ones. " +
+			"Named components are updated together with their dependencies.",
+		Flags: []FlagHelp{
+			{"-f, --force", "Replace files even if running programs have them open"},
+			{"--critical-only", "Only apply updates the index flags as critical or security updates"},
+		},
+		Examples: []string{"fpm update", "fpm update --critical-only", "fpm list updates --ids-only | fpm update -"},
+	},
+	{
+		Name:     "rollback",
+		Usage:    []string{"rollback <component>"},
+		Summary:  "Go back to the previous cached version",
+		Details:  "Reinstalls the newest cached version of a component other than the installed one and pins it. Needs cache-versions and a cache size.",
+		Examples: []string{"fpm rollback core-launcher"},
+	},
+	{
+		Name:    "pin",
+		Usage:   []string{"pin <component...>"},
+		Summary: "Keep components at their installed version",
+		Details: "fpm update skips pinned components, even when they are named, until they are unpinned.",
+	},
+	{
+		Name:    "unpin",
+		Usage:   []string{"unpin <component...>"},
+		Summary: "Let update change components again",
+	},
+	{
+		Name:     "tag",
+		Usage:    []string{"tag <component> <tag...>"},
+		Summary:  "Add tags to a component",
+		Examples: []string{"fpm tag core-server production", "fpm list --tag production"},
+	},
+	{
+		Name:    "untag",
+		Usage:   []string{"untag <component> <tag...>"},
+		Summary: "Remove tags from a component",
+	},
+	{
+		Name:     "note",
+		Usage:    []string{"note <component> [text]"},
+		Summary:  "Set or remove the note of a component",
+		Examples: []string{"fpm note extra-ruffle \"needed for Newgrounds games\""},
+	},
+	{
+		Name:    "snapshot",
+		Usage:   []string{"snapshot <create|restore|delete> <name>", "snapshot list"},
+		Summary: "Record and restore the installed versions",
+		Details: "create records the installed components and their versions; restore removes, downloads and changes components to return to that state. " +
+			"Versions no longer in a source are taken from the cache.",
+		Examples: []string{"fpm snapshot create before-upgrade", "fpm snapshot restore before-upgrade"},
+	},
+	{
+		Name:    "verify",
+		Usage:   []string{"verify [-a|--all] [component...]"},
+		Summary: "Check installed files against their checksums",
+		Details: "Reports files that are missing or differ from when they were installed. Exits with status 1 if any are found.",
+		Flags: []FlagHelp{
+			{"-a, --all", "Verify every installed component"},
+		},
+	},
+	{
+		Name:    "verify-downloads",
+		Usage:   []string{"verify-downloads"},
+		Summary: "Check the cached archives",
+		Details: "Deletes cached archives that do not match the hash of their version and lists cached versions no source offers any more.",
+	},
+	{
+		Name:    "resume",
+		Usage:   []string{"resume"},
+		Summary: "Finish an interrupted operation",
+	},
+	{
+		Name:    "purge",
+		Usage:   []string{"purge [--config]"},
+		Summary: "Remove everything fpm installed",
+		Details: "Removes every installed component, the state directory and the cached archives. The audit log is kept, and files fpm did not install are left alone.",
+		Flags: []FlagHelp{
+			{"--config", "Also delete fpm.cfg"},
+		},
+	},
+	{
+		Name:    "trash",
+		Usage:   []string{"trash <list|empty>"},
+		Summary: "List or empty the trash of removed files",
+	},
+	{
+		Name:    "lint",
+		Usage:   []string{"lint <archive.zip> [--path <dir>]"},
+		Summary: "Check a component archive before publishing it",
+		Details: "Reports absolute paths, entries leaving the extraction directory, names Windows cannot create or that differ only in case, symbolic links and executables. " +
+			"Exits with status 1 on errors.",
+		Flags: []FlagHelp{
+			{"--path <dir>", "Check the archive against the component's path"},
+		},
+		Examples: []string{"fpm lint extra-ruffle.zip --path Data/Ruffle"},
+	},
+	{
+		Name:    "repo",
+		Usage:   []string{"repo diff <old.xml|url> <new.xml|url>"},
+		Summary: "Compare two versions of a component index",
+		Details: "Lists the components the new index adds and removes, and those whose hash, download size, install size or dependencies changed. " +
+			"Either index can be a file or a URL.",
+		Examples: []string{"fpm repo diff components.xml https://example.org/repository/components.xml"},
+	},
+	{
+		Name:     "channel",
+		Usage:    []string{"channel [stable|unstable]"},
+		Summary:  "Show or switch the official repository",
+		Details:  "Without an argument, shows the channels and which one is in use. Switching lists the installed components that have another version on the new channel.",
+		Examples: []string{"fpm channel unstable"},
+	},
+	{
+		Name:    "status",
+		Usage:   []string{"status"},
+		Summary: "Show the base path, sources and last refresh",
+	},
+	{
+		Name:    "refresh",
+		Usage:   []string{"refresh [--source <name>]"},
+		Summary: "Fetch the component indexes now",
+		Flags: []FlagHelp{
+			{"--source <name>", "Only fetch the index of the named source"},
+		},
+	},
+	{
+		Name:    "watch",
+		Usage:   []string{"watch [--interval <seconds>]"},
+		Summary: "Print state changes of components as JSON lines",
+		Flags: []FlagHelp{
+			{"--interval <seconds>", "How often the installed components are checked"},
+		},
+	},
+	{
+		Name:    "shell",
+		Usage:   []string{"shell"},
+		Summary: "Run commands from a prompt",
+		Details: "Loads the components once and runs commands typed at a prompt until exit. refresh loads them again and history lists the commands run.",
+	},
+	{
+		Name:    "config",
+		Usage:   []string{"config <list|get|set|unset> [key] [value]", "config migrate [--dry-run]"},
+		Summary: "Show and change settings",
+		Details: "list shows every setting with its description. migrate brings an fpm.cfg written by an older fpm up to date.",
+		Flags: []FlagHelp{
+			{"--dry-run", "With migrate, show the changes without saving them"},
+		},
+		Examples: []string{"fpm config set concurrency 4", "fpm config get path"},
+	},
+	{
+		Name:    "path",
+		Usage:   []string{"path [value]"},
+		Summary: "Show or set the base path",
+	},
+	{
+		Name:     "source",
+		Usage:    []string{"source [value|edit]", "source test [name]"},
+		Summary:  "Show or set the primary source, edit all sources or test them",
+		Details:  "edit opens all sources in $VISUAL or $EDITOR. test measures how quickly each source responds and checks its hashes.",
+		Examples: []string{"fpm source edit", "fpm source test"},
+	},
+	{
+		Name:     "help",
+		Usage:    []string{"help [command]"},
+		Summary:  "Show the usage of fpm or of a command",
+		Examples: []string{"fpm help download"},
+	},
+	{
+		Name:    "generate-manpages",
+		Usage:   []string{"generate-manpages [--markdown] [dir]"},
+		Summary: "Write the man pages or a Markdown reference",
+		Details: "Writes fpm.1 and an fpm-<command>.1 page for each command to dir, or the current directory. With --markdown, writes fpm.md instead.",
+		Flags: []FlagHelp{
+			{"--markdown", "Write a single Markdown reference instead of the man pages"},
+		},
+	},
+}
+
+// findCommandHelp returns the help of the named command, following aliases
+// and unique prefixes like the command line does, or nil.
+func findCommandHelp(name string) *CommandHelp {
+	if target := config["alias."+name]; target != "" {
+		name = strings.Fields(target)[0]
+	} else if target := builtinAliases[name]; target != "" {
+		name = strings.Fields(target)[0]
 	}
-	fmt.Println()
-	fmt.Printf("Estimated download size: %s\n", formatBytes(dlSize))
-	fmt.Printf("Estimated install size:  %s\n\n", formatBytes(instSize))
+	var match *CommandHelp
+	for _, h := range commandHelp {
+		if h.Name == name {
+			return h
+		}
+		if strings.HasPrefix(h.Name, name) {
+			if match != nil {
+				return nil
+			}
+			match = h
+		}
+	}
+	return match
+}
 
-	if !confirm("Is this OK?") {
+func handleHelp(args []string) {
+	if len(args) == 0 {
+		fmt.Println(tr(helpText))
 		return
 	}
+	h := findCommandHelp(args[0])
+	if h == nil {
+		fatal(fmt.Sprintf(tr("Unknown command %s; run fpm help for a list"), args[0]))
+	}
 
-	for _, c := range toDownload {
-		if err := downloadComponent(c); err != nil {
-			fmt.Printf("Failed to download %s: %v\n", c.ID, err)
+	fmt.Printf(tr("NAME:\n    fpm %s - %s\n\nUSAGE:\n"), h.Name, tr(h.Summary))
+	for _, u := range h.Usage {
+		fmt.Println(wrapText("fpm "+u, 8, "    "))
+	}
+	if h.Details != "" {
+		fmt.Printf(tr("\nDESCRIPTION:\n%s\n"), wrapText(tr(h.Details), 4, "    "))
+	}
+	if len(h.Flags) > 0 {
+		fmt.Println(tr("\nOPTIONS:"))
+		for _, f := range h.Flags {
+			fmt.Printf("    %s\n%s\n", f.Flag, wrapText(tr(f.Description), 8, "        "))
 		}
 	}
-	fmt.Printf("\nSuccessfully downloaded %d components\n", len(toDownload))
+	if len(h.Examples) > 0 {
+		fmt.Println(tr("\nEXAMPLES:"))
+		for _, e := range h.Examples {
+			fmt.Printf("    %s\n", e)
+		}
+	}
+	fmt.Println(tr("\nGlobal options are listed by fpm help."))
 }
 
-func handleRemove(args []string) {
-	// For remove, we only explicitly remove what was asked
-	var cleanList []*Component
-	var removeSize int64
+// wrapText wraps text to 80 columns, indenting the first line by indent and
+// the following ones by hang spaces.
+func wrapText(text string, hang int, indent string) string {
+	var b strings.Builder
+	col := 0
+	for _, word := range strings.Fields(text) {
+		switch {
+		case col == 0:
+			b.WriteString(indent)
+			col = len(indent)
+		case col+1+len(word) > 80:
+			b.WriteString("\n" + strings.Repeat(" ", hang))
+			col = hang
+		default:
+			b.WriteString(" ")
+			col++
+		}
+		b.WriteString(word)
+		col += len(word)
+	}
+	return b.String()
+}
 
-	for _, arg := range args {
-		matches := findComponents(arg)
-		if len(matches) == 0 {
-			fmt.Printf("Component or category %s does not exist and will be skipped\n", arg)
-			continue
+// handleGenerateManpages writes the man pages, or with --markdown a single
+// Markdown reference, from commandHelp and globalFlags.
+func handleGenerateManpages(opts Options, args []string) {
+	dir, markdown := ".", opts.Has("markdown")
+	if len(args) > 0 {
+		dir = args[len(args)-1]
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal(err.Error())
+	}
+
+	pages := make(map[string]string)
+	if markdown {
+		pages["fpm.md"] = markdownReference()
+	} else {
+		pages["fpm.1"] = manPage(nil)
+		for _, h := range commandHelp {
+			pages["fpm-"+h.Name+".1"] = manPage(h)
 		}
-		for _, c := range matches {
-			if !c.Downloaded {
-				fmt.Printf("Component %s is not downloaded and will be skipped\n", c.ID)
-			} else {
-				cleanList = append(cleanList, c)
-				removeSize += c.InstallSize
-			}
+	}
+	var names []string
+	for name := range pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(pages[name]), 0644); err != nil {
+			fatal(err.Error())
 		}
 	}
-	cleanList = unique(cleanList)
+	fmt.Printf(tr("Wrote %d file(s) to %s\n"), len(names), dir)
+}
 
-	if len(cleanList) == 0 {
-		fmt.Println("No components to remove")
-		return
+// roff escapes text for a man page: backslashes, hyphens, which would
+// otherwise be typeset as hyphens rather than minus signs, and a leading
+// control character.
+func roff(text string) string {
+	text = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(text)
+	if strings.HasPrefix(text, ".") || strings.HasPrefix(text, "'") {
+		text = `\&` + text
 	}
+	return text
+}
 
-	fmt.Println(len(cleanList), "component(s) will be removed:")
-	for _, c := range cleanList {
-		fmt.Printf("  %s\n", c.ID)
+// manPage returns the man page of h, or of fpm itself if h is nil.
+func manPage(h *CommandHelp) string {
+	var b strings.Builder
+	flag := func(f FlagHelp) {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s\n", roff(f.Flag), roff(f.Description))
 	}
-	fmt.Println()
-	fmt.Printf("Estimated freed size: %s\n\n", formatBytes(removeSize))
 
-	if !confirm("Is this OK?") {
-		return
+	if h == nil {
+		b.WriteString(".TH FPM 1 \"\" \"fpm\" \"Flashpoint Component Manager\"\n")
+		b.WriteString(".SH NAME\nfpm \\- Flashpoint Component Manager (Linux Port)\n")
+		b.WriteString(".SH SYNOPSIS\n.B fpm\n[\\fIoptions\\fR] \\fIcommand\\fR [\\fIarguments\\fR...]\n")
+		b.WriteString(".SH DESCRIPTION\nfpm downloads, updates and removes the components of a Flashpoint installation.\n")
+		b.WriteString(".SH OPTIONS\n")
+		for _, f := range globalFlags {
+			flag(f)
+		}
+		b.WriteString(".SH COMMANDS\n")
+		for _, c := range commandHelp {
+			fmt.Fprintf(&b, ".TP\n.BR fpm\\-%s (1)\n%s\n", roff(c.Name), roff(c.Summary))
+		}
+		b.WriteString(".SH COMPONENTS\nComponents can be given by ID, by category (core), as a glob (core\\-*), " +
+			"by kind (kind:required) or as @<name> for a group or profile. A \\- reads them from standard input, one per line.\n")
+		b.WriteString(".SH FILES\n.TP\n.I fpm.cfg\nSettings, in the working directory; see \\fBfpm config list\\fR.\n")
+		return b.String()
 	}
 
-	for _, c := range cleanList {
-		removeComponent(c)
+	fmt.Fprintf(&b, ".TH FPM\\-%s 1 \"\" \"fpm\" \"Flashpoint Component Manager\"\n", roff(strings.ToUpper(h.Name)))
+	fmt.Fprintf(&b, ".SH NAME\nfpm\\-%s \\- %s\n.SH SYNOPSIS\n", roff(h.Name), roff(h.Summary))
+	for i, u := range h.Usage {
+		if i > 0 {
+			b.WriteString(".br\n")
+		}
+		fmt.Fprintf(&b, ".B fpm\n%s\n", roff(u))
+	}
+	if h.Details != "" {
+		fmt.Fprintf(&b, ".SH DESCRIPTION\n%s\n", roff(h.Details))
+	}
+	if len(h.Flags) > 0 {
+		b.WriteString(".SH OPTIONS\n")
+		for _, f := range h.Flags {
+			flag(f)
+		}
+	}
+	if len(h.Examples) > 0 {
+		b.WriteString(".SH EXAMPLES\n.nf\n")
+		for _, e := range h.Examples {
+			b.WriteString(roff(e) + "\n")
+		}
+		b.WriteString(".fi\n")
 	}
-	fmt.Printf("\nSuccessfully removed %d components\n", len(cleanList))
+	b.WriteString(".SH SEE ALSO\n.BR fpm (1)\n")
+	return b.String()
 }
 
-func handleUpdate(args []string) {
-	var toUpdate, toDownload []*Component
-
-	if len(args) > 0 {
-		visited := make(map[string]bool)
-		var recurse func(string, bool)
-		recurse = func(id string, isDepend bool) {
-			matches := findComponents(id)
-			if len(matches) == 0 {
-				if !isDepend {
-					fmt.Printf("Component or category %s does not exist\n", id)
-				}
-				return
+// markdownReference returns the documentation of every command as Markdown.
+func markdownReference() string {
+	var b strings.Builder
+	b.WriteString("# fpm command reference\n\n## Global options\n\n")
+	for _, f := range globalFlags {
+		fmt.Fprintf(&b, "- `%s`: %s\n", f.Flag, f.Description)
+	}
+	for _, h := range commandHelp {
+		fmt.Fprintf(&b, "\n## fpm %s\n\n%s.\n\n```\n", h.Name, h.Summary)
+		for _, u := range h.Usage {
+			fmt.Fprintf(&b, "fpm %s\n", u)
+		}
+		b.WriteString("```\n")
+		if h.Details != "" {
+			fmt.Fprintf(&b, "\n%s\n", h.Details)
+		}
+		if len(h.Flags) > 0 {
+			b.WriteString("\n")
+			for _, f := range h.Flags {
+				fmt.Fprintf(&b, "- `%s`: %s\n", f.Flag, f.Description)
 			}
+		}
+		if len(h.Examples) > 0 {
+			b.WriteString("\n```\n" + strings.Join(h.Examples, "\n") + "\n```\n")
+		}
+	}
+	return b.String()
+}
 
-			for _, c := range matches {
-				if visited[c.ID] {
-					continue
-				}
-				visited[c.ID] = true
+// --- Handlers ---
 
-				if !c.Downloaded {
-					if isDepend {
-						toDownload = append(toDownload, c)
-					} else {
-						fmt.Printf("Component %s is not downloaded and will be skipped\n", c.ID)
-					}
-				} else if !c.Outdated {
+func handleConfig(opts Options, args []string) {
+	if len(args) == 0 {
+		fatal(tr("A subcommand is required: list, get, set, unset or migrate"))
+	}
+
+	switch args[0] {
+	case "list":
+		for _, s := range knownSettings {
+			if !strings.Contains(s.Key, "*") {
+				fmt.Printf("%s = %s\n", s.Key, getSetting(s.Key))
+			}
+		}
+		var keys []string
+		for k, v := range config {
+			if strings.Contains(k, ".") && v != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value := config[k]
+			if isSecretKey(k) {
+				value = "********"
+			}
+			fmt.Printf("%s = %s\n", k, value)
+		}
+	case "get":
+		if len(args) < 2 {
+			fatal(tr("A configuration key is required"))
+		}
+		lookupSetting(args[1])
+		fmt.Println(getSetting(args[1]))
+	case "set":
+		if len(args) < 3 {
+			fatal(tr("A configuration key and value are required"))
+		}
+		key := args[1]
+		s := lookupSetting(key)
+		value := args[2]
+		if s.Parse != nil {
+			v, err := s.Parse(value)
+			if err != nil {
+				fatal(fmt.Sprintf(tr("Invalid value for %s: %v"), key, err))
+			}
+			value = v
+		}
+		config[key] = value
+		applyConfig()
+		writeConfig()
+	case "unset":
+		if len(args) < 2 {
+			fatal(tr("A configuration key is required"))
+		}
+		lookupSetting(args[1])
+		delete(config, args[1])
+		applyConfig()
+		writeConfig()
+	case "migrate":
+		dryRun := opts.Has("dry-run")
+		if migrationChanges == nil {
+			fmt.Printf(tr("%s is up to date (version %d)\n"), configFile, configVersion)
+			return
+		}
+		if dryRun {
+			fmt.Printf(tr("Migrating %s would:\n"), configFile)
+		} else {
+			fmt.Printf(tr("Migrated %s:\n"), configFile)
+		}
+		for _, change := range migrationChanges {
+			fmt.Printf("  %s\n", change)
+		}
+		if !dryRun {
+			migrationChanges = nil
+			writeConfig()
+		}
+	default:
+		fatal(fmt.Sprintf(tr("Unknown config subcommand %s"), args[0]))
+	}
+}
+
+// handleSourceEdit opens the list of sources in $VISUAL or $EDITOR and
+// saves it only once every source has been fetched and parsed, so a typo
+// cannot break every later command.
+func handleSourceEdit() {
+	f, err := ioutil.TempFile("", "fpm-sources-*.txt")
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not create a temporary file: %v"), err))
+	}
+	defer os.Remove(f.Name())
+
+	var b strings.Builder
+	b.WriteString(tr("# Component sources, one per line as <name> <url>. The source named\n"))
+	b.WriteString(tr("# default is the primary one; the others follow in name order.\n"))
+	for _, src := range sources() {
+		fmt.Fprintf(&b, "%s %s\n", src.Name, src.URL)
+	}
+	f.WriteString(b.String())
+	f.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	for {
+		cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fatal(fmt.Sprintf(tr("The editor failed: %v; the sources were not changed"), err))
+		}
+		data, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			fatal(err.Error())
+		}
+
+		list, problems := parseSourceList(string(data))
+		if len(problems) == 0 {
+			problems = checkSources(list)
+		}
+		if len(problems) == 0 {
+			saveSources(list)
+			fmt.Printf(tr("Saved %d source(s)\n"), len(list))
+			return
+		}
+
+		for _, p := range problems {
+			fmt.Println("  " + p)
+		}
+		if assumeYes || !confirm(tr("Edit the sources again?")) {
+			fmt.Println(tr("The sources were not changed"))
+			return
+		}
+	}
+}
+
+// parseSourceList reads the lines written by handleSourceEdit, returning
+// the sources and a description of every invalid line.
+func parseSourceList(text string) ([]Source, []string) {
+	var list []Source
+	var problems []string
+	seen := make(map[string]bool)
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			problems = append(problems, fmt.Sprintf(tr("Line %d: expected a name and a URL"), i+1))
+			continue
+		}
+		name, u := fields[0], fields[1]
+		if strings.ContainsAny(name, ".*") {
+			problems = append(problems, fmt.Sprintf(tr("Line %d: source names cannot contain . or *"), i+1))
+			continue
+		}
+		if seen[name] {
+			problems = append(problems, fmt.Sprintf(tr("Line %d: source %s is listed twice"), i+1, name))
+			continue
+		}
+		if _, err := parseURL(u); err != nil {
+			problems = append(problems, fmt.Sprintf(tr("Line %d: %v"), i+1, err))
+			continue
+		}
+		seen[name] = true
+		list = append(list, Source{Name: name, URL: u})
+	}
+	if !seen["default"] && len(problems) == 0 {
+		problems = append(problems, tr("A source named default is required"))
+	}
+	return list, problems
+}
+
+// checkSources fetches the index of every source, returning a description
+// of each that cannot be fetched or parsed.
+func checkSources(list []Source) []string {
+	problems := make([]string, len(list))
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			timeout := time.Duration(sourceIntSetting(list[i].Name, "fetch-timeout")) * time.Second
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			comps, _, err := fetchIndex(ctx, list[i])
+			if err != nil {
+				problems[i] = fmt.Sprintf("%s: %v", list[i].Name, err)
+			} else if len(comps) == 0 {
+				problems[i] = fmt.Sprintf(tr("%s: the index lists no components"), list[i].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var found []string
+	for _, p := range problems {
+		if p != "" {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// sourceHealth is what fpm source test found out about a source.
+type sourceHealth struct {
+	indexTime   time.Duration
+	archiveTime time.Duration
+	components  int
+	sample      string         // ID of the component whose archive was checked
+	algs        map[string]int // Number of components by hash algorithm
+	malformed   int            // Components with a missing or malformed hash
+	problems    []string
+}
+
+// handleSourceTest checks every source, or the named one, and prints how
+// quickly its index and a sample archive respond and whether its hashes are
+// well-formed, to help choose between mirrors.
+func handleSourceTest(args []string) {
+	list := sources()
+	if len(args) > 0 {
+		var picked []Source
+		for _, src := range list {
+			if src.Name == args[0] {
+				picked = append(picked, src)
+			}
+		}
+		if len(picked) == 0 {
+			fatal(fmt.Sprintf(tr("Source %s does not exist"), args[0]))
+		}
+		list = picked
+	}
+
+	results := make([]*sourceHealth, len(list))
+	var wg sync.WaitGroup
+	for i := range list {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = testSource(list[i])
+		}(i)
+	}
+	wg.Wait()
+
+	unhealthy := 0
+	fastest := -1
+	for i, src := range list {
+		h := results[i]
+		fmt.Printf("%s  %s\n", src.Name, src.URL)
+		if h.components > 0 {
+			fmt.Printf(tr("  Index:    %s, %d components\n"), h.indexTime.Round(100*time.Microsecond), h.components)
+		}
+		if h.sample != "" && h.archiveTime > 0 {
+			fmt.Printf(tr("  Archive:  %s (%s)\n"), h.archiveTime.Round(100*time.Microsecond), h.sample)
+		}
+		if len(h.algs) > 0 {
+			var algs []string
+			for alg, n := range h.algs {
+				algs = append(algs, fmt.Sprintf("%s (%d)", alg, n))
+			}
+			sort.Strings(algs)
+			fmt.Printf(tr("  Hashes:   %s\n"), strings.Join(algs, ", "))
+		}
+		if len(h.problems) == 0 {
+			fmt.Println(tr("  Health:   OK"))
+			if fastest < 0 || h.indexTime < results[fastest].indexTime {
+				fastest = i
+			}
+		} else {
+			unhealthy++
+			for _, p := range h.problems {
+				fmt.Printf(tr("  Problem:  %s\n"), p)
+			}
+		}
+		fmt.Println()
+	}
+
+	if len(list) > 1 && fastest >= 0 {
+		fmt.Printf(tr("%s has the fastest index of the healthy sources\n"), list[fastest].Name)
+	}
+	if unhealthy > 0 {
+		fmt.Printf(tr("%d of %d source(s) have problems\n"), unhealthy, len(list))
+		exit(1)
+	}
+}
+
+// testSource fetches the index of src, checks its hashes and requests the
+// headers of the archive of its first component with files.
+func testSource(src Source) *sourceHealth {
+	h := &sourceHealth{algs: make(map[string]int)}
+	timeout := time.Duration(sourceIntSetting(src.Name, "fetch-timeout")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	comps, _, err := fetchIndex(ctx, src)
+	h.indexTime = time.Since(start)
+	if err != nil {
+		h.problems = append(h.problems, fmt.Sprintf(tr("index: %v"), err))
+		return h
+	}
+	h.components = len(comps)
+	if len(comps) == 0 {
+		h.problems = append(h.problems, tr("the index lists no components"))
+		return h
+	}
+
+	var sample *Component
+	for _, c := range comps {
+		if sample == nil && !c.IsMeta() {
+			sample = c
+		}
+		ok := c.Hash != ""
+		for alg, value := range c.Hashes {
+			newHash := hashAlgorithms[alg]
+			if _, err := hex.DecodeString(value); newHash == nil || err != nil || len(value) != newHash().Size()*2 {
+				ok = false
+			}
+		}
+		if ok {
+			h.algs[c.HashAlg]++
+		} else {
+			h.malformed++
+		}
+	}
+	if h.malformed > 0 {
+		h.problems = append(h.problems, fmt.Sprintf(tr("%d component(s) have a missing or malformed hash"), h.malformed))
+	}
+
+	if sample == nil {
+		return h
+	}
+	h.sample = sample.ID
+	req, err := http.NewRequestWithContext(ctx, "HEAD", sample.URL, nil)
+	if err != nil {
+		h.problems = append(h.problems, fmt.Sprintf(tr("archive: %v"), err))
+		return h
+	}
+	authorize(req, archiveAuth(sample))
+	start = time.Now()
+	resp, err := clientFor(src.Name).Do(req)
+	if err != nil {
+		h.problems = append(h.problems, fmt.Sprintf(tr("archive of %s: %v"), sample.ID, networkError(err)))
+		return h
+	}
+	resp.Body.Close()
+	h.archiveTime = time.Since(start)
+	if resp.StatusCode != 200 {
+		h.problems = append(h.problems, fmt.Sprintf(tr("archive of %s: %v"), sample.ID, statusError(resp, "archive")))
+	} else if resp.ContentLength > 0 && sample.DownloadSize > 0 && resp.ContentLength != sample.DownloadSize {
+		h.problems = append(h.problems, fmt.Sprintf(tr("the archive of %s is %s, but the index gives %s"),
+			sample.ID, formatBytes(resp.ContentLength), formatBytes(sample.DownloadSize)))
+	}
+	return h
+}
+
+// saveSources replaces the configured sources with list. The settings of
+// sources that were removed are dropped with them.
+func saveSources(list []Source) {
+	keep := make(map[string]bool)
+	for _, src := range list {
+		keep[src.Name] = true
+		if src.Name == "default" {
+			config["source"] = src.URL
+		} else {
+			config["source."+src.Name] = src.URL
+		}
+	}
+	for k := range config {
+		if !strings.HasPrefix(k, "source.") {
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(k, "source."), ".", 2)[0]
+		if !keep[name] {
+			delete(config, k)
+		}
+	}
+	applyConfig()
+	writeConfig()
+}
+
+// handleChannel shows the channel the primary source is on, or switches it
+// to another official repository. Installed components whose version differs
+// on the new channel are listed first, as updating them afterwards can go
+// back to older versions when returning to a more stable channel.
+func handleChannel(args []string) {
+	current := -1
+	for i, ch := range channels {
+		if ch.URL == getSetting("source") {
+			current = i
+		}
+	}
+	if len(args) == 0 {
+		for i, ch := range channels {
+			mark := " "
+			if i == current {
+				mark = "*"
+			}
+			fmt.Printf("%s %-10s %s\n", mark, ch.Name, ch.URL)
+		}
+		if current < 0 {
+			fmt.Printf(tr("The source is %s, which is not an official channel\n"), getSetting("source"))
+		}
+		return
+	}
+
+	target := -1
+	var names []string
+	for i, ch := range channels {
+		if ch.Name == args[0] {
+			target = i
+		}
+		names = append(names, ch.Name)
+	}
+	if target < 0 {
+		fatal(fmt.Sprintf(tr("Unknown channel %s; the channels are %s"), args[0], strings.Join(names, ", ")))
+	}
+	if target == current {
+		fmt.Printf(tr("Already on the %s channel\n"), channels[target].Name)
+		return
+	}
+
+	src := Source{Name: "default", URL: channels[target].URL}
+	timeout := time.Duration(sourceIntSetting(src.Name, "fetch-timeout")) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	comps, _, err := fetchIndex(ctx, src)
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not fetch the %s channel: %v; the source was not changed"), channels[target].Name, err))
+	}
+
+	var differ []string
+	for _, c := range comps {
+		if c.Downloaded && c.Outdated {
+			differ = append(differ, c.ID)
+		}
+	}
+	if len(differ) > 0 {
+		if current >= 0 && target < current {
+			fmt.Printf(tr("%d installed component(s) have another version on the %s channel. fpm update would replace them, "+
+				"which can go back to older versions than those installed from the %s channel:\n"),
+				len(differ), channels[target].Name, channels[current].Name)
+		} else {
+			fmt.Printf(tr("%d installed component(s) have another version on the %s channel; fpm update will replace them:\n"),
+				len(differ), channels[target].Name)
+		}
+		for _, id := range differ {
+			fmt.Printf("  %s\n", id)
+		}
+		if current >= 0 && target < current && !confirm(tr("Switch channels?")) {
+			fmt.Println(tr("The source was not changed"))
+			return
+		}
+	}
+
+	config["source"] = channels[target].URL
+	applyConfig()
+	writeConfig()
+	fmt.Printf(tr("Switched to the %s channel\n"), channels[target].Name)
+}
+
+func handleStatus() {
+	lastRefresh := tr("never")
+	if data, err := ioutil.ReadFile(filepath.Join(stateDir(), "last-refresh")); err == nil {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data))); err == nil {
+			lastRefresh = formatTime(t)
+		}
+	}
+
+	fmt.Printf(tr("Base path:       %s\n"), basePath)
+	for i, src := range sources() {
+		label := tr("Sources:")
+		if i > 0 {
+			label = ""
+		}
+		fetched := ""
+		if fi, err := os.Stat(indexCachePath(src)); err == nil {
+			fetched = fmt.Sprintf(tr(", fetched %s"), formatTime(fi.ModTime()))
+		}
+		fmt.Printf("%-16s %s (%s)%s\n", label, src.Name, src.URL, fetched)
+	}
+	fmt.Printf(tr("Last refresh:    %s\n"), lastRefresh)
+
+	if err := getComponents(); err != nil {
+		fmt.Printf(tr("Components:      unavailable (%v)\n"), err)
+	} else {
+		var installed, outdated int
+		for _, c := range components {
+			if c.Downloaded {
+				installed++
+				if c.Outdated {
+					outdated++
+				}
+			}
+		}
+		fmt.Printf(tr("Installed:       %d (%d outdated)\n"), installed, outdated)
+		fmt.Printf(tr("Available:       %d\n"), len(components)-installed)
+	}
+
+	var cacheSize int64
+	for _, fi := range cachedArchives() {
+		cacheSize += fi.Size()
+	}
+	limit, _ := parseSize(getSetting("cache-max-size"))
+	fmt.Printf(tr("Cache:           %s of %s in %s\n"), formatBytes(cacheSize), formatBytes(limit), cacheDir())
+
+	if pid := lockHolder(); pid != 0 {
+		fmt.Printf(tr("Lock:            held by process %d\n"), pid)
+	} else {
+		fmt.Println(tr("Lock:            not held"))
+	}
+}
+
+func handleList(opts Options, args []string) {
+	filter := ""
+	verbose := false
+	idsOnly := false
+	tree := false
+
+	kind := opts.Value("kind")
+	tag := opts.Value("tag")
+	idsOnly = opts.Has("ids-only")
+	var minSize int64
+	var updatedSince, installedBefore time.Time
+	if opts.Has("min-size") {
+		size, err := parseSize(opts.Value("min-size"))
+		if err != nil {
+			fatal(err.Error())
+		}
+		minSize = size
+	}
+	for name, t := range map[string]*time.Time{"updated-since": &updatedSince, "installed-before": &installedBefore} {
+		if opts.Has(name) {
+			date, err := parseDate(opts.Value(name))
+			if err != nil {
+				fatal(err.Error())
+			}
+			*t = date
+		}
+	}
+
+	for _, arg := range args[1:] {
+		switch arg {
+		case "verbose":
+			verbose = true
+		case "tree":
+			tree = true
+		default:
+			filter = arg
+		}
+	}
+
+	if kind != "" && kind != "required" && kind != "recommended" && kind != "optional" {
+		fatal(fmt.Sprintf(tr("Unknown kind %s; use required, recommended or optional"), kind))
+	}
+
+	if filter == "profiles" {
+		printProfiles()
+		return
+	}
+
+	if len(components) == 0 && !idsOnly {
+		fmt.Println(tr("No components found. Please check your source URL or internet connection."))
+		return
+	}
+
+	var shown []*Component
+	for _, c := range components {
+		if filter == "available" && c.Downloaded {
+			continue
+		}
+		if filter == "downloaded" && !c.Downloaded {
+			continue
+		}
+		if filter == "updates" && !c.Outdated {
+			continue
+		}
+		if filter == "broken" && !c.Broken {
+			continue
+		}
+		if kind != "" && c.Kind != kind {
+			continue
+		}
+		if tag != "" && !hasTag(c.ID, tag) {
+			continue
+		}
+		if c.InstallSize < minSize || c.LastUpdated.Before(updatedSince) {
+			continue
+		}
+		if !installedBefore.IsZero() && (!c.Downloaded || !installTime(c).Before(installedBefore)) {
+			continue
+		}
+		shown = append(shown, c)
+	}
+
+	if tree && !idsOnly {
+		printTree(shown, verbose)
+		return
+	}
+
+	for _, c := range shown {
+		// Bare IDs are a stable interface for completion scripts and wrappers
+		if idsOnly {
+			fmt.Println(c.ID)
+			continue
+		}
+
+		output := fmt.Sprintf("%s %s", statusGlyph(c), c.ID)
+		if verbose {
+			output += fmt.Sprintf(" (%s)", c.Title)
+		}
+		if c.IsMeta() {
+			output += tr(" [meta]")
+		}
+		if c.Pinned {
+			output += tr(" [pinned]")
+		}
+		if c.Outdated && c.Critical {
+			output += colorize(tr(" [critical]"), colorRed)
+		}
+		if a := annotations()[c.ID]; a != nil {
+			if len(a.Tags) > 0 {
+				output += " #" + strings.Join(a.Tags, " #")
+			}
+			if verbose && a.Note != "" {
+				output += " - " + a.Note
+			}
+		}
+		fmt.Println(output)
+	}
+
+	if filter == "updates" && !idsOnly && len(shown) > 0 {
+		var dlSize, changeSize int64
+		critical := 0
+		for _, c := range shown {
+			dlSize += c.DownloadSize
+			changeSize += c.InstallSize - c.OldSize
+			if c.Critical {
+				critical++
+			}
+		}
+		fmt.Printf(tr("\n%d update(s), %d critical: %s to download, %s changed size\n"),
+			len(shown), critical, formatBytes(dlSize), formatBytes(changeSize))
+	}
+}
+
+// statusGlyph marks installed components in listings: * when up to date, !
+// when outdated and x when broken.
+func statusGlyph(c *Component) string {
+	switch {
+	case !c.Downloaded:
+		return " "
+	case c.Broken:
+		return colorize("x", colorRed)
+	case c.Outdated:
+		return colorize("!", colorYellow)
+	}
+	return colorize("*", colorGreen)
+}
+
+// printTree lists components under their categories, indented by depth.
+// Categories show the install size and status of everything below them, with
+// ~ when only some of it is installed.
+func printTree(list []*Component, verbose bool) {
+	children := make(map[string][]*Category)
+	for _, cat := range categories {
+		children[cat.Parent] = append(children[cat.Parent], cat)
+	}
+	members := make(map[string][]*Component)
+	for _, c := range list {
+		members[c.Category] = append(members[c.Category], c)
+	}
+
+	// below returns the listed components in a category and its descendants
+	var below func(id string) []*Component
+	below = func(id string) []*Component {
+		all := append([]*Component{}, members[id]...)
+		for _, sub := range children[id] {
+			all = append(all, below(sub.ID)...)
+		}
+		return all
+	}
+
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		indent := strings.Repeat("  ", depth)
+		for _, c := range members[parent] {
+			output := fmt.Sprintf("%s %s%s", statusGlyph(c), indent, c.ID)
+			if verbose {
+				output += fmt.Sprintf(" (%s)", c.Title)
+			}
+			if c.IsMeta() {
+				output += tr(" [meta]")
+			} else {
+				output += "  " + formatBytes(c.InstallSize)
+			}
+			fmt.Println(output)
+		}
+		for _, cat := range children[parent] {
+			comps := below(cat.ID)
+			if len(comps) == 0 {
+				continue
+			}
+			var size int64
+			installed, outdated, broken := 0, 0, 0
+			for _, c := range comps {
+				size += c.InstallSize
+				if c.Downloaded {
+					installed++
+				}
+				if c.Outdated {
+					outdated++
+				}
+				if c.Broken {
+					broken++
+				}
+			}
+			glyph := " "
+			switch {
+			case broken > 0:
+				glyph = colorize("x", colorRed)
+			case outdated > 0:
+				glyph = colorize("!", colorYellow)
+			case installed == len(comps):
+				glyph = colorize("*", colorGreen)
+			case installed > 0:
+				glyph = "~"
+			}
+			label := cat.ID
+			if cat.Title != "" {
+				label += " (" + cat.Title + ")"
+			}
+			fmt.Printf(tr("%s %s%s  [%d/%d installed, %s]\n"), glyph, indent, label, installed, len(comps), formatBytes(size))
+			walk(cat.ID, depth+1)
+		}
+	}
+	walk("", 0)
+}
+
+// ComponentInfo is the output of fpm info --json. Attributes holds every
+// attribute of the component in the index as given, so tools can read fields
+// fpm does not interpret.
+type ComponentInfo struct {
+	ID           string            `json:"id"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Source       string            `json:"source"`
+	Category     string            `json:"category,omitempty"`
+	Kind         string            `json:"kind"`
+	Locale       string            `json:"locale,omitempty"`
+	URL          string            `json:"url"`
+	Path         string            `json:"path"`
+	Hash         string            `json:"hash"`
+	DownloadSize int64             `json:"download_size"`
+	InstallSize  int64             `json:"install_size"`
+	FileCount    int               `json:"file_count,omitempty"`
+	LastUpdated  *time.Time        `json:"last_updated,omitempty"`
+	Depends      []string          `json:"depends,omitempty"`
+	Conflicts    []string          `json:"conflicts,omitempty"`
+	Replaces     []string          `json:"replaces,omitempty"`
+	Downloaded   bool              `json:"downloaded"`
+	Outdated     bool              `json:"outdated"`
+	Broken       bool              `json:"broken"`
+	Pinned       bool              `json:"pinned"`
+	Critical     bool              `json:"critical,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Note         string            `json:"note,omitempty"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+}
+
+func printInfoJSON(c *Component) {
+	info := ComponentInfo{
+		ID:           c.ID,
+		Title:        c.Title,
+		Description:  c.Description,
+		Source:       c.Source,
+		Category:     c.Category,
+		Kind:         c.Kind,
+		Locale:       c.Locale,
+		URL:          c.URL,
+		Path:         c.Directory,
+		Hash:         c.TaggedHash(),
+		DownloadSize: c.DownloadSize,
+		InstallSize:  c.InstallSize,
+		FileCount:    c.FileCount,
+		Depends:      c.Depends,
+		Conflicts:    c.Conflicts,
+		Replaces:     c.Replaces,
+		Downloaded:   c.Downloaded,
+		Outdated:     c.Outdated,
+		Broken:       c.Broken,
+		Pinned:       c.Pinned,
+		Critical:     c.Critical,
+	}
+	if !c.LastUpdated.IsZero() {
+		info.LastUpdated = &c.LastUpdated
+	}
+	if a := annotations()[c.ID]; a != nil {
+		info.Tags, info.Note = a.Tags, a.Note
+	}
+	if len(c.Attrs) > 0 {
+		info.Attributes = make(map[string]string, len(c.Attrs))
+		for _, attr := range c.Attrs {
+			info.Attributes[attr.Name.Local] = attr.Value
+		}
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		fatal(err.Error())
+	}
+	fmt.Println(string(data))
+}
+
+func handleInfo(opts Options, args []string) {
+	if len(args) > 1 {
+		fatal(tr("Only one component can be given; see fpm help info"))
+	}
+	id := args[0]
+	contents, asJSON := opts.Has("contents"), opts.Has("json")
+	c, exists := compMap[id]
+	if !exists {
+		fatal(tr("Specified component does not exist"))
+	}
+	if asJSON {
+		printInfoJSON(c)
+		return
+	}
+
+	fmt.Printf(tr("ID:             %s\n"), c.ID)
+	fmt.Printf(tr("Title:          %s\n"), c.Title)
+	fmt.Printf(tr("Description:    %s\n"), c.Description)
+	fmt.Printf(tr("Download size:  %s\n"), formatBytes(c.DownloadSize))
+	if c.IsMeta() {
+		fmt.Println(tr("Install size:   none (meta component)"))
+	} else {
+		fmt.Printf(tr("Install size:   %s\n"), formatBytes(c.InstallSize))
+	}
+	var files []*zip.File
+	if contents && !c.IsMeta() {
+		var err error
+		if files, err = archiveEntries(c); err != nil {
+			warn(fmt.Sprintf(tr("Warning: Could not read the archive of %s: %v"), c.ID, err))
+		}
+	} else if r, err := zip.OpenReader(filepath.Join(cacheDir(), archiveName(c))); err == nil {
+		// Counting the files of a cached archive costs nothing
+		files = r.File
+		r.Close()
+	}
+	if count := countFiles(files); count > 0 {
+		fmt.Printf(tr("Files:          %s\n"), formatCount(count))
+	} else if c.FileCount > 0 {
+		fmt.Printf(tr("Files:          %s\n"), formatCount(c.FileCount))
+	}
+	fmt.Printf(tr("Last updated:   %s\n"), formatTime(c.LastUpdated))
+	fmt.Printf(tr("Hash:           %s\n"), c.TaggedHash())
+	fmt.Printf(tr("Source:         %s\n"), c.Source)
+	if c.Locale != "" {
+		fmt.Printf(tr("Locale:         %s\n"), c.Locale)
+	}
+	if others := len(providers[c.ID]) - 1; others > 0 {
+		fmt.Printf(tr("                (also in %d other source(s), see fpm which-source)\n"), others)
+	}
+	if a := annotations()[c.ID]; a != nil {
+		if len(a.Tags) > 0 {
+			fmt.Printf(tr("Tags:           %s\n"), strings.Join(a.Tags, ", "))
+		}
+		if a.Note != "" {
+			fmt.Printf(tr("Note:           %s\n"), a.Note)
+		}
+	}
+	fmt.Println()
+
+	if len(c.Depends) > 0 {
+		fmt.Printf(tr("Dependencies: \n  %s\n\n"), strings.Join(c.Depends, "\n  "))
+	}
+
+	req := tr("No")
+	if c.Kind == "required" {
+		req = tr("Yes")
+	} else if c.Kind == "recommended" {
+		req = tr("No (recommended)")
+	}
+	fmt.Printf(tr("Required?       %s\n"), req)
+
+	down := tr("No")
+	if c.Downloaded {
+		down = tr("Yes")
+	}
+	fmt.Printf(tr("Downloaded?     %s\n"), down)
+
+	if c.Downloaded {
+		upToDate := tr("Yes")
+		if c.Outdated {
+			upToDate = tr("No")
+		}
+		fmt.Printf(tr("Up-to-date?     %s\n"), upToDate)
+		if c.Broken {
+			fmt.Println(tr("Broken?         Yes, files are missing or changed; run fpm update to repair"))
+		}
+		if c.Pinned {
+			fmt.Println(tr("Pinned?         Yes, update skips it until fpm unpin"))
+		}
+	}
+
+	if contents && countFiles(files) > 0 {
+		fmt.Println()
+		printContents(files)
+	}
+}
+
+// countFiles returns the number of files among entries that would be
+// installed, leaving out directories and maintainer scripts.
+func countFiles(entries []*zip.File) int {
+	n := 0
+	for _, f := range entries {
+		if !f.FileInfo().IsDir() && !strings.HasPrefix(f.Name, scriptDir) {
+			n++
+		}
+	}
+	return n
+}
+
+// printContents summarizes the files of an archive: the largest file and
+// how many files of which type it holds, by extension, largest share first.
+func printContents(entries []*zip.File) {
+	type share struct {
+		ext   string
+		files int
+		size  int64
+	}
+	byExt := make(map[string]*share)
+	var largest *zip.File
+	for _, f := range entries {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, scriptDir) {
+			continue
+		}
+		if largest == nil || f.UncompressedSize64 > largest.UncompressedSize64 {
+			largest = f
+		}
+		ext := strings.ToLower(path.Ext(f.Name))
+		if ext == "" {
+			ext = tr("(none)")
+		}
+		if byExt[ext] == nil {
+			byExt[ext] = &share{ext: ext}
+		}
+		byExt[ext].files++
+		byExt[ext].size += int64(f.UncompressedSize64)
+	}
+
+	var shares []*share
+	for _, sh := range byExt {
+		shares = append(shares, sh)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].size != shares[j].size {
+			return shares[i].size > shares[j].size
+		}
+		return shares[i].ext < shares[j].ext
+	})
+
+	fmt.Printf(tr("Largest file:   %s (%s)\n"), largest.Name, formatBytes(int64(largest.UncompressedSize64)))
+	fmt.Println(tr("Contents:"))
+	const shown = 10
+	if len(shares) > shown {
+		other := &share{ext: tr("other")}
+		for _, rest := range shares[shown-1:] {
+			other.files += rest.files
+			other.size += rest.size
+		}
+		shares = append(shares[:shown-1], other)
+	}
+	for _, sh := range shares {
+		fmt.Printf(tr("  %-12s %8s files  %s\n"), sh.ext, formatCount(sh.files), formatBytes(sh.size))
+	}
+}
+
+func handleDownload(opts Options, args []string) {
+	tree := opts.Has("tree") || getSetting("plan-view") == "tree"
+	simulate := opts.Has("simulate-layout")
+	localID, localDir := opts.Value("id"), opts.Value("dir")
+	var maxSize int64
+	if opts.Has("max-size") {
+		value := opts.Value("max-size")
+		size, err := parseSize(value)
+		if err != nil || size <= 0 {
+			fatal(fmt.Sprintf(tr("Invalid size %s"), value))
+		}
+		maxSize = size
+	}
+	largest := false
+	if opts.Has("order") {
+		value := opts.Value("order")
+		if value != "index" && value != "largest" {
+			fatal(fmt.Sprintf(tr("Unknown order %s; use index or largest"), value))
+		}
+		largest = value == "largest"
+	}
+
+	// --category is the same as naming the category, but reads better with
+	// --max-size
+	ids := append([]string(nil), opts["category"]...)
+	var urls []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+			urls = append(urls, arg)
+		} else {
+			ids = append(ids, arg)
+		}
+	}
+	if len(urls) == 0 && (localID != "" || localDir != "") {
+		fatal(tr("--id and --dir can only be given with an archive URL"))
+	}
+	if len(urls) > 1 && localID != "" {
+		fatal(tr("--id can only be given with a single archive URL"))
+	}
+	var local []*Component
+	for _, u := range urls {
+		c := newLocalComponent(u, localID, localDir)
+		ids = append(ids, c.ID)
+		local = append(local, c)
+	}
+	// They are only recorded once the download is confirmed
+	addLocalComponents(local)
+	args = ids
+
+	toDownload := resolveQueue(args, func(c *Component) bool {
+		return !c.Downloaded
+	})
+
+	if len(toDownload) == 0 {
+		fmt.Println(tr("No components to download"))
+		return
+	}
+	if simulate {
+		for _, c := range toDownload {
+			printLayout(c)
+		}
+		return
+	}
+	measureInstallSizes(toDownload)
+	if maxSize > 0 {
+		var skipped int
+		toDownload, skipped = fitBudget(toDownload, maxSize, largest)
+		if skipped > 0 {
+			warn(fmt.Sprintf(tr("%d component(s) do not fit in %s and are skipped"), skipped, formatBytes(maxSize)))
+		}
+		if len(toDownload) == 0 {
+			fmt.Println(tr("No components to download"))
+			return
+		}
+	}
+	toRemove := resolveConflicts(toDownload)
+
+	var dlSize, instSize int64
+	fmt.Printf(tr("%d component(s) will be downloaded:\n"), len(toDownload))
+	if tree {
+		printPlanTree(args, toDownload)
+	}
+	for _, c := range toDownload {
+		if !tree {
+			fmt.Printf("  %s\n", c.ID)
+		}
+		dlSize += c.DownloadSize
+		instSize += c.InstallSize
+	}
+	fmt.Println()
+	printConflictRemovals(toRemove, toDownload)
+	fmt.Printf(tr("Estimated download size: %s\n"), formatBytes(dlSize))
+	fmt.Printf(tr("Estimated install size:  %s\n\n"), formatBytes(instSize))
+
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	plan := newPlan("download", toRemove, nil, toDownload)
+	failed := executePlan(plan)
+	if len(local) > 0 {
+		// Now that they are installed, their size is known
+		for _, c := range local {
+			c.InstallSize = installedSize(c)
+		}
+		forgetLocalComponents(local)
+		saveLocalComponents()
+	}
+	if n := plan.succeeded(toDownload); n > 0 {
+		fmt.Printf(tr("\nSuccessfully downloaded %d components\n"), n)
+	}
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+// layoutListMax limits how many new directories and existing files
+// printLayout lists for each component.
+const layoutListMax = 20
+
+// printLayout shows where the files of c would go under the base path, from
+// the central directory of its archive: the top-level paths, the directories
+// that would be created and the existing files that would be overwritten.
+func printLayout(c *Component) {
+	if c.IsMeta() {
+		fmt.Printf(tr("%s installs no files\n\n"), c.ID)
+		return
+	}
+	entries, err := archiveEntries(c)
+	if err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not read the archive of %s: %v"), c.ID, err))
+		return
+	}
+
+	include, exclude := extractFilters(c)
+	type topPath struct {
+		files int
+		size  int64
+	}
+	tops := make(map[string]*topPath)
+	var topOrder, newDirs, manual, owned []string
+	seenDirs := make(map[string]bool)
+	for _, f := range entries {
+		if f.FileInfo().IsDir() || !filterEntry(f.Name, include, exclude) {
+			continue
+		}
+		rel, ok := localPath(filepath.FromSlash(path.Join(c.Directory, f.Name)))
+		if !ok {
+			continue
+		}
+		top := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		if tops[top] == nil {
+			tops[top] = &topPath{}
+			topOrder = append(topOrder, top)
+		}
+		tops[top].files++
+		tops[top].size += int64(f.UncompressedSize64)
+
+		for dir := filepath.Dir(rel); dir != "." && !seenDirs[dir]; dir = filepath.Dir(dir) {
+			seenDirs[dir] = true
+			if _, err := storage.Stat(dir); os.IsNotExist(err) {
+				newDirs = append(newDirs, filepath.ToSlash(dir)+"/")
+			}
+		}
+		if _, err := storage.Stat(rel); err == nil {
+			if owner := fileOwner(rel); owner == "" {
+				manual = append(manual, filepath.ToSlash(rel))
+			} else if owner != c.ID {
+				owned = append(owned, fmt.Sprintf(tr("%s (installed by %s)"), filepath.ToSlash(rel), owner))
+			}
+		}
+	}
+	sort.Strings(newDirs)
+
+	fmt.Printf(tr("%s would install into %s:\n"), c.ID, basePath)
+	for _, top := range topOrder {
+		state := tr("new")
+		if _, err := storage.Stat(top); err == nil {
+			state = tr("exists")
+		}
+		name := top
+		if tops[top].files > 1 || seenDirs[top] {
+			name += "/"
+		}
+		fmt.Printf(tr("  %-30s %s, %s file(s), %s\n"), name, state, formatCount(tops[top].files), formatBytes(tops[top].size))
+	}
+	for _, group := range []struct {
+		title string
+		list  []string
+	}{
+		{tr("Directories that would be created:"), newDirs},
+		{tr("Files not installed by fpm that would be overwritten:"), manual},
+		{tr("Files of other components that would be overwritten:"), owned},
+	} {
+		if len(group.list) == 0 {
+			continue
+		}
+		fmt.Println(group.title)
+		for i, p := range group.list {
+			if i == layoutListMax {
+				fmt.Printf(tr("  ... and %d more\n"), len(group.list)-layoutListMax)
+				break
+			}
+			fmt.Printf("  %s\n", p)
+		}
+	}
+	fmt.Println()
+}
+
+// fitBudget selects the components of list whose install size, together
+// with that of their dependencies, fits in budget. Components are taken in
+// index order, or largest first, and those that do not fit are skipped in
+// favor of smaller ones. It returns the selection and the number skipped.
+func fitBudget(list []*Component, budget int64, largest bool) ([]*Component, int) {
+	inPlan := make(map[*Component]bool)
+	for _, c := range list {
+		inPlan[c] = true
+	}
+	order := append([]*Component(nil), list...)
+	if largest {
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].InstallSize > order[j].InstallSize
+		})
+	}
+
+	chosen := make(map[*Component]bool)
+	var used int64
+	skipped := 0
+	for _, c := range order {
+		if chosen[c] {
+			continue
+		}
+		// c and the dependencies it would pull in that are not chosen yet
+		closure := make(map[*Component]bool)
+		var size int64
+		var add func(c *Component)
+		add = func(c *Component) {
+			if closure[c] || chosen[c] || !inPlan[c] {
+				return
+			}
+			closure[c] = true
+			size += c.InstallSize
+			for _, dep := range c.Depends {
+				for _, d := range findComponents(dep) {
+					add(d)
+				}
+			}
+		}
+		add(c)
+		if used+size > budget {
+			skipped++
+			continue
+		}
+		used += size
+		for d := range closure {
+			chosen[d] = true
+		}
+	}
+
+	var fit []*Component
+	for _, c := range list {
+		if chosen[c] {
+			fit = append(fit, c)
+		}
+	}
+	return fit, skipped
+}
+
+// printPlanTree shows the components to download under the ones requested
+// in args, each dependency nested below the component that first pulled it
+// in, with the download size of every branch.
+func printPlanTree(args []string, list []*Component) {
+	inPlan := make(map[*Component]bool)
+	for _, c := range list {
+		inPlan[c] = true
+	}
+
+	children := make(map[*Component][]*Component)
+	claimed := make(map[*Component]bool)
+	var claim func(c *Component)
+	claim = func(c *Component) {
+		for _, dep := range c.Depends {
+			for _, d := range findComponents(dep) {
+				if inPlan[d] && !claimed[d] {
+					claimed[d] = true
+					children[c] = append(children[c], d)
+					claim(d)
+				}
+			}
+		}
+	}
+
+	var requested []*Component
+	for _, arg := range args {
+		requested = append(requested, findComponents(arg)...)
+	}
+	var roots []*Component
+	for _, c := range append(requested, list...) {
+		if inPlan[c] && !claimed[c] {
+			claimed[c] = true
+			roots = append(roots, c)
+			claim(c)
+		}
+	}
+
+	var branchSize func(c *Component) (int64, int)
+	branchSize = func(c *Component) (int64, int) {
+		size, count := c.DownloadSize, 0
+		for _, d := range children[c] {
+			s, n := branchSize(d)
+			size += s
+			count += n + 1
+		}
+		return size, count
+	}
+
+	var show func(c *Component, depth int)
+	show = func(c *Component, depth int) {
+		line := "  " + strings.Repeat("   ", depth)
+		if depth > 0 {
+			line += "-> "
+		}
+		line += c.ID + "  " + formatBytes(c.DownloadSize)
+		if size, n := branchSize(c); n > 0 {
+			line += fmt.Sprintf(tr(" (%s with %d dependencies)"), formatBytes(size), n)
+		}
+		fmt.Println(line)
+		for _, d := range children[c] {
+			show(d, depth+1)
+		}
+	}
+	for _, c := range roots {
+		show(c, 0)
+	}
+}
+
+func handleRemove(opts Options, args []string) {
+	// For remove, we only explicitly remove what was asked
+	var cleanList []*Component
+	var removeSize int64
+
+	trash, force := opts.Has("trash") || getSetting("trash") == "on", opts.Has("force")
+	if trash {
+		trashBatch = filepath.Join(trashDir(), time.Now().Format("20060102-150405"))
+		defer func() { trashBatch = "" }()
+	}
+
+	for _, arg := range args {
+		matches := findComponents(arg)
+		if len(matches) == 0 {
+			warn(fmt.Sprintf(tr("Component or category %s does not exist and will be skipped"), arg))
+			continue
+		}
+		for _, c := range matches {
+			if !c.Downloaded {
+				warn(fmt.Sprintf(tr("Component %s is not downloaded and will be skipped"), c.ID))
+			} else {
+				cleanList = append(cleanList, c)
+				removeSize += c.InstallSize
+			}
+		}
+	}
+	cleanList = unique(cleanList)
+
+	if len(cleanList) == 0 {
+		fmt.Println(tr("No components to remove"))
+		return
+	}
+
+	fmt.Printf(tr("%d component(s) will be removed:\n"), len(cleanList))
+	for _, c := range cleanList {
+		fmt.Printf("  %s\n", c.ID)
+	}
+	fmt.Println()
+	if trash {
+		fmt.Printf(tr("The files will be moved to %s; run fpm trash empty to free the space\n\n"), trashBatch)
+	} else {
+		fmt.Printf(tr("Estimated freed size: %s\n\n"), formatBytes(removeSize))
+	}
+	checkInUse(cleanList, force)
+
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	plan := newPlan("remove", cleanList, nil, nil)
+	failed := executePlan(plan)
+	forgetLocalComponents(cleanList)
+	if n := plan.succeeded(cleanList); n > 0 {
+		fmt.Printf(tr("\nSuccessfully removed %d components\n"), n)
+	}
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+// handlePurge removes every installed component, the state directory and the
+// cached archives, and with --config the config file, leaving only the audit
+// log and files fpm did not install. It works from the info files alone, so
+// components no source provides any more are removed too.
+func handlePurge(opts Options, args []string) {
+	if len(args) > 0 {
+		fatal(fmt.Sprintf(tr("Unexpected argument %s"), args[0]))
+	}
+	withConfig := opts.Has("config")
+
+	ids, err := infoFileNames()
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err.Error())
+	}
+	var installed []*Component
+	for _, id := range ids {
+		installed = append(installed, &Component{ID: id})
+	}
+	archives := cachedArchives()
+
+	fmt.Printf(tr("%d component(s) will be removed from %s:\n"), len(installed), basePath)
+	for _, c := range installed {
+		fmt.Printf("  %s\n", c.ID)
+	}
+	fmt.Printf(tr("\nThe state directory %s and %d cached archive(s) in %s will be deleted.\n"), stateDir(), len(archives), cacheDir())
+	fmt.Printf(tr("The audit log %s is kept.\n"), auditPath())
+	if withConfig {
+		fmt.Printf(tr("The config file %s will be deleted.\n"), configFile)
+	}
+	fmt.Println()
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	beginTransaction()
+	var preRemove []scriptRun
+	for _, c := range installed {
+		preRemove = append(preRemove, scriptRun{c, "remove"})
+	}
+	runScripts("pre-remove", preRemove)
+
+	ui.begin(len(installed), 0)
+	for _, c := range installed {
+		e := report.begin(c, "remove")
+		e.reason = "purge"
+		removeComponent(c, e)
+		e.finish(nil)
+		if listed := compMap[c.ID]; listed != nil {
+			listed.Downloaded = false
+		}
+		transactionChanges["remove"] = append(transactionChanges["remove"], c.ID)
+	}
+	ui.end()
+	os.Remove(filepath.Join(basePath, "Components"))
+
+	for _, fi := range archives {
+		os.Remove(filepath.Join(cacheDir(), fi.Name()))
+	}
+	// The cache directory may be shared, so it is only removed once empty
+	os.Remove(cacheDir())
+	os.Remove(stagingDir())
+	clearStateDir()
+	if withConfig {
+		if err := os.Remove(configFile); err != nil && !os.IsNotExist(err) {
+			warn(fmt.Sprintf(tr("Warning: Could not delete %s: %v"), configFile, err))
+		}
+	}
+
+	fmt.Printf(tr("\nPurged %d components\n"), len(installed))
+	releaseLock()
+	runPostTransaction("purge")
+}
+
+// clearStateDir deletes the state directory, except for the audit log, which
+// holds the record of what a purge deleted.
+func clearStateDir() {
+	keep := filepath.Clean(auditPath())
+	infos, err := ioutil.ReadDir(stateDir())
+	if err != nil && !os.IsNotExist(err) {
+		warn(fmt.Sprintf(tr("Warning: Could not delete %s: %v"), stateDir(), err))
+	}
+	for _, fi := range infos {
+		p := filepath.Join(stateDir(), fi.Name())
+		if p == keep || strings.HasPrefix(keep, p+string(os.PathSeparator)) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			warn(fmt.Sprintf(tr("Warning: Could not delete %s: %v"), p, err))
+		}
+	}
+	// Only removed if the audit log was not kept in it
+	os.Remove(stateDir())
+}
+
+func handleResume() {
+	plan, err := loadPlan()
+	if err != nil {
+		fmt.Println(tr("There is no interrupted operation to resume"))
+		return
+	}
+
+	remaining := 0
+	for _, st := range plan.Steps {
+		if !st.Done {
+			remaining++
+		}
+	}
+	fmt.Printf(tr("Resuming %s from %s: %d of %d step(s) remaining\n\n"),
+		plan.Command, formatTime(plan.Created), remaining, len(plan.Steps))
+	if executePlan(plan) > 0 {
+		exit(1)
+	}
+}
+
+// handleWhichSource shows which sources provide each component and which of
+// them wins: the primary source, then the others in name order.
+func handleWhichSource(ids []string) {
+	urls := make(map[string]string)
+	for _, src := range sources() {
+		urls[src.Name] = src.URL
+	}
+
+	for i, id := range ids {
+		list := providers[id]
+		if len(list) == 0 {
+			fmt.Printf(tr("Component %s is not provided by any source\n"), id)
+			continue
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s:\n", id)
+		for j, c := range list {
+			mark := " "
+			if j == 0 {
+				mark = "*"
+			}
+			fmt.Printf("%s %s (%s)\n    %s", mark, c.Source, urls[c.Source], c.TaggedHash())
+			if !c.LastUpdated.IsZero() {
+				fmt.Printf(tr(", updated %s"), formatTime(c.LastUpdated))
+			}
+			fmt.Println()
+		}
+		if len(list) > 1 {
+			fmt.Printf(tr("  %s wins as the source with the highest priority\n"), list[0].Source)
+		}
+	}
+}
+
+// handleRollback reinstalls the newest cached version of a component other
+// than the installed one, and pins it so that update leaves it alone.
+func handleRollback(id string) {
+	c, exists := compMap[id]
+	if !exists {
+		fatal(tr("Specified component does not exist"))
+	}
+	if !c.Downloaded {
+		fatal(fmt.Sprintf(tr("Component %s is not downloaded"), c.ID))
+	}
+
+	installed := installedHash(c.ID)
+	_, installedValue := splitHash(installed)
+
+	var previous os.FileInfo
+	for _, fi := range cachedArchives() {
+		if archiveComponent(fi.Name()) != c.ID {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(fi.Name(), ".zst"), ".zip")
+		if strings.EqualFold(name[len(c.ID)+1:], installedValue) {
+			continue
+		}
+		if previous == nil || fi.ModTime().After(previous.ModTime()) {
+			previous = fi
+		}
+	}
+	if previous == nil {
+		fatal(fmt.Sprintf(tr("No other version of %s is in the cache; set cache-max-size and cache-versions to keep previous versions"), c.ID))
+	}
+
+	old := *c
+	useCachedVersion(&old, strings.TrimSuffix(strings.TrimSuffix(previous.Name(), ".zst"), ".zip")[len(c.ID)+1:])
+
+	fmt.Printf(tr("%s will be rolled back from %s to %s, cached on %s\n\n"), c.ID, installed, old.TaggedHash(), formatTime(previous.ModTime()))
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	ui.begin(1, 0)
+	e := report.begin(c, "rollback")
+	e.reason = "rollback"
+	err := downloadComponent(&old, e, func() { removeComponent(c, e) })
+	e.finish(err)
+	ui.end()
+	finishTransaction()
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Failed to roll back %s: %v"), c.ID, err))
+	}
+
+	transactionChanges["rollback"] = append(transactionChanges["rollback"], c.ID)
+	runScripts("post-install", []scriptRun{{c, "rollback"}})
+	setPinned([]string{c.ID}, true)
+	fmt.Printf(tr("\nRolled back %s; it is pinned until fpm unpin %s\n"), c.ID, c.ID)
+}
+
+// useCachedVersion makes c refer to the version with the given hash in the
+// cache, decompressing it so its install size can be read.
+func useCachedVersion(c *Component, hash string) {
+	c.HashAlg, c.Hash = splitHash(hash)
+	if alg := hashAlgOf(hash); alg != "" && !strings.Contains(hash, ":") {
+		c.HashAlg = alg
+	}
+	c.Hashes = map[string]string{c.HashAlg: c.Hash}
+	cached := filepath.Join(cacheDir(), archiveName(c))
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		decompressArchive(cached + ".zst")
+	}
+	if r, err := zip.OpenReader(cached); err == nil {
+		c.InstallSize = 0
+		for _, f := range r.File {
+			c.InstallSize += int64(f.UncompressedSize64)
+		}
+		r.Close()
+	}
+}
+
+// installTime returns when c was last installed or updated, taken from its
+// info file.
+func installTime(c *Component) time.Time {
+	fi, err := storage.Stat(filepath.Join("Components", c.ID))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// installedHash returns the hash recorded in the info file of the installed
+// component id, or "" if it is not installed. It is tagged with its algorithm
+// unless written by an older version.
+func installedHash(id string) string {
+	data, err := readStoredFile(filepath.Join("Components", id))
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(strings.SplitN(string(data), "\n", 2)[0], " ", 2)[0]
+}
+
+func snapshotPath(name string) string {
+	return filepath.Join(stateDir(), "snapshots", name)
+}
+
+// handleSnapshot records the installed components and their versions under
+// a name, and brings the installation back to such a record. Versions that
+// are no longer in a source are restored from the cache.
+func handleSnapshot(args []string) {
+	if len(args) == 0 {
+		fatal(tr("A snapshot subcommand is required: create, restore, delete or list"))
+	}
+	if args[0] == "list" {
+		entries, _ := ioutil.ReadDir(filepath.Join(stateDir(), "snapshots"))
+		if len(entries) == 0 {
+			fmt.Println(tr("No snapshots"))
+		}
+		for _, fi := range entries {
+			fmt.Printf("%-20s %s\n", fi.Name(), formatTime(fi.ModTime()))
+		}
+		return
+	}
+	if len(args) < 2 {
+		fatal(tr("A snapshot name is required"))
+	}
+	name := args[1]
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		fatal(fmt.Sprintf(tr("Invalid snapshot name %s"), name))
+	}
+
+	switch args[0] {
+	case "create":
+		ids, err := infoFileNames()
+		if err != nil && !os.IsNotExist(err) {
+			fatal(err.Error())
+		}
+		var lines []string
+		for _, id := range ids {
+			lines = append(lines, id+" "+installedHash(id))
+		}
+		os.MkdirAll(filepath.Dir(snapshotPath(name)), 0755)
+		if err := writeFileAtomic(snapshotPath(name), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			fatal(fmt.Sprintf(tr("Could not save snapshot: %v"), err))
+		}
+		fmt.Printf(tr("Saved snapshot %s of %d components\n"), name, len(lines))
+	case "delete":
+		if err := os.Remove(snapshotPath(name)); err != nil {
+			fatal(fmt.Sprintf(tr("Snapshot %s does not exist"), name))
+		}
+	case "restore":
+		restoreSnapshot(name)
+	default:
+		fatal(fmt.Sprintf(tr("Unknown snapshot subcommand %s"), args[0]))
+	}
+}
+
+func restoreSnapshot(name string) {
+	data, err := ioutil.ReadFile(snapshotPath(name))
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Snapshot %s does not exist"), name))
+	}
+	wanted := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if parts := strings.Fields(line); len(parts) == 2 {
+			wanted[parts[0]] = parts[1]
+		}
+	}
+
+	cached := make(map[string]bool)
+	for _, fi := range cachedArchives() {
+		cached[strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(fi.Name(), ".zst"), ".zip"))] = true
+	}
+
+	var toRemove, toChange, toDownload, fromCache []*Component
+	for _, c := range components {
+		hash, ok := wanted[c.ID]
+		if !ok {
+			if c.Downloaded {
+				toRemove = append(toRemove, c)
+			}
+			continue
+		}
+		delete(wanted, c.ID)
+		if c.Downloaded && sameHash(installedHash(c.ID), hash) && !c.Broken {
+			continue
+		}
+		if !c.MatchesHash(hash) {
+			if _, value := splitHash(hash); !cached[strings.ToUpper(c.ID+"-"+value)] {
+				warn(fmt.Sprintf(tr("Version %s of %s is in neither a source nor the cache and will be skipped"), hash, c.ID))
+				continue
+			}
+			// The step installs the cached version instead of the index's
+			useCachedVersion(c, hash)
+			fromCache = append(fromCache, c)
+		}
+		if c.Downloaded {
+			toChange = append(toChange, c)
+		} else {
+			toDownload = append(toDownload, c)
+		}
+	}
+	for id := range wanted {
+		warn(fmt.Sprintf(tr("Component %s is no longer in any source and will be skipped"), id))
+	}
+
+	if len(toRemove)+len(toChange)+len(toDownload) == 0 {
+		fmt.Printf(tr("The installation already matches snapshot %s\n"), name)
+		return
+	}
+	measureInstallSizes(append(toChange, toDownload...))
+
+	for _, group := range []struct {
+		format string
+		list   []*Component
+	}{
+		{tr("%d component(s) will be removed:\n"), toRemove},
+		{tr("%d component(s) will be changed to another version:\n"), toChange},
+		{tr("%d component(s) will be downloaded:\n"), toDownload},
+	} {
+		if len(group.list) == 0 {
+			continue
+		}
+		fmt.Printf(group.format, len(group.list))
+		for _, c := range group.list {
+			fmt.Printf("  %s\n", c.ID)
+		}
+		fmt.Println()
+	}
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	if failed := executePlan(newPlan("snapshot", toRemove, toChange, toDownload)); failed > 0 {
+		fmt.Printf(tr("\nSnapshot %s was only partly restored\n"), name)
+		exit(1)
+	}
+
+	var pinned []string
+	for _, c := range fromCache {
+		pinned = append(pinned, c.ID)
+	}
+	if len(pinned) > 0 {
+		setPinned(pinned, true)
+		fmt.Printf(tr("\nRestored from the cache and pinned: %s\n"), strings.Join(pinned, ", "))
+	}
+	fmt.Printf(tr("\nRestored snapshot %s\n"), name)
+}
+
+// handlePin pins or unpins installed components.
+func handlePin(args []string, pin bool) {
+	var ids []string
+	for _, arg := range args {
+		matches := findComponents(arg)
+		if len(matches) == 0 {
+			warn(fmt.Sprintf(tr("Component or category %s does not exist and will be skipped"), arg))
+		}
+		for _, c := range matches {
+			if c.Downloaded {
+				ids = append(ids, c.ID)
+			}
+		}
+	}
+	setPinned(ids, pin)
+	for _, id := range ids {
+		if pin {
+			fmt.Printf(tr("Pinned %s\n"), id)
+		} else {
+			fmt.Printf(tr("Unpinned %s\n"), id)
+		}
+	}
+}
+
+func pinnedPath() string {
+	return filepath.Join(stateDir(), "pinned")
+}
+
+var (
+	pinnedOnce sync.Once
+	pinned     map[string]bool
+)
+
+// pinnedComponents returns the IDs of pinned components, one per line in
+// the state directory.
+func pinnedComponents() map[string]bool {
+	pinnedOnce.Do(func() {
+		pinned = make(map[string]bool)
+		data, _ := ioutil.ReadFile(pinnedPath())
+		for _, id := range strings.Fields(string(data)) {
+			pinned[id] = true
+		}
+	})
+	return pinned
+}
+
+func setPinned(ids []string, pin bool) {
+	set := pinnedComponents()
+	for _, id := range ids {
+		if pin {
+			set[id] = true
+		} else {
+			delete(set, id)
+		}
+		if c, ok := compMap[id]; ok {
+			c.Pinned = pin
+		}
+	}
+
+	var list []string
+	for id := range set {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	os.MkdirAll(stateDir(), 0755)
+	if err := writeFileAtomic(pinnedPath(), []byte(strings.Join(list, "\n")), 0644); err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not save pinned components: %v"), err))
+	}
+}
+
+// Annotation holds the tags and note the user attached to a component. They
+// are kept by component ID, whether or not it is installed.
+type Annotation struct {
+	Tags []string `json:"tags,omitempty"`
+	Note string   `json:"note,omitempty"`
+}
+
+func annotationsPath() string {
+	return filepath.Join(stateDir(), "notes.json")
+}
+
+var (
+	annotationsOnce sync.Once
+	annotationMap   map[string]*Annotation
+)
+
+// annotations returns the tags and notes of components, by ID.
+func annotations() map[string]*Annotation {
+	annotationsOnce.Do(func() {
+		annotationMap = make(map[string]*Annotation)
+		data, err := ioutil.ReadFile(annotationsPath())
+		if err != nil {
+			return
+		}
+		if err := json.Unmarshal(data, &annotationMap); err != nil {
+			warn(fmt.Sprintf(tr("Warning: Could not read %s: %v"), annotationsPath(), err))
+		}
+	})
+	return annotationMap
+}
+
+func hasTag(id, tag string) bool {
+	if a := annotations()[id]; a != nil {
+		for _, t := range a.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleTag adds tags to or removes them from the component id.
+func handleTag(id string, tags []string, add bool) {
+	if _, exists := compMap[id]; !exists {
+		fatal(tr("Specified component does not exist"))
+	}
+	a := annotations()[id]
+	if a == nil {
+		a = &Annotation{}
+		annotations()[id] = a
+	}
+	for _, tag := range tags {
+		if strings.ContainsAny(tag, " \t,") || tag == "" {
+			fatal(fmt.Sprintf(tr("Invalid tag %q; tags cannot contain spaces or commas"), tag))
+		}
+		if add && !hasTag(id, tag) {
+			a.Tags = append(a.Tags, tag)
+		} else if !add {
+			for i, t := range a.Tags {
+				if t == tag {
+					a.Tags = append(a.Tags[:i], a.Tags[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	sort.Strings(a.Tags)
+	saveAnnotations()
+	if len(a.Tags) == 0 {
+		fmt.Printf(tr("%s has no tags\n"), id)
+	} else {
+		fmt.Printf(tr("Tags of %s: %s\n"), id, strings.Join(a.Tags, ", "))
+	}
+}
+
+// handleNote sets the note of the component id, or removes it if text is
+// empty.
+func handleNote(id, text string) {
+	if _, exists := compMap[id]; !exists {
+		fatal(tr("Specified component does not exist"))
+	}
+	a := annotations()[id]
+	if a == nil {
+		a = &Annotation{}
+		annotations()[id] = a
+	}
+	a.Note = strings.TrimSpace(text)
+	saveAnnotations()
+	if a.Note == "" {
+		fmt.Printf(tr("Removed the note of %s\n"), id)
+	} else {
+		fmt.Printf(tr("Saved the note of %s\n"), id)
+	}
+}
+
+func saveAnnotations() {
+	set := annotations()
+	for id, a := range set {
+		if len(a.Tags) == 0 && a.Note == "" {
+			delete(set, id)
+		}
+	}
+	if len(set) == 0 {
+		os.Remove(annotationsPath())
+		return
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(stateDir(), 0755)
+	if err := writeFileAtomic(annotationsPath(), data, 0644); err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not save %s: %v"), annotationsPath(), err))
+	}
+}
+
+// handleDrift reports installed components whose version is not known: the
+// installed hash is neither provided by any source nor one fpm downloaded
+// and cached before. These were modified or installed outside of fpm, or
+// come from a source that is no longer configured. It exits with status 1
+// if any are found, for use in fleet checks.
+func handleDrift() {
+	ids, err := infoFileNames()
+	if err != nil {
+		fmt.Println(tr("No components are installed"))
+		return
+	}
+
+	cached := make(map[string]bool)
+	for _, fi := range cachedArchives() {
+		cached[strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(fi.Name(), ".zst"), ".zip"))] = true
+	}
+
+	drifted := 0
+	for _, id := range ids {
+		data, err := readStoredFile(filepath.Join("Components", id))
+		if err != nil {
+			continue
+		}
+		hash := strings.SplitN(strings.SplitN(string(data), "\n", 2)[0], " ", 2)[0]
+		_, value := splitHash(hash)
+
+		list := providers[id]
+		if len(list) == 0 {
+			fmt.Printf(tr("%s: installed version %s is not provided by any configured source\n"), id, hash)
+			drifted++
+			continue
+		}
+		known := cached[strings.ToUpper(id+"-"+value)]
+		var hashes []string
+		for _, c := range list {
+			hashes = append(hashes, fmt.Sprintf("%s (%s)", c.TaggedHash(), c.Source))
+			if c.MatchesHash(hash) {
+				known = true
+			}
+		}
+		if !known {
+			fmt.Printf(tr("%s: installed version %s is unknown; sources have %s\n"), id, hash, strings.Join(hashes, ", "))
+			drifted++
+		}
+	}
+
+	if drifted == 0 {
+		fmt.Println(tr("All installed components match a known version"))
+		return
+	}
+	fmt.Printf(tr("\n%d component(s) differ from every known version\n"), drifted)
+	exit(1)
+}
+
+// handleDiff compares the installed files of a component with its archive in
+// the repository, showing what an update would add, remove or replace and
+// which files were modified locally.
+func handleDiff(id string) {
+	c, exists := compMap[id]
+	if !exists {
+		fatal(tr("Specified component does not exist"))
+	}
+	if c.IsMeta() {
+		fmt.Println(tr("Meta components have no files to compare"))
+		return
+	}
+
+	j := ui.start(c.ID, tr("downloading"))
+	archive, err := fetchArchive(c, &ReportEntry{}, j)
+	ui.done(j, "")
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not download the archive of %s: %v"), c.ID, err))
+	}
+	defer func() {
+		compressCache()
+		pruneCache()
+	}()
+
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not read the archive of %s: %v"), c.ID, err))
+	}
+	defer r.Close()
+
+	installed := make(map[string]bool)
+	files, _ := manifestFiles(c)
+	for _, f := range files {
+		installed[filepath.ToSlash(f)] = true
+	}
+
+	var added, removed, modified []string
+	include, exclude := extractFilters(c)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !filterEntry(f.Name, include, exclude) {
+			continue
+		}
+		rel := path.Join(c.Directory, f.Name)
+		wasInstalled := installed[rel]
+		delete(installed, rel)
+
+		sum, size, err := fileCRC32(filepath.FromSlash(rel))
+		switch {
+		case err != nil && wasInstalled:
+			added = append(added, rel+tr(" (missing)"))
+		case err != nil:
+			added = append(added, rel)
+		case size != int64(f.UncompressedSize64) || sum != f.CRC32:
+			modified = append(modified, rel)
+		}
+	}
+	for rel := range installed {
+		removed = append(removed, rel)
+	}
+	sort.Strings(removed)
+
+	if !c.Downloaded {
+		fmt.Printf(tr("%s is not installed; all of its files would be added\n\n"), c.ID)
+	}
+	for _, f := range added {
+		fmt.Printf("+ %s\n", f)
+	}
+	for _, f := range removed {
+		fmt.Printf("- %s\n", f)
+	}
+	for _, f := range modified {
+		fmt.Printf("M %s\n", f)
+	}
+	fmt.Printf(tr("\n%d added, %d removed, %d modified\n"), len(added), len(removed), len(modified))
+}
+
+// verifyState tracks the files of a component checked by handleVerify.
+type verifyState struct {
+	job       *job
+	remaining int
+	corrupt   []string
+	missing   []string
+}
+
+// handleVerify checks installed files against the checksums recorded when
+// they were extracted. Files are hashed by a pool of workers fed in component
+// order, so only a few components are in progress at any time.
+func handleVerify(opts Options, ids []string) {
+	all := opts.Has("all")
+
+	var list []*Component
+	if all || len(ids) == 0 {
+		for _, c := range components {
+			if c.Downloaded {
+				list = append(list, c)
+			}
+		}
+	} else {
+		for _, id := range ids {
+			matches := findComponents(id)
+			if len(matches) == 0 {
+				warn(fmt.Sprintf(tr("Component or category %s does not exist"), id))
+			}
+			for _, c := range matches {
+				if c.Downloaded {
+					list = append(list, c)
+				}
+			}
+		}
+		list = unique(list)
+	}
+
+	type verifyFile struct {
+		c     *Component
+		path  string
+		sum   fileChecksum
+		known bool
+	}
+	var files []verifyFile
+	states := make(map[*Component]*verifyState)
+	var order []*Component
+	var totalBytes int64
+	for _, c := range list {
+		paths, err := manifestFiles(c)
+		if err != nil || len(paths) == 0 {
+			continue
+		}
+		sums := loadChecksums(c)
+		for _, p := range paths {
+			sum, known := sums[filepath.ToSlash(p)]
+			files = append(files, verifyFile{c, p, sum, known})
+			totalBytes += sum.Size
+		}
+		states[c] = &verifyState{remaining: len(paths)}
+		order = append(order, c)
+	}
+	if len(files) == 0 {
+		fmt.Println(tr("No installed files to verify"))
+		return
+	}
+
+	workers := runtime.NumCPU()
+	if workers < 4 {
+		workers = 4
+	}
+	queue := make(chan verifyFile, workers*64)
+	go func() {
+		for _, f := range files {
+			queue <- f
+		}
+		close(queue)
+	}()
+
+	var mu sync.Mutex
+	unchecked := 0
+	ui.begin(len(order), totalBytes)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1<<20)
+			for f := range queue {
+				mu.Lock()
+				st := states[f.c]
+				if st.job == nil {
+					st.job = ui.start(f.c.ID, tr("verifying"))
+				}
+				mu.Unlock()
+
+				missing, corrupt := false, false
+				fh, err := storage.Open(f.path)
+				if err != nil {
+					missing = true
+				} else {
+					if f.known {
+						h := crc32.NewIEEE()
+						n, err := io.CopyBuffer(h, &progressReader{r: fh, j: st.job}, buf)
+						corrupt = err != nil || n != f.sum.Size || h.Sum32() != f.sum.CRC32
+					}
+					fh.Close()
+				}
+
+				mu.Lock()
+				switch {
+				case missing:
+					st.missing = append(st.missing, f.path)
+				case corrupt:
+					st.corrupt = append(st.corrupt, f.path)
+				case !f.known:
+					unchecked++
+				}
+				st.remaining--
+				if st.remaining == 0 {
+					if len(st.corrupt)+len(st.missing) == 0 {
+						ui.done(st.job, "")
+					} else {
+						ui.done(st.job, fmt.Sprintf(tr("%d corrupt, %d missing"), len(st.corrupt), len(st.missing)))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	ui.end()
+
+	corrupt, missing := 0, 0
+	for _, c := range order {
+		st := states[c]
+		if len(st.corrupt)+len(st.missing) == 0 {
+			continue
+		}
+		sort.Strings(st.corrupt)
+		sort.Strings(st.missing)
+		fmt.Printf("\n%s:\n", c.ID)
+		for _, p := range st.corrupt {
+			fmt.Printf(tr("  corrupt: %s\n"), p)
+		}
+		for _, p := range st.missing {
+			fmt.Printf(tr("  missing: %s\n"), p)
+		}
+		corrupt += len(st.corrupt)
+		missing += len(st.missing)
+	}
+
+	fmt.Printf(tr("\nVerified %d files of %d components: %d corrupt, %d missing\n"), len(files), len(order), corrupt, missing)
+	if unchecked > 0 {
+		fmt.Printf(tr("%d files have no recorded checksum and were only checked for existence\n"), unchecked)
+	}
+	if corrupt+missing > 0 {
+		exit(1)
+	}
+}
+
+// renames returns the new ID of each renamed component, by old ID, from the
+// renamed-from attributes of the indexes and the rename.<old> settings, which
+// take precedence.
+func renames() map[string]string {
+	m := make(map[string]string)
+	for _, c := range components {
+		for _, old := range c.RenamedFrom {
+			if m[old] == "" {
+				m[old] = c.ID
+			}
+		}
+	}
+	for key, value := range config {
+		if strings.HasPrefix(key, "rename.") && value != "" {
+			m[strings.TrimPrefix(key, "rename.")] = value
+		}
+	}
+	return m
+}
+
+// migrateRenames hands the installations of components that no source offers
+// any more over to the components they were renamed to, moving the info
+// file and all state kept by ID. The new component is then updated like any
+// other whose installed version differs.
+func migrateRenames() {
+	m := renames()
+	var olds []string
+	for old := range m {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	for _, old := range olds {
+		if !installedIDs()[old] || compMap[old] != nil {
+			continue
+		}
+		c := compMap[m[old]]
+		if c == nil {
+			warn(fmt.Sprintf(tr("Warning: %s was renamed to %s, which no source offers"), old, m[old]))
+			continue
+		}
+		if c.Downloaded {
+			warn(fmt.Sprintf(tr("Warning: %s was renamed to %s, which is installed too; remove %s with fpm remove"), old, c.ID, old))
+			continue
+		}
+
+		if assumeNo {
+			fmt.Printf(tr("%s was renamed to %s; its installation would be moved to %s\n"), old, c.ID, c.ID)
+			continue
+		}
+
+		oldInfo := &Component{ID: old}
+		if err := os.Rename(filepath.Join(basePath, "Components", old), filepath.Join(basePath, "Components", c.ID)); err != nil {
+			warn(fmt.Sprintf(tr("Warning: Could not move the installation of %s to %s: %v"), old, c.ID, err))
+			continue
+		}
+		os.Rename(checksumPath(oldInfo), checksumPath(c))
+		os.Rename(scriptsPath(oldInfo), scriptsPath(c))
+
+		ownersMu.Lock()
+		loadOwners()
+		for p, id := range owners {
+			if id == old {
+				owners[p] = c.ID
+			}
+		}
+		ownersMu.Unlock()
+		saveOwners()
+
+		if pinnedComponents()[old] {
+			setPinned([]string{old}, false)
+			setPinned([]string{c.ID}, true)
+		}
+		if a := annotations(); a[old] != nil && a[c.ID] == nil {
+			a[c.ID] = a[old]
+			delete(a, old)
+			saveAnnotations()
+		}
+
+		forgetInstalled()
+		loadState(c)
+		fmt.Printf(tr("%s was renamed to %s; its installation now belongs to %s\n"), old, c.ID, c.ID)
+	}
+}
+
+// updateExcluded reports whether c matches the update.exclude setting, which
+// keeps components the user updates by hand out of fpm update.
+func updateExcluded(c *Component) bool {
+	for _, pattern := range strings.Fields(getSetting("update.exclude")) {
+		if ok, _ := path.Match(pattern, c.ID); ok || matchesAny(c.ID, []string{pattern}) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleUpdate(opts Options, args []string) {
+	var toUpdate, toRepair, toDownload []*Component
+
+	force, criticalOnly := opts.Has("force"), opts.Has("critical-only")
+	migrateRenames()
+
+	if len(args) > 0 {
+		visited := make(map[string]bool)
+		var recurse func(string, bool)
+		recurse = func(id string, isDepend bool) {
+			matches := findComponents(id)
+			if len(matches) == 0 {
+				if !isDepend {
+					warn(fmt.Sprintf(tr("Component or category %s does not exist"), id))
+				}
+				return
+			}
+
+			for _, c := range matches {
+				if visited[c.ID] {
+					continue
+				}
+				visited[c.ID] = true
+
+				if !c.Downloaded {
+					if isDepend {
+						toDownload = append(toDownload, c)
+					} else {
+						warn(fmt.Sprintf(tr("Component %s is not downloaded and will be skipped"), c.ID))
+					}
+				} else if c.Broken {
+					toRepair = append(toRepair, c)
+				} else if !c.Outdated {
+					if !isDepend {
+						warn(fmt.Sprintf(tr("Component %s is already up-to-date and will be skipped"), c.ID))
+					}
+				} else if c.Pinned {
+					warn(fmt.Sprintf(tr("Component %s is pinned and will be skipped; run fpm unpin %s to update it"), c.ID, c.ID))
+				} else if criticalOnly && !c.Critical {
 					if !isDepend {
-						fmt.Printf("Component %s is already up-to-date and will be skipped\n", c.ID)
+						warn(fmt.Sprintf(tr("Component %s has no critical update and will be skipped"), c.ID))
+					}
+				} else {
+					toUpdate = append(toUpdate, c)
+					for _, dep := range c.Depends {
+						recurse(dep, true)
+					}
+				}
+			}
+		}
+
+		for _, arg := range args {
+			recurse(arg, false)
+		}
+
+	} else {
+		// Update all
+		var excluded []string
+		for _, c := range components {
+			if updateExcluded(c) {
+				if c.Downloaded && c.Outdated || c.Broken {
+					excluded = append(excluded, c.ID)
+				}
+				continue
+			}
+			if c.Downloaded && c.Outdated && !c.Pinned && (c.Critical || !criticalOnly) {
+				toUpdate = append(toUpdate, c)
+			}
+			if criticalOnly {
+				// Repairs and missing components wait for a full update
+				continue
+			}
+			if c.Broken {
+				toRepair = append(toRepair, c)
+			}
+			if c.Kind == "required" && !c.Downloaded {
+				toDownload = append(toDownload, c)
+			}
+		}
+		if len(excluded) > 0 {
+			fmt.Printf(tr("Skipping %d component(s) excluded by update.exclude: %s\n"), len(excluded), strings.Join(excluded, ", "))
+		}
+
+		// New versions can depend on components that are not installed yet
+		visited := make(map[string]bool)
+		var addMissing func(id string)
+		addMissing = func(id string) {
+			for _, c := range findComponents(id) {
+				if visited[c.ID] || c.Downloaded {
+					continue
+				}
+				visited[c.ID] = true
+				toDownload = append(toDownload, c)
+				for _, dep := range c.Depends {
+					addMissing(dep)
+				}
+			}
+		}
+		for _, c := range toUpdate {
+			for _, dep := range c.Depends {
+				addMissing(dep)
+			}
+		}
+	}
+
+	toUpdate = unique(toUpdate)
+	toRepair = unique(toRepair)
+	toDownload = unique(toDownload)
+
+	if len(toUpdate) == 0 && len(toRepair) == 0 && len(toDownload) == 0 {
+		fmt.Println(tr("No components to update"))
+		return
+	}
+
+	measureInstallSizes(append(toUpdate, toDownload...))
+	toRemove := resolveConflicts(append(append(toUpdate, toRepair...), toDownload...))
+
+	var dlSize, changeSize int64
+
+	if len(toUpdate) > 0 {
+		fmt.Printf(tr("%d component(s) will be updated:\n"), len(toUpdate))
+		for _, c := range toUpdate {
+			fmt.Printf("  %s\n", c.ID)
+			dlSize += c.DownloadSize
+			changeSize += (c.InstallSize - c.OldSize)
+		}
+		fmt.Println()
+	}
+
+	if len(toRepair) > 0 {
+		fmt.Printf(tr("%d component(s) are broken and will be repaired:\n"), len(toRepair))
+		for _, c := range toRepair {
+			fmt.Printf("  %s\n", c.ID)
+			dlSize += c.DownloadSize
+		}
+		fmt.Println()
+	}
+
+	if len(toDownload) > 0 {
+		fmt.Printf(tr("%d component(s) will be downloaded:\n"), len(toDownload))
+		for _, c := range toDownload {
+			fmt.Printf("  %s\n", c.ID)
+			dlSize += c.DownloadSize
+			changeSize += c.InstallSize
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf(tr("Estimated download size: %s\n"), formatBytes(dlSize))
+	printConflictRemovals(toRemove, append(append(toUpdate, toRepair...), toDownload...))
+	fmt.Printf(tr("Estimated changed size:  %s\n\n"), formatBytes(changeSize))
+	checkInUse(append(append(toRemove, toUpdate...), toRepair...), force)
+
+	if !confirm(tr("Is this OK?")) {
+		return
+	}
+
+	plan := newPlan("update", toRemove, append(toUpdate, toRepair...), toDownload)
+	failed := executePlan(plan)
+
+	updated, repaired, downloaded := plan.succeeded(toUpdate), plan.succeeded(toRepair), plan.succeeded(toDownload)
+	var done []string
+	if updated > 0 {
+		done = append(done, fmt.Sprintf(tr("updated %d components"), updated))
+	}
+	if repaired > 0 {
+		done = append(done, fmt.Sprintf(tr("repaired %d components"), repaired))
+	}
+	if downloaded > 0 {
+		done = append(done, fmt.Sprintf(tr("downloaded %d components"), downloaded))
+	}
+	if n := len(done); n > 1 {
+		done = append(done[:n-2], fmt.Sprintf(tr("%s and %s"), done[n-2], done[n-1]))
+	}
+	if len(done) > 0 {
+		fmt.Printf(tr("\nSuccessfully %s\n"), strings.Join(done, ", "))
+	}
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+// --- Helpers ---
+
+// initConfig reads fpm.cfg. The first two lines are always the base path and
+// source URL, as in the Windows version; any further lines are "key = value"
+// settings, which the Windows version ignores.
+func initConfig() {
+	config = make(map[string]string)
+
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		if _, err := os.Stat(systemConfigFile); err == nil {
+			configFile = systemConfigFile
+		}
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err == nil {
+		lines := strings.Split(string(data), "\n")
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if i == 0 {
+				config["path"] = line
+				continue
+			}
+			if i == 1 {
+				config["source"] = line
+				continue
+			}
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) == 2 {
+				config[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+		migrationChanges = migrateConfig(config)
+		applyConfig()
+	} else {
+		config["version"] = strconv.Itoa(configVersion)
+		applyConfig()
+		writeConfig()
+	}
+}
+
+// configVersion is the version of the layout of fpm.cfg written by this fpm.
+// Older configs, including the two-line fpm.cfg of the Windows version, are
+// migrated in memory when read, and saved by the first command run.
+const configVersion = 1
+
+// configMigrations bring a config from the version before Version up to
+// Version, returning a description of each change made.
+var configMigrations = []struct {
+	Version int
+	Migrate func(cfg map[string]string) []string
+}{
+	{1, migrateNormalizeValues},
+}
+
+// migrationChanges describes how the config read was migrated, until the
+// migrated config is saved.
+var migrationChanges []string
+
+// migrateConfig applies the migrations cfg is missing and describes what
+// they changed. It returns nil if cfg is up to date.
+func migrateConfig(cfg map[string]string) []string {
+	from, _ := strconv.Atoi(cfg["version"])
+	if from >= configVersion {
+		return nil
+	}
+	var changes []string
+	for _, m := range configMigrations {
+		if m.Version > from {
+			changes = append(changes, m.Migrate(cfg)...)
+		}
+	}
+	cfg["version"] = strconv.Itoa(configVersion)
+	return append(changes, fmt.Sprintf(tr("set version = %d (was %d)"), configVersion, from))
+}
+
+// migrateNormalizeValues stores values the way config set does, e.g. choices
+// in lower case and sizes in upper case, which configs written by hand or
+// by the Windows version do not always do. Invalid values are only reported.
+func migrateNormalizeValues(cfg map[string]string) []string {
+	var keys []string
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, k := range keys {
+		s := findSetting(k)
+		if s == nil {
+			changes = append(changes, fmt.Sprintf(tr("kept unknown setting %s"), k))
+			continue
+		}
+		if s.Parse == nil || cfg[k] == "" {
+			continue
+		}
+		v, err := s.Parse(cfg[k])
+		if err != nil {
+			changes = append(changes, fmt.Sprintf(tr("kept invalid value %s = %s (%v)"), k, cfg[k], err))
+		} else if v != cfg[k] {
+			changes = append(changes, fmt.Sprintf(tr("changed %s = %s to %s"), k, cfg[k], v))
+			cfg[k] = v
+		}
+	}
+	return changes
+}
+
+// saveMigratedConfig writes the config once it was migrated.
+func saveMigratedConfig() {
+	warn(fmt.Sprintf(tr("Note: Updated %s to version %d of its layout: %s"), configFile, configVersion, strings.Join(migrationChanges, "; ")))
+	migrationChanges = nil
+	writeConfig()
+}
+
+// applyConfig refreshes the globals derived from settings.
+func applyConfig() {
+	basePath = getSetting("path")
+	sourceURL = getSetting("source")
+	if systemMode() {
+		// Whoever installs, every user must be able to read and run the files
+		syscall.Umask(0022)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy := getSetting("proxy"); proxy != "" {
+		if u, err := url.Parse(proxy); err == nil {
+			transport.Proxy = http.ProxyURL(u)
+		}
+	}
+	if endpoint := getSetting("doh"); endpoint != "" {
+		resolver := &dohResolver{
+			endpoint: endpoint,
+			always:   getSetting("doh-mode") == "always",
+			client:   &http.Client{Timeout: 15 * time.Second, Transport: transport.Clone()},
+			cache:    make(map[string][]string),
+		}
+		transport.DialContext = resolver.dial
+	}
+	baseTransport = transport
+	clients = make(map[string]*http.Client)
+	client = &http.Client{Timeout: 0, Transport: transport}
+	if curlDebug {
+		client.Transport = &curlTransport{transport}
+	}
+}
+
+// sourceSetting returns the source.<name>.<key> setting of a source, falling
+// back to the global <key> setting.
+func sourceSetting(source, key string) string {
+	if v := config["source."+source+"."+key]; v != "" {
+		return v
+	}
+	return getSetting(key)
+}
+
+func sourceIntSetting(source, key string) int {
+	if n, err := strconv.Atoi(config["source."+source+"."+key]); err == nil {
+		return n
+	}
+	return getIntSetting(key)
+}
+
+var (
+	baseTransport *http.Transport
+	clientsMu     sync.Mutex
+	clients       = make(map[string]*http.Client)
+)
+
+// clientFor returns the HTTP client for requests to a source, which differs
+// from the shared client if the source restricts redirects or trusts
+// additional certificates.
+func clientFor(source string) *http.Client {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, ok := clients[source]; ok {
+		return c
+	}
+
+	redirects := sourceSetting(source, "redirects")
+	caFile := sourceSetting(source, "ca-file")
+	if redirects == "follow" && caFile == "" {
+		clients[source] = client
+		return client
+	}
+
+	transport := baseTransport.Clone()
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil || !pool.AppendCertsFromPEM(data) {
+			fatal(fmt.Sprintf(tr("Could not load CA certificates from %s"), caFile))
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	c := &http.Client{Timeout: 0, Transport: transport}
+	if curlDebug {
+		c.Transport = &curlTransport{transport}
+	}
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		switch {
+		case redirects == "none":
+			return fmt.Errorf(tr("redirect to %s refused, as redirects are disabled for source %s"), req.URL, source)
+		case redirects == "same-host" && req.URL.Host != via[0].URL.Host:
+			return fmt.Errorf(tr("redirect to %s refused, as source %s only allows redirects on the same host"), req.URL, source)
+		case len(via) >= 10:
+			return errors.New(tr("stopped after 10 redirects"))
+		}
+		return nil
+	}
+	clients[source] = c
+	return c
+}
+
+// curlTransport prints every request as an equivalent curl command line to
+// standard error, for bug reports. Credentials are left out.
+type curlTransport struct {
+	next http.RoundTripper
+}
+
+func (t *curlTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cmd := []string{"curl", "-v"}
+	if req.Method == "HEAD" {
+		cmd = append(cmd, "-I")
+	} else if req.Method != "GET" {
+		cmd = append(cmd, "-X", req.Method)
+	}
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "Authorization" {
+			value = "<redacted>"
+		}
+		cmd = append(cmd, "-H", shellQuote(name+": "+value))
+	}
+	cmd = append(cmd, shellQuote(req.URL.String()))
+	fmt.Fprintln(os.Stderr, strings.Join(cmd, " "))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "# %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "# %s\n", resp.Status)
+	}
+	return resp, err
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// statusError describes a failed response: the status, the URL it finally
+// came from and, for common statuses, what is likely wrong. what is the
+// kind of file requested, "index" or "archive".
+func statusError(resp *http.Response, what string) error {
+	msg := fmt.Sprintf(tr("HTTP %s from %s"), resp.Status, resp.Request.URL)
+
+	first := resp.Request
+	for first.Response != nil {
+		first = first.Response.Request
+	}
+	if first.URL.String() != resp.Request.URL.String() {
+		msg += fmt.Sprintf(tr(" (redirected from %s)"), first.URL)
+	}
+
+	switch {
+	case resp.StatusCode == 404 && what == "archive":
+		msg += tr("; the component may have been renamed or removed since the index was published, or come from a different source than expected (see fpm which-source)")
+	case resp.StatusCode == 404:
+		msg += tr("; check the URL of the source with fpm config list")
+	case resp.StatusCode == 429 || resp.StatusCode == 503:
+		msg += tr("; the repository is busy or under maintenance, try again later")
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		msg += tr("; the source may require credentials (source.<name>.user and password, or token)")
+	case resp.StatusCode >= 500:
+		msg += tr("; the server has a problem, try again later")
+	}
+	return errors.New(msg)
+}
+
+// busyHosts holds, by host, until when a server that answered 429 or 503
+// asked to be left alone, so that parallel downloads all back off instead
+// of each running into the limit again.
+var (
+	busyMu    sync.Mutex
+	busyHosts = make(map[string]time.Time)
+)
+
+// maxBusyWait is how long a request waits in total for a busy repository
+// before its 429 or 503 answer is treated as an error.
+const maxBusyWait = 10 * time.Minute
+
+// retryAfter returns how long a 429 or 503 response asks to wait before
+// trying again, from its Retry-After header in seconds or as a date, or 0
+// for other responses.
+func retryAfter(resp *http.Response) time.Duration {
+	if resp.StatusCode != 429 && resp.StatusCode != 503 {
+		return 0
+	}
+	var wait time.Duration
+	value := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		wait = time.Until(t)
+	}
+	if wait < time.Second {
+		wait = 5 * time.Second
+	}
+	return wait
+}
+
+func markBusy(host string, wait time.Duration) {
+	busyMu.Lock()
+	if until := time.Now().Add(wait); until.After(busyHosts[host]) {
+		busyHosts[host] = until
+	}
+	busyMu.Unlock()
+}
+
+// waitIfBusy waits until host accepts requests again, counting down on the
+// line of j if given, and reports whether it had to wait.
+func waitIfBusy(ctx context.Context, host string, j *job) (bool, error) {
+	waited := false
+	for {
+		busyMu.Lock()
+		left := time.Until(busyHosts[host])
+		busyMu.Unlock()
+		if left <= 0 {
+			return waited, nil
+		}
+		// Without a terminal, the countdown would print a line every second
+		if j != nil && (ui.tty || !waited) {
+			ui.update(j, fmt.Sprintf(tr("repository busy, retrying in %s"), left.Round(time.Second)))
+		}
+		waited = true
+		step := time.Second
+		if left < step {
+			step = left
+		}
+		select {
+		case <-time.After(step):
+		case <-ctx.Done():
+			return waited, ctx.Err()
+		}
+	}
+}
+
+// notXMLError detects responses that are web pages rather than an index or
+// archive, as served with status 200 by captive portals and filtering
+// proxies, given the first bytes of the body. The error quotes the start of
+// the page, which usually names the portal or proxy.
+func notXMLError(resp *http.Response, head []byte) error {
+	text := strings.TrimSpace(strings.TrimPrefix(string(head), "\ufeff"))
+	lower := strings.ToLower(text)
+	html := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		strings.HasPrefix(lower, "<!doctype html") || strings.HasPrefix(lower, "<html")
+	if !html && (text == "" || strings.HasPrefix(text, "<")) {
+		return nil
+	}
+
+	snippet := strings.Join(strings.Fields(text), " ")
+	if len(snippet) > 160 {
+		snippet = snippet[:160] + "..."
+	}
+	return fmt.Errorf(tr("%s returned a web page or message instead of the expected file, which usually means a captive portal "+
+		"(log in through a browser first) or a proxy intercepted the request. The response began with: %q"),
+		resp.Request.URL, snippet)
+}
+
+// networkError adds a hint to errors that are commonly misread, like TLS
+// certificates rejected because of a filtering proxy or a wrong clock.
+func networkError(err error) error {
+	var unknown x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	switch {
+	case errors.As(err, &unknown):
+		return fmt.Errorf(tr("%v; the certificate is not trusted, which often means a proxy or filter intercepts HTTPS"), err)
+	case errors.As(err, &invalid):
+		return fmt.Errorf(tr("%v; check that the system clock is correct"), err)
+	case errors.As(err, &hostname):
+		return fmt.Errorf(tr("%v; the server presented a certificate for another name, which often means a proxy or filter intercepts HTTPS"), err)
+	}
+	return err
+}
+
+// dohResolver resolves host names with a DNS-over-HTTPS server speaking the
+// JSON API of Google and Cloudflare, for networks that filter DNS. The
+// endpoint should be given by IP address, or it may be blocked as well.
+type dohResolver struct {
+	endpoint string
+	always   bool
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string][]string
+}
+
+var dohDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+func (r *dohResolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dohDialer.DialContext(ctx, network, addr)
+	}
+	if !r.always {
+		conn, err := dohDialer.DialContext(ctx, network, addr)
+		var dnsErr *net.DNSError
+		if err == nil || !errors.As(err, &dnsErr) {
+			return conn, err
+		}
+	}
+
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, Server: r.endpoint}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dohDialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// lookup returns the IPv4 addresses of host, or its IPv6 addresses if it
+// has none.
+func (r *dohResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	ips, ok := r.cache[host]
+	r.mu.Unlock()
+	if ok {
+		return ips, nil
+	}
+
+	for _, qtype := range []int{1, 28} { // A, AAAA
+		u := fmt.Sprintf("%s?name=%s&type=%d", r.endpoint, url.QueryEscape(host), qtype)
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/dns-json")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var answer struct {
+			Answer []struct {
+				Type int    `json:"type"`
+				Data string `json:"data"`
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&answer)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf(tr("invalid response from DNS-over-HTTPS server: %v"), err)
+		}
+		for _, a := range answer.Answer {
+			if a.Type == qtype {
+				ips = append(ips, a.Data)
+			}
+		}
+		if len(ips) > 0 {
+			break
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New(tr("no such host"))
+	}
+
+	r.mu.Lock()
+	r.cache[host] = ips
+	r.mu.Unlock()
+	return ips, nil
+}
+
+func writeConfig() {
+	lines := []string{basePath, sourceURL}
+
+	var keys []string
+	for k, v := range config {
+		if k != "path" && k != "source" && v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	// Passwords and tokens must not be readable by other users
+	perm := os.FileMode(0644)
+	for _, k := range keys {
+		if isSecretKey(k) {
+			perm = 0600
+		}
+	}
+	for _, k := range keys {
+		// The file format, unlike messages, is never translated
+		lines = append(lines, fmt.Sprintf("%s = %s", k, config[k]))
+	}
+
+	content := strings.Join(lines, "\n")
+	if err := writeFileAtomic(configFile, []byte(content), perm); err != nil {
+		warn(tr("Warning: Could not write to fpm.cfg"))
+	}
+}
+
+// isSecretKey reports whether the setting key holds a credential.
+func isSecretKey(key string) bool {
+	return strings.HasSuffix(key, ".password") || strings.HasSuffix(key, ".token")
+}
+
+// lookupSetting finds the setting for key. A "*" in a setting's key matches
+// any name without dots, so "source.*" matches "source.unstable" and
+// "source.*.token" matches "source.unstable.token".
+func lookupSetting(key string) *Setting {
+	s := findSetting(key)
+	if s == nil {
+		fatal(fmt.Sprintf(tr("Unknown configuration key %s"), key))
+	}
+	return s
+}
+
+// findSetting returns the setting key belongs to, or nil if it is unknown.
+func findSetting(key string) *Setting {
+	for i := range knownSettings {
+		if matchKey(knownSettings[i].Key, key) {
+			return &knownSettings[i]
+		}
+	}
+	return nil
+}
+
+func matchKey(pattern, key string) bool {
+	p := strings.Split(pattern, ".")
+	k := strings.Split(key, ".")
+	if len(p) != len(k) {
+		return false
+	}
+	for i := range p {
+		if p[i] == "*" {
+			if k[i] == "" || strings.ContainsAny(k[i], " \t=") {
+				return false
+			}
+		} else if p[i] != k[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func getSetting(key string) string {
+	if v := config[key]; v != "" {
+		return v
+	}
+	if key == "path" {
+		if systemMode() {
+			return systemBasePath
+		}
+		ex, _ := os.Executable()
+		guess := filepath.Clean(filepath.Join(filepath.Dir(ex), ".."))
+		// fpm installed elsewhere, e.g. in /usr/local/bin, is usually run
+		// from the Flashpoint directory, which holds fpm.cfg
+		if wd, err := os.Getwd(); err == nil && !isFlashpointDir(guess) && isFlashpointDir(wd) {
+			return wd
+		}
+		return guess
+	}
+	return lookupSetting(key).Default
+}
+
+// flashpointDirs are found at the top of every Flashpoint installation, or
+// of any directory fpm has installed components into.
+var flashpointDirs = []string{"Launcher", "Data", "Components"}
+
+// isFlashpointDir reports whether dir holds one of the flashpointDirs.
+func isFlashpointDir(dir string) bool {
+	for _, name := range flashpointDirs {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBasePath asks for the Flashpoint directory when the base path is
+// neither a Flashpoint installation nor empty, as when fpm guessed it from
+// its own location in /usr/local/bin, instead of installing into /usr/local.
+func checkBasePath() {
+	if systemMode() || baseMissing() || isFlashpointDir(basePath) {
+		return
+	}
+	if d, err := os.Open(basePath); err == nil {
+		_, err = d.Readdirnames(1)
+		d.Close()
+		if err == io.EOF {
+			// An empty directory made for a new installation
+			return
+		}
+	}
+
+	fmt.Printf(tr("The base path %s does not look like a Flashpoint installation, as it has none of the %s directories.\n"),
+		basePath, strings.Join(flashpointDirs, ", "))
+	fail := func() {
+		fatal(fmt.Sprintf(tr("The base path was not changed. Choose the Flashpoint directory with fpm config set path <dir>, "+
+			"or create %s to use this one"), filepath.Join(basePath, "Components")))
+	}
+	if assumeYes || assumeNo {
+		fail()
+	}
+	fmt.Print(tr("Enter the path of the Flashpoint directory, or nothing to cancel: "))
+	answer, err := readAnswer(0)
+	answer = strings.TrimSpace(answer)
+	if err != nil || answer == "" {
+		fmt.Println()
+		fail()
+	}
+	dir, err := parsePath(answer)
+	if err != nil {
+		fatal(err.Error())
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		fatal(fmt.Sprintf(tr("%s is not a directory"), dir))
+	}
+
+	config["path"] = dir
+	applyConfig()
+	writeConfig()
+	fmt.Printf(tr("The base path is now %s\n\n"), basePath)
+	if components != nil {
+		// What is installed was read from the old base path
+		if err := getComponents(); err != nil {
+			fatal(fmt.Sprintf(tr("Could not fetch components: %v"), err))
+		}
+	}
+}
+
+// systemMode reports whether fpm manages a machine-wide installation, see
+// the mode setting.
+func systemMode() bool {
+	return config["mode"] == "system"
+}
+
+func getIntSetting(key string) int {
+	n, err := strconv.Atoi(getSetting(key))
+	if err != nil {
+		n, _ = strconv.Atoi(lookupSetting(key).Default)
+	}
+	return n
+}
+
+func parsePath(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	return filepath.Abs(value)
+}
+
+func parseURL(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf(tr("%s is not an absolute URL"), value)
+	}
+	return value, nil
+}
+
+func parseCommandTemplate(value string) (string, error) {
+	if !strings.Contains(value, "{url}") {
+		return "", errors.New(tr("the command must contain {url}"))
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// parseWindow parses a daily time window such as "01:00-07:00", which may
+// span midnight.
+func parseWindow(value string) (string, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return "", errors.New(tr("must be a range of times such as 01:00-07:00"))
+	}
+	var times []string
+	for _, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return "", errors.New(tr("must be a range of times such as 01:00-07:00"))
+		}
+		times = append(times, t.Format("15:04"))
+	}
+	if times[0] == times[1] {
+		return "", errors.New(tr("the window must not start and end at the same time"))
+	}
+	return times[0] + "-" + times[1], nil
+}
+
+func parseInt(min int) func(string) (string, error) {
+	return func(value string) (string, error) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min {
+			return "", fmt.Errorf(tr("must be a whole number of at least %d"), min)
+		}
+		return strconv.Itoa(n), nil
+	}
+}
+
+func parseSizeSetting(value string) (string, error) {
+	if _, err := parseSize(value); err != nil {
+		return "", err
+	}
+	return strings.ToUpper(value), nil
+}
+
+// parseDate parses dates such as "2024-01-01" or "2024-01-01 18:30" in
+// local time, or RFC 3339 timestamps.
+func parseDate(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf(tr("%s is not a valid date; use YYYY-MM-DD"), value)
+}
+
+// parseSize parses sizes such as "512", "700M" or "1.5G" using binary units.
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	s = strings.TrimSuffix(s, "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGTPE", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf(tr("%s is not a valid size"), value)
+	}
+	return int64(f * float64(mult)), nil
+}
+
+func parseChoice(choices ...string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		for _, c := range choices {
+			if strings.EqualFold(value, c) {
+				return c, nil
+			}
+		}
+		return "", fmt.Errorf(tr("must be one of %s"), strings.Join(choices, ", "))
+	}
+}
+
+// sources returns the configured sources in priority order: the primary
+// source, named "default", first, then additional sources sorted by name.
+func sources() []Source {
+	list := []Source{{Name: "default", URL: sourceURL}}
+
+	var names []string
+	for k, v := range config {
+		if matchKey("source.*", k) && k != "source.default" && v != "" {
+			names = append(names, strings.TrimPrefix(k, "source."))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list = append(list, Source{Name: name, URL: config["source."+name]})
+	}
+	return list
+}
+
+// getComponents fetches all source indexes concurrently and merges them. When
+// several sources provide the same component, the higher priority one wins.
+func getComponents() error {
+	srcs := sources()
+	forgetInstalled()
+
+	results := make([][]*Component, len(srcs))
+	catResults := make([][]*Category, len(srcs))
+	errs := make([]error, len(srcs))
+	fresh := make([]bool, len(srcs))
+	var wg sync.WaitGroup
+	for i := range srcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			timeout := time.Duration(sourceIntSetting(srcs[i].Name, "fetch-timeout")) * time.Second
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			results[i], catResults[i], fresh[i], errs[i] = loadIndex(ctx, srcs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	components = []*Component{}
+	compMap = make(map[string]*Component)
+	providers = make(map[string][]*Component)
+	categories = nil
+	profiles = make(map[string]*Category)
+	seenCategory := make(map[string]bool)
+	fetched := 0
+	for i, src := range srcs {
+		if errs[i] != nil {
+			if len(srcs) > 1 {
+				warn(fmt.Sprintf(tr("Warning: Could not fetch source %s: %v"), src.Name, errs[i]))
+			}
+			continue
+		}
+		fetched++
+		listed := make(map[string]bool, len(results[i]))
+		for _, c := range results[i] {
+			// A source listing an ID twice would leave two entries behind
+			// one map key, so only its first entry counts.
+			if listed[c.ID] {
+				debug(fmt.Sprintf(tr("component %s is listed more than once by source %s; the first entry is used"), c.ID, src.Name))
+				continue
+			}
+			listed[c.ID] = true
+			providers[c.ID] = append(providers[c.ID], c)
+			if first, exists := compMap[c.ID]; exists {
+				debug(fmt.Sprintf(tr("component %s is offered by sources %s and %s; %s takes precedence"), c.ID, first.Source, src.Name, first.Source))
+				continue
+			}
+			components = append(components, c)
+			compMap[c.ID] = c
+		}
+		for _, cat := range catResults[i] {
+			if cat.Members != nil {
+				if profiles[cat.ID] == nil {
+					profiles[cat.ID] = cat
+				}
+				continue
+			}
+			if !seenCategory[cat.ID] {
+				seenCategory[cat.ID] = true
+				categories = append(categories, cat)
+			}
+		}
+	}
+
+	forgetIDIndex()
+	if fetched == 0 {
+		return errs[0]
+	}
+	loadLocalComponents()
+
+	checkInstalled()
+
+	refreshed := false
+	for _, f := range fresh {
+		refreshed = refreshed || f
+	}
+	if refreshed && makeStateDir(stateDir()) == nil {
+		stamp := time.Now().UTC().Format(time.RFC3339)
+		writeFileAtomic(filepath.Join(stateDir(), "last-refresh"), []byte(stamp), 0644)
+	}
+	return nil
+}
+
+func fetchIndex(ctx context.Context, src Source) ([]*Component, []*Category, error) {
+	// Kept for index-ttl and for when the source cannot be reached. It is
+	// written while the index is parsed and only put in place if it parses.
+	cached := indexCachePath(src)
+	var part *os.File
+	var cache io.Writer
+	if makeStateDir(filepath.Dir(cached)) == nil {
+		if f, err := os.Create(cached + ".part"); err == nil {
+			part = f
+			cache = &quietWriter{w: f}
+		}
+	}
+	list, cats, err := streamIndex(ctx, src.URL, src.Name, cache)
+	if part != nil {
+		cerr := part.Close()
+		if err == nil && cerr == nil && cache.(*quietWriter).err == nil {
+			os.Rename(part.Name(), cached)
+		} else {
+			os.Remove(part.Name())
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range list {
+		c.Source = src.Name
+	}
+	return list, cats, nil
+}
+
+// streamIndex fetches the index at u and parses it as it arrives, so that a
+// broken index is given up on as soon as it goes wrong. What is read is
+// copied to w, if not nil. Pages that are not XML and indexes over
+// maxIndexSize are errors.
+func streamIndex(ctx context.Context, u, source string, w io.Writer) ([]*Component, []*Category, error) {
+	resp, err := httpGet(ctx, u, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, nil, statusError(resp, "index")
+	}
+
+	br := bufio.NewReader(resp.Body)
+	head, _ := br.Peek(512)
+	if err := notXMLError(resp, head); err != nil {
+		return nil, nil, err
+	}
+	limited := &io.LimitedReader{R: br, N: maxIndexSize + 1}
+	body := &bodyReader{r: limited}
+	var r io.Reader = body
+	if w != nil {
+		r = io.TeeReader(body, w)
+	}
+	list, cats, err := parseIndex(r)
+	switch {
+	case limited.N == 0:
+		return nil, nil, fmt.Errorf(tr("the component index from %s is larger than %s"), resp.Request.URL, formatBytes(maxIndexSize))
+	case body.err != nil:
+		return nil, nil, networkError(body.err)
+	case err != nil:
+		return nil, nil, fmt.Errorf(tr("invalid component index from %s: %v"), resp.Request.URL, err)
+	}
+	return list, cats, nil
+}
+
+// bodyReader keeps the first error reading r other than io.EOF, so that a
+// dropped connection can be told apart from a broken index.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+// quietWriter writes to w until a write fails, which it keeps in err
+// instead of returning, so that keeping a copy of the data cannot break
+// the reading of it.
+type quietWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (q *quietWriter) Write(p []byte) (int, error) {
+	if q.err == nil {
+		_, q.err = q.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// indexCachePath is where the index of src is kept. The URL is part of the
+// name so that a changed URL never falls back to the old one's index.
+func indexCachePath(src Source) string {
+	return filepath.Join(stateDir(), "indexes", fmt.Sprintf("%s-%08X.xml", src.Name, crc32.ChecksumIEEE([]byte(src.URL))))
+}
+
+// loadIndex returns the index of src from the copy kept by fetchIndex while
+// it is younger than the source's index-ttl, and fetches it otherwise. If
+// fetching fails, the kept copy is used regardless of its age. fresh
+// reports whether the index was fetched.
+func loadIndex(ctx context.Context, src Source) (list []*Component, cats []*Category, fresh bool, err error) {
+	cached := indexCachePath(src)
+	fi, statErr := os.Stat(cached)
+	ttl := time.Duration(sourceIntSetting(src.Name, "index-ttl")) * time.Minute
+	if statErr == nil && ttl > 0 && time.Since(fi.ModTime()) < ttl {
+		if list, cats, err := readCachedIndex(src); err == nil {
+			return list, cats, false, nil
+		}
+	}
+
+	list, cats, err = fetchIndex(ctx, src)
+	if err == nil || statErr != nil {
+		return list, cats, err == nil, err
+	}
+	if list, cats, cerr := readCachedIndex(src); cerr == nil {
+		warn(fmt.Sprintf(tr("Warning: Could not fetch source %s (%v); using its index from %s"), src.Name, err, formatTime(fi.ModTime())))
+		return list, cats, false, nil
+	}
+	return nil, nil, false, err
+}
+
+func readCachedIndex(src Source) ([]*Component, []*Category, error) {
+	f, err := os.Open(indexCachePath(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	list, cats, err := parseIndex(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, c := range list {
+		c.Source = src.Name
+	}
+	return list, cats, nil
+}
+
+// handleRefresh fetches the indexes of all sources, or of the one given
+// with --source, regardless of index-ttl.
+func handleRefresh(opts Options, args []string) {
+	if len(args) > 0 {
+		fatal(fmt.Sprintf(tr("Unexpected argument %s"), args[0]))
+	}
+	only := opts.Value("source")
+
+	var srcs []Source
+	for _, src := range sources() {
+		if only == "" || src.Name == only {
+			srcs = append(srcs, src)
+		}
+	}
+	if len(srcs) == 0 {
+		fatal(fmt.Sprintf(tr("Source %s does not exist"), only))
+	}
+
+	failed := 0
+	for _, src := range srcs {
+		timeout := time.Duration(sourceIntSetting(src.Name, "fetch-timeout")) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		list, _, err := fetchIndex(ctx, src)
+		cancel()
+		if err != nil {
+			fmt.Printf("%s: %v\n", src.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf(tr("%s: %d components\n"), src.Name, len(list))
+	}
+	if failed < len(srcs) && makeStateDir(stateDir()) == nil {
+		stamp := time.Now().UTC().Format(time.RFC3339)
+		writeFileAtomic(filepath.Join(stateDir(), "last-refresh"), []byte(stamp), 0644)
+	}
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+// Limits on component indexes, so that a broken or malicious mirror cannot
+// exhaust memory or the stack. Real indexes are far from them.
+const (
+	maxIndexSize    = 256 << 20
+	maxIndexDepth   = 64
+	maxAttrLength   = 64 << 10
+	maxArchiveFiles = 1000000
+)
+
+// parseIndex decodes a component index as a token stream, building components
+// as their elements are read. The root element's url attribute is the base URL
+// of the archives, and nested categories and lists prefix the IDs of the
+// components inside them (e.g. core-server-gamezip).
+func parseIndex(r io.Reader) ([]*Component, []*Category, error) {
+	dec := xml.NewDecoder(r)
+	var list []*Component
+	var cats []*Category
+	var parents []string
+	repoURL := ""
+	skipping := 0 // Depth inside an element that is ignored
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if len(parents)+skipping >= maxIndexDepth {
+				line, _ := dec.InputPos()
+				return nil, nil, fmt.Errorf(tr("elements nested more than %d deep on line %d"), maxIndexDepth, line)
+			}
+			for _, attr := range t.Attr {
+				if len(attr.Value) > maxAttrLength {
+					line, _ := dec.InputPos()
+					return nil, nil, fmt.Errorf(tr("attribute %s longer than %s on line %d"), attr.Name.Local, formatBytes(maxAttrLength), line)
+				}
+			}
+			if skipping > 0 {
+				skipping++
+				continue
+			}
+			if parents != nil && len(parents) == 0 {
+				line, _ := dec.InputPos()
+				return nil, nil, fmt.Errorf(tr("element after the end of the component list on line %d"), line)
+			}
+			if parents == nil {
+				repoURL = getAttr(t.Attr, "url")
+				if repoURL != "" && !strings.HasSuffix(repoURL, "/") {
+					repoURL += "/"
+				}
+				parents = []string{""}
+				continue
+			}
+
+			name := t.Name.Local
+			if name == "profile" && len(parents) == 1 {
+				cats = append(cats, &Category{
+					ID:      getAttr(t.Attr, "id"),
+					Title:   getAttr(t.Attr, "title"),
+					Members: strings.Fields(getAttr(t.Attr, "components")),
+				})
+			}
+			if name != "component" && name != "category" && name != "list" {
+				// Skipped by hand, as Decoder.Skip recurses once per level
+				skipping = 1
+				continue
+			}
+
+			parentID := parents[len(parents)-1]
+			fullID := getAttr(t.Attr, "id")
+			if parentID != "" && fullID != "" {
+				fullID = parentID + "-" + fullID
+			} else if parentID != "" {
+				fullID = parentID
+			}
+			parents = append(parents, fullID)
+
+			if name == "component" {
+				c := newComponent(fullID, t.Attr, repoURL)
+				c.Category = parentID
+				list = append(list, c)
+			} else if fullID != parentID {
+				cats = append(cats, &Category{ID: fullID, Title: getAttr(t.Attr, "title"), Parent: parentID})
+			}
+		case xml.EndElement:
+			if skipping > 0 {
+				skipping--
+			} else if len(parents) > 0 {
+				parents = parents[:len(parents)-1]
+			}
+		}
+	}
+
+	if parents == nil {
+		return nil, nil, errors.New(tr("no component list found"))
+	}
+	return list, cats, nil
+}
+
+func newComponent(id string, attrs []xml.Attr, repoURL string) *Component {
+	c := &Component{
+		ID:          id,
+		Title:       getAttr(attrs, "title"),
+		Description: getAttr(attrs, "description"),
+		Directory:   getAttr(attrs, "path"),
+		HashAlg:     defaultHashAlg,
+		URL:         repoURL + id + ".zip",
+		Kind:        getAttr(attrs, "kind"),
+		Locale:      getAttr(attrs, "locale"),
+		Attrs:       attrs,
+	}
+
+	// Archives can be hosted apart from the index, e.g. on a CDN, with an
+	// absolute URL or one relative to the repository URL
+	if ref := getAttr(attrs, "url"); ref != "" {
+		base, err := url.Parse(repoURL)
+		u, err2 := url.Parse(ref)
+		if err == nil && err2 == nil {
+			u = base.ResolveReference(u)
+			c.URL = u.String()
+			c.Offsite = u.Host != base.Host
+		}
+	}
+
+	// An index moving to a new algorithm can list the old hash alongside, so
+	// that installed components are not all seen as outdated
+	for _, field := range strings.Fields(getAttr(attrs, "hash")) {
+		alg, value := splitHash(field)
+		if c.Hashes == nil {
+			c.Hash, c.HashAlg = value, alg
+			c.Hashes = make(map[string]string)
+		}
+		c.Hashes[alg] = value
+	}
+
+	// Indexes without kinds mark required components by the core- prefix
+	if c.Kind != "required" && c.Kind != "recommended" && c.Kind != "optional" {
+		c.Kind = "optional"
+		if strings.HasPrefix(id, "core-") {
+			c.Kind = "required"
+		}
+	}
+
+	if val, err := strconv.ParseInt(getAttr(attrs, "date-modified"), 10, 64); err == nil {
+		c.LastUpdated = time.Unix(val, 0)
+	}
+	if val, err := strconv.ParseInt(getAttr(attrs, "download-size"), 10, 64); err == nil {
+		c.DownloadSize = val
+	}
+	if val, err := strconv.ParseInt(getAttr(attrs, "install-size"), 10, 64); err == nil {
+		c.InstallSize = val
+	}
+	if val, err := strconv.Atoi(getAttr(attrs, "file-count")); err == nil {
+		c.FileCount = val
+	}
+	depStr := getAttr(attrs, "depends")
+	if depStr != "" {
+		c.Depends = strings.Split(depStr, " ")
+	}
+	c.Conflicts = strings.Fields(getAttr(attrs, "conflicts"))
+	c.Replaces = strings.Fields(getAttr(attrs, "replaces"))
+	c.RenamedFrom = strings.Fields(getAttr(attrs, "renamed-from"))
+	for _, name := range []string{"critical", "security"} {
+		if v := getAttr(attrs, name); v == "true" || v == "yes" || v == "1" {
+			c.Critical = true
+		}
+	}
+
+	loadState(c)
+	return c
+}
+
+// loadState checks whether c is installed and whether the installed version
+// differs from the one in the index.
+func loadState(c *Component) {
+	if !installedIDs()[c.ID] {
+		return
+	}
+	c.Downloaded = true
+	c.Pinned = pinnedComponents()[c.ID]
+
+	// Read header
+	f, err := storage.Open(filepath.Join("Components", c.ID))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		headerParts := strings.Split(scanner.Text(), " ")
+		if len(headerParts) >= 2 {
+			if !c.MatchesHash(headerParts[0]) {
+				c.Outdated = true
+				c.OldSize, _ = strconv.ParseInt(headerParts[1], 10, 64)
+			}
+		}
+	}
+}
+
+var (
+	installedMu sync.Mutex
+	installed   map[string]bool
+)
+
+// installedIDs returns the IDs that have an info file, read from the
+// Components directory once per getComponents instead of looking up every
+// component of the indexes, which would take one system call each.
+func installedIDs() map[string]bool {
+	installedMu.Lock()
+	defer installedMu.Unlock()
+	if installed == nil {
+		installed = make(map[string]bool)
+		names, _ := storage.List("Components")
+		for _, name := range names {
+			if !strings.HasPrefix(name, ".") {
+				installed[name] = true
+			}
+		}
+	}
+	return installed
+}
+
+// forgetInstalled makes installedIDs read the Components directory again.
+func forgetInstalled() {
+	installedMu.Lock()
+	installed = nil
+	installedMu.Unlock()
+}
+
+// checkInstalled marks up-to-date components whose files are missing or have
+// the wrong size as broken, when enabled. Sizes are only known for files
+// extracted since checksums were recorded; others are checked for existence.
+func checkInstalled() {
+	if !checkFiles && getSetting("check-files") != "on" {
+		return
+	}
+
+	var list []*Component
+	for _, c := range components {
+		if c.Downloaded && !c.Outdated && !c.IsMeta() {
+			list = append(list, c)
+		}
+	}
+	forEachParallel(list, func(c *Component) {
+		files, err := manifestFiles(c)
+		if err != nil {
+			return
+		}
+		sums := make(map[string]fileChecksum)
+		if _, err := os.Stat(checksumPath(c)); err == nil {
+			sums = loadChecksums(c)
+		}
+		for _, f := range files {
+			fi, err := storage.Stat(f)
+			if err != nil {
+				c.Broken = true
+				return
+			}
+			if sum, ok := sums[filepath.ToSlash(f)]; ok && sum.Size != fi.Size() {
+				c.Broken = true
+				return
+			}
+		}
+	})
+}
+
+func getAttr(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func resolveQueue(args []string, criteria func(*Component) bool) []*Component {
+	var queue []*Component
+	visited := make(map[string]bool)
+
+	var add func(string)
+	add = func(id string) {
+		matches := findComponents(id)
+		if len(matches) == 0 {
+			warn(fmt.Sprintf(tr("Component or category %s does not exist"), id))
+			return
+		}
+
+		for _, c := range matches {
+			if visited[c.ID] {
+				continue
+			}
+			visited[c.ID] = true
+			if c.ID != id && !wantedLocale(c) {
+				continue
+			}
+
+			if criteria(c) {
+				queue = append(queue, c)
+				for _, dep := range c.Depends {
+					add(dep)
+				}
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		// All components
+		for _, c := range components {
+			if wantedLocale(c) {
+				add(c.ID)
+			}
+		}
+	} else {
+		for _, arg := range args {
+			add(arg)
+		}
+	}
+	warnSkippedLocales()
+
+	return unique(queue)
+}
+
+// expandSelection replaces @<name> arguments with the members of the group
+// defined by the group.<name> setting, and globs like core-* with the IDs
+// they match. Other arguments are kept as they are.
+func expandSelection(args []string) []string {
+	var expanded []string
+	var expand func(arg string, depth int)
+	expand = func(arg string, depth int) {
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			name := strings.TrimPrefix(arg, "@")
+			var list []string
+			if members, ok := config["group."+name]; ok {
+				list = strings.Fields(strings.Replace(members, ",", " ", -1))
+			} else if profile := findProfile(name); profile != nil {
+				list = profile.Members
+			} else {
+				fatal(fmt.Sprintf(tr("Group %s is not defined; add it with fpm config set group.%s <components>"), name, name))
+			}
+			if depth > 10 {
+				fatal(fmt.Sprintf(tr("Group %s contains itself"), name))
+			}
+			for _, m := range list {
+				expand(m, depth+1)
+			}
+		case strings.HasPrefix(arg, "kind:"):
+			kind := strings.TrimPrefix(arg, "kind:")
+			if kind != "required" && kind != "recommended" && kind != "optional" {
+				fatal(fmt.Sprintf(tr("Unknown kind %s; use required, recommended or optional"), kind))
+			}
+			for _, c := range components {
+				if c.Kind == kind && wantedLocale(c) {
+					expanded = append(expanded, c.ID)
+				}
+			}
+		case strings.Contains(arg, "://"):
+			// Archive URLs given to download
+			expanded = append(expanded, arg)
+		case strings.ContainsAny(arg, "*?["):
+			matched := false
+			for _, c := range components {
+				if ok, _ := path.Match(arg, c.ID); ok {
+					matched = true
+					if wantedLocale(c) {
+						expanded = append(expanded, c.ID)
+					}
+				}
+			}
+			if !matched {
+				warn(fmt.Sprintf(tr("No components match %s"), arg))
+			}
+		default:
+			expanded = append(expanded, arg)
+		}
+	}
+
+	for _, arg := range args {
+		if arg == "-" {
+			if inShell {
+				fatal(tr("Reading components from standard input is not possible in the shell"))
+			}
+			for _, id := range readStdinList() {
+				expand(id, 0)
+			}
+			continue
+		}
+		expand(arg, 0)
+	}
+	if len(args) > 0 && len(expanded) == 0 {
+		warnSkippedLocales()
+		fatal(tr("The selection matches no components"))
+	}
+	return expanded
+}
+
+// preferredLocales returns the locales setting as lower case tags with -
+// separators, e.g. pt-br.
+func preferredLocales() []string {
+	setting := getSetting("locales")
+	if setting != "auto" {
+		var list []string
+		for _, l := range strings.Fields(strings.Replace(setting, ",", " ", -1)) {
+			list = append(list, strings.ToLower(strings.Replace(l, "_", "-", -1)))
+		}
+		return list
+	}
+	lang := getSetting("language")
+	if lang == "auto" {
+		for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if lang = os.Getenv(env); lang != "" {
+				break
+			}
+		}
+	}
+	if i := strings.IndexAny(lang, ".@"); i >= 0 {
+		lang = lang[:i]
+	}
+	list := []string{"en"}
+	if lang != "" && lang != "C" && lang != "POSIX" && lang != "auto" {
+		list = append(list, strings.ToLower(strings.Replace(lang, "_", "-", -1)))
+	}
+	return list
+}
+
+// localeSkipped holds the locale variants left out of selections, so that
+// the user is told once.
+var localeSkipped = make(map[string]bool)
+
+// wantedLocale reports whether c should be selected by a category, glob or
+// kind: it is not a locale variant, is installed already, or its locale is
+// a preferred one. A preferred "pt" takes pt-BR too, and "pt-BR" takes pt.
+func wantedLocale(c *Component) bool {
+	if c.Locale == "" || c.Downloaded || allLocales {
+		return true
+	}
+	locale := strings.ToLower(strings.Replace(c.Locale, "_", "-", -1))
+	for _, l := range preferredLocales() {
+		if l == locale || strings.HasPrefix(locale, l+"-") || strings.HasPrefix(l, locale+"-") {
+			return true
+		}
+	}
+	localeSkipped[c.ID] = true
+	return false
+}
+
+func warnSkippedLocales() {
+	if len(localeSkipped) > 0 {
+		warn(fmt.Sprintf(tr("%d locale variant(s) not in the locales setting (%s) were left out; add --all-locales to include them"),
+			len(localeSkipped), strings.Join(preferredLocales(), " ")))
+		localeSkipped = make(map[string]bool)
+	}
+}
+
+// findProfile returns the profile of the given name, from the indexes or
+// bundled with fpm, or nil.
+func findProfile(name string) *Category {
+	if p := profiles[name]; p != nil {
+		return p
+	}
+	for _, p := range bundledProfiles {
+		if p.ID == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// printProfiles lists the profiles that can be selected with @<name>, with
+// the number of components each would select.
+func printProfiles() {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, p := range bundledProfiles {
+		if profiles[p.ID] == nil {
+			names = append(names, p.ID)
+		}
+	}
+	for _, name := range names {
+		p := findProfile(name)
+		note := ""
+		if _, ok := config["group."+name]; ok {
+			note = tr(" (overridden by a group setting)")
+		}
+		selected := make(map[string]bool)
+		for _, m := range p.Members {
+			for _, c := range components {
+				if ok, _ := path.Match(m, c.ID); ok || m == "kind:"+c.Kind {
+					selected[c.ID] = true
+				}
+			}
+			if !strings.HasPrefix(m, "kind:") && !strings.ContainsAny(m, "*?[") {
+				for _, c := range findComponents(m) {
+					selected[c.ID] = true
+				}
+			}
+		}
+		fmt.Printf(tr("@%-12s %s, %d components%s\n"), name, tr(p.Title), len(selected), note)
+	}
+}
+
+// readStdinList reads component arguments from standard input, one per line.
+// Blank lines and # comments are ignored.
+func readStdinList() []string {
+	if stdinUsed {
+		return nil
+	}
+	stdinUsed = true
+
+	var list []string
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			list = append(list, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fatal(fmt.Sprintf(tr("Could not read components from standard input: %v"), err))
+	}
+	return list
+}
+
+func findComponents(id string) []*Component {
+	var matches []*Component
+	if c, ok := compMap[id]; ok {
+		matches = append(matches, c)
+	}
+	matches = append(matches, componentsWithPrefix(id+"-")...)
+
+	// Callers expect index order, e.g. for the order of downloads
+	idIndexMu.Lock()
+	defer idIndexMu.Unlock()
+	sort.Slice(matches, func(i, j int) bool {
+		return idIndexPos[matches[i]] < idIndexPos[matches[j]]
+	})
+	return matches
+}
+
+var (
+	idIndexMu  sync.Mutex
+	idIndex    []*Component       // components sorted by ID, nil until needed
+	idIndexPos map[*Component]int // Position of each component in components
+)
+
+// forgetIDIndex must be called whenever components changes.
+func forgetIDIndex() {
+	idIndexMu.Lock()
+	idIndex, idIndexPos = nil, nil
+	idIndexMu.Unlock()
+}
+
+// componentsWithPrefix returns the components whose ID starts with prefix,
+// sorted by ID. A binary search over the components sorted by ID finds them
+// without looking at the others, which matters when resolving dependencies
+// in large catalogs.
+func componentsWithPrefix(prefix string) []*Component {
+	idIndexMu.Lock()
+	defer idIndexMu.Unlock()
+	if idIndex == nil {
+		idIndex = append([]*Component(nil), components...)
+		sort.Slice(idIndex, func(i, j int) bool {
+			return idIndex[i].ID < idIndex[j].ID
+		})
+		idIndexPos = make(map[*Component]int, len(components))
+		for i, c := range components {
+			idIndexPos[c] = i
+		}
+	}
+	start := sort.Search(len(idIndex), func(i int) bool {
+		return idIndex[i].ID >= prefix
+	})
+	end := start
+	for end < len(idIndex) && strings.HasPrefix(idIndex[end].ID, prefix) {
+		end++
+	}
+	return append([]*Component(nil), idIndex[start:end]...)
+}
+
+func unique(slice []*Component) []*Component {
+	keys := make(map[string]bool)
+	list := []*Component{}
+	for _, entry := range slice {
+		if _, value := keys[entry.ID]; !value {
+			keys[entry.ID] = true
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// downloadComponent installs c. When it replaces an installed version,
+// replace removes that version; it is only called once the new one was
+// downloaded, verified and staged, so a failed download leaves the old
+// version in place.
+func downloadComponent(c *Component, e *ReportEntry, replace func()) error {
+	j := ui.start(c.ID, tr("downloading"))
+
+	var err error
+	if c.IsMeta() {
+		ui.update(j, tr("registering"))
+		if replace != nil {
+			replace()
+		}
+		err = writeManifest(c, nil)
+	} else {
+		err = installArchive(c, e, j, replace)
+	}
+
+	if err != nil {
+		ui.done(j, "")
+	} else {
+		ui.done(j, tr("done"))
+	}
+	return err
+}
+
+// installArchive downloads the archive of c and extracts it. replace, if not
+// nil, is called between staging the files and moving them into place.
+func installArchive(c *Component, e *ReportEntry, j *job, replace func()) error {
+	// Files are extracted into the staging directory first and only moved into
+	// place once the whole archive was extracted.
+	if err := os.MkdirAll(stagingDir(), 0755); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(stagingDir(), c.ID+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	type stagedFile struct {
+		staged, final string
+		sum           string
+		size          int64
+		crc           uint32
+	}
+	var staged []stagedFile
+	var scripts map[string][]byte
+
+	destDir := filepath.Join(basePath, filepath.FromSlash(c.Directory))
+
+	include, exclude := extractFilters(c)
+	var checker *pathChecker
+	var seen map[string]bool
+	extract := func(name string, size int64, r io.Reader) error {
+		// A second entry of the same name would silently win
+		key := path.Clean(name)
+		if seen[key] {
+			return pathProblem(fmt.Sprintf(tr("the archive contains %s more than once"), name))
+		}
+		if len(seen) >= maxArchiveFiles {
+			return pathProblem(fmt.Sprintf(tr("the archive contains more than %d files"), maxArchiveFiles))
+		}
+		seen[key] = true
+		if strings.HasPrefix(name, scriptDir) {
+			data, err := ioutil.ReadAll(r)
+			scripts[name] = data
+			return err
+		}
+		if !filterEntry(name, include, exclude) {
+			return nil
+		}
+
+		fpath := filepath.Join(destDir, filepath.FromSlash(name))
+
+		// Zip Slip check
+		if !strings.HasPrefix(fpath, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return fmt.Errorf(tr("illegal file path: %s"), fpath)
+		}
+		if checker != nil {
+			if err := checker.check(fpath); err != nil {
+				return err
+			}
+		}
+
+		spath := filepath.Join(staging, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(spath), 0755)
+
+		outFile, err := os.Create(spath)
+		if err != nil {
+			return err
+		}
+		preallocate(outFile, size)
+
+		// Streamed entries may only give their size and CRC32 after the data
+		crc := crc32.NewIEEE()
+		w := io.MultiWriter(outFile, crc)
+		h := sha256.New()
+		if dedupEnabled() {
+			w = io.MultiWriter(w, h)
+		}
+		size, err = io.Copy(w, r)
+		if err == nil {
+			err = finishFile(outFile, size)
+		}
+		outFile.Close()
+		if err != nil {
+			return err
+		}
+
+		sf := stagedFile{staged: spath, final: fpath, size: size, crc: crc.Sum32()}
+		if dedupEnabled() && size >= dedupMinSize() {
+			sf.sum = hex.EncodeToString(h.Sum(nil))
+		}
+		staged = append(staged, sf)
+		// Only files actually written count, so that the count reaches the total
+		ui.addFile(j)
+		return nil
+	}
+
+	streamed := false
+	if streamArchives && !isCached(c) {
+		// Each attempt starts over, overwriting what the last one staged
+		var lastErr error
+		for attempt := 0; attempt <= sourceIntSetting(c.Source, "retries"); attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			staged, scripts, seen = nil, make(map[string][]byte), make(map[string]bool)
+			checker = newPathChecker(destDir)
+			ui.setFiles(j, 0)
+			n, retry, err := streamArchive(c, j, extract)
+			e.BytesDownloaded += n
+			if lastErr = err; err == nil || !retry {
+				break
+			}
+		}
+		if errors.Is(lastErr, errZipStream) {
+			// The archive has to be downloaded whole after all
+			if free, ok := freeSpace(stagingDir()); ok && free < c.DownloadSize {
+				return fmt.Errorf(tr("%v, and there is not enough space in %s to download it first; install %s without --stream once %s are free"),
+					lastErr, stagingDir(), c.ID, formatBytes(c.DownloadSize))
+			}
+			ui.warn(fmt.Sprintf(tr("Warning: %v; downloading %s before extracting it"), lastErr, c.ID))
+		} else if lastErr != nil {
+			return lastErr
+		} else {
+			streamed = true
+		}
+	}
+	if !streamed {
+		archive, err := fetchArchive(c, e, j)
+		if err != nil {
+			return err
+		}
+		ui.update(j, tr("extracting"))
+
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// Problems are found before anything is extracted
+		if pc := newPathChecker(destDir); pc != nil {
+			for _, f := range r.File {
+				name := filepath.Join(destDir, filepath.FromSlash(f.Name))
+				if !f.FileInfo().IsDir() && !strings.HasPrefix(f.Name, scriptDir) && filterEntry(f.Name, include, exclude) {
+					if err := pc.check(name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		total := 0
+		for _, f := range r.File {
+			if !f.FileInfo().IsDir() && !strings.HasPrefix(f.Name, scriptDir) && filterEntry(f.Name, include, exclude) {
+				total++
+			}
+		}
+		ui.setFiles(j, total)
+
+		staged, scripts, seen, checker = nil, make(map[string][]byte), make(map[string]bool), nil
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = extract(f.Name, int64(f.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if replace != nil {
+		ui.update(j, tr("replacing"))
+		replace()
+	}
+
+	installedFiles := []string{}
+	checksums := []string{}
+	dirs := make(map[string]bool)
+	for _, sf := range staged {
+		relPath, _ := filepath.Rel(basePath, sf.final)
+		if _, err := storage.Stat(relPath); err == nil {
+			audit("overwrite", relPath, c.ID, e.reason)
+		}
+		if owner := setOwner(relPath, c.ID); owner != "" {
+			ui.warn(fmt.Sprintf(tr("Warning: %s replaces %s, which belonged to %s"), c.ID, relPath, owner))
+		}
+
+		if err := storage.Put(sf.staged, relPath); err != nil {
+			return placedPartly(c, installedFiles, err)
+		}
+		dirs[filepath.Dir(relPath)] = true
+		if sf.sum != "" {
+			dedupFile(sf.final, sf.sum, sf.size, c.ID)
+		}
+
+		// Record relative path for info file
+		installedFiles = append(installedFiles, relPath)
+		checksums = append(checksums, fmt.Sprintf("%08X %d %s", sf.crc, sf.size, filepath.ToSlash(relPath)))
+		e.FilesWritten = append(e.FilesWritten, relPath)
+	}
+
+	if fsyncEnabled() {
+		// The info file must not claim files that are not on disk yet
+		for dir := range dirs {
+			if err := storage.Sync(dir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeManifest(c, installedFiles); err != nil {
+		ui.warn(tr("Warning: Could not write component info file"))
+	}
+	os.MkdirAll(filepath.Dir(checksumPath(c)), 0755)
+	if err := writeFileAtomic(checksumPath(c), []byte(strings.Join(checksums, "\n")), 0644); err != nil {
+		ui.warn(fmt.Sprintf(tr("Warning: Could not record the checksums of %s: %v"), c.ID, err))
+	}
+	if err := saveScripts(c, scripts); err != nil {
+		ui.warn(fmt.Sprintf(tr("Warning: Could not keep the maintainer scripts of %s: %v"), c.ID, err))
+	}
+	return nil
+}
+
+// placedPartly records the files of c that were moved into place before err
+// stopped the rest. The old version is already gone, so they are written to
+// an info file without a hash: fpm remove can find them, and c shows as
+// outdated until fpm update installs it again.
+func placedPartly(c *Component, files []string, err error) error {
+	broken := *c
+	broken.Hash = ""
+	if werr := writeManifest(&broken, files); werr != nil {
+		ui.warn(fmt.Sprintf(tr("Warning: Could not record the %d files of %s placed so far: %v"), len(files), c.ID, werr))
+	}
+	c.Downloaded, c.Outdated, c.Broken = true, true, true
+	return fmt.Errorf(tr("%v; %s is incomplete, run fpm update to install it again"), err, c.ID)
+}
+
+// isCached reports whether the archive of c's version is in the cache.
+func isCached(c *Component) bool {
+	if c.Hash == "" {
+		return false
+	}
+	cached := filepath.Join(cacheDir(), archiveName(c))
+	for _, name := range []string{cached, cached + ".zst"} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestFiles returns the files recorded as installed by c, relative to
+// the base path.
+func manifestFiles(c *Component) ([]string, error) {
+	data, err := readStoredFile(filepath.Join("Components", c.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	lines := strings.Split(string(data), "\n")
+	// Skip header (index 0)
+	for i := 1; i < len(lines); i++ {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// pathMax is the longest path Linux accepts, including the terminating NUL.
+const pathMax = 4096
+
+// fsLimits describes what the filesystem under a directory can hold apart.
+type fsLimits struct {
+	caseInsensitive bool
+	nameMax         int
+}
+
+var (
+	fsLimitsMu    sync.Mutex
+	fsLimitsCache = make(map[string]fsLimits)
+)
+
+// filesystemLimits finds out whether the filesystem dir is on, or would be
+// on once created, ignores case (as exFAT and FAT drives do), and how long
+// its file names may be.
+func filesystemLimits(dir string) fsLimits {
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	fsLimitsMu.Lock()
+	defer fsLimitsMu.Unlock()
+	if l, ok := fsLimitsCache[dir]; ok {
+		return l
+	}
+	var l fsLimits
+	var st syscall.Statfs_t
+	if syscall.Statfs(dir, &st) == nil {
+		l.nameMax = int(st.Namelen)
+	}
+	if f, err := ioutil.TempFile(dir, ".fpm-case-test-"); err == nil {
+		f.Close()
+		upper := filepath.Join(dir, strings.ToUpper(filepath.Base(f.Name())))
+		if _, err := os.Stat(upper); err == nil {
+			l.caseInsensitive = true
+		}
+		os.Remove(f.Name())
+	}
+	fsLimitsCache[dir] = l
+	return l
+}
+
+// freeSpace returns how many bytes can be written to the filesystem dir is
+// on, if it can tell.
+func freeSpace(dir string) (int64, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false
+	}
+	return int64(st.Bavail) * int64(st.Bsize), true
+}
+
+// pathChecker finds the files of an archive that the filesystem they are
+// extracted to could not hold as they are: names that are too long, and on
+// filesystems that ignore case, names that differ from each other or from
+// files already there only in case, which would silently overwrite them.
+type pathChecker struct {
+	limits fsLimits
+	seen   map[string]string   // Paths by their lower case form
+	dirs   map[string][]string // Existing entries of directories looked at
+}
+
+// newPathChecker returns a checker for files extracted into dest, or nil if
+// path-checks is off.
+func newPathChecker(dest string) *pathChecker {
+	if getSetting("path-checks") == "off" {
+		return nil
+	}
+	return &pathChecker{
+		limits: filesystemLimits(dest),
+		seen:   make(map[string]string),
+		dirs:   make(map[string][]string),
+	}
+}
+
+// pathProblem is an error found by a pathChecker, which no retry can fix.
+type pathProblem string
+
+func (p pathProblem) Error() string {
+	return string(p)
+}
+
+func (pc *pathChecker) check(fpath string) error {
+	rel, _ := filepath.Rel(basePath, fpath)
+	if len(fpath) >= pathMax {
+		return pathProblem(fmt.Sprintf(tr("%s is longer than the %d bytes a path may have"), rel, pathMax-1))
+	}
+	if pc.limits.nameMax > 0 {
+		for _, part := range strings.Split(rel, string(os.PathSeparator)) {
+			if len(part) > pc.limits.nameMax {
+				return pathProblem(fmt.Sprintf(tr("%s has a name longer than the %d bytes the filesystem allows"), rel, pc.limits.nameMax))
+			}
+		}
+	}
+	if !pc.limits.caseInsensitive {
+		return nil
+	}
+
+	lower := strings.ToLower(fpath)
+	if other, ok := pc.seen[lower]; ok && other != fpath {
+		otherRel, _ := filepath.Rel(basePath, other)
+		return pathProblem(fmt.Sprintf(tr("%s and %s differ only in case, which the filesystem does not tell apart"), otherRel, rel))
+	}
+	pc.seen[lower] = fpath
+
+	dir := filepath.Dir(fpath)
+	entries, ok := pc.dirs[dir]
+	if !ok {
+		if f, err := os.Open(dir); err == nil {
+			entries, _ = f.Readdirnames(-1)
+			f.Close()
+		}
+		pc.dirs[dir] = entries
+	}
+	base := filepath.Base(fpath)
+	for _, name := range entries {
+		if name != base && strings.EqualFold(name, base) {
+			existing, _ := filepath.Rel(basePath, filepath.Join(dir, name))
+			return pathProblem(fmt.Sprintf(tr("%s would overwrite %s, which differs only in case, as the filesystem does not tell them apart"), rel, existing))
+		}
+	}
+	return nil
+}
+
+// --- Lint ---
+
+// reservedNames cannot be used as file names on Windows, with or without an
+// extension. The tree is shared with the Windows version.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// executableExts are Windows executables worth a second look in a component.
+var executableExts = map[string]bool{
+	".exe": true, ".com": true, ".bat": true, ".cmd": true, ".scr": true, ".pif": true, ".ps1": true, ".vbs": true, ".msi": true,
+}
+
+// handleLint checks a component archive for problems before it is submitted
+// to a repository. It exits with status 1 if any are errors.
+func handleLint(opts Options, args []string) {
+	if len(args) == 0 {
+		fatal(tr("An archive is required"))
+	}
+	archive, dir := args[len(args)-1], opts.Value("path")
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not open %s: %v"), archive, err))
+	}
+	defer r.Close()
+
+	var errs, warnings int
+	report := func(isErr bool, format string, a ...interface{}) {
+		if isErr {
+			errs++
+			fmt.Printf(tr("error:   %s\n"), fmt.Sprintf(format, a...))
+		} else {
+			warnings++
+			fmt.Printf(tr("warning: %s\n"), fmt.Sprintf(format, a...))
+		}
+	}
+
+	if dir != "" {
+		if _, ok := localPath(filepath.FromSlash(dir)); !ok {
+			report(true, tr("the path %s is not inside the Flashpoint tree"), dir)
+		} else if fi, err := storage.Stat(filepath.FromSlash(dir)); err != nil || !fi.IsDir() {
+			if _, err := storage.Stat("Components"); err == nil {
+				report(false, tr("the path %s does not exist in the Flashpoint tree at %s"), dir, basePath)
+			}
+		}
+	}
+
+	seen := make(map[string]string)
+	top := make(map[string]bool)
+	for _, f := range r.File {
+		name := f.Name
+		if strings.Contains(name, "\\") {
+			report(true, tr("%s uses backslashes, which are part of the name on Linux; use /"), name)
+			name = strings.ReplaceAll(name, "\\", "/")
+		}
+		if strings.HasPrefix(name, "/") || len(name) > 1 && name[1] == ':' {
+			report(true, tr("%s is an absolute path"), f.Name)
+			continue
+		}
+		if _, ok := localPath(filepath.FromSlash(name)); !ok {
+			report(true, tr("%s leaves the directory the archive is extracted to"), f.Name)
+			continue
+		}
+		name = strings.TrimSuffix(name, "/")
+		top[strings.SplitN(name, "/", 2)[0]] = true
+
+		for _, part := range strings.Split(name, "/") {
+			base := strings.ToUpper(strings.SplitN(part, ".", 2)[0])
+			switch {
+			case reservedNames[base]:
+				report(true, tr("%s uses the reserved name %s, which Windows cannot create"), f.Name, part)
+			case strings.ContainsAny(part, "<>:\"|?*"):
+				report(true, tr("%s contains a character Windows does not allow in names"), f.Name)
+			case strings.HasSuffix(part, ".") || strings.HasSuffix(part, " "):
+				report(true, tr("%s ends a name with a dot or space, which Windows drops"), f.Name)
+			default:
+				continue
+			}
+			break
+		}
+
+		lower := strings.ToLower(name)
+		if other, ok := seen[lower]; ok {
+			if other == name {
+				report(true, tr("%s is in the archive more than once"), f.Name)
+			} else {
+				report(true, tr("%s and %s differ only in case, so they overwrite each other on Windows"), other, name)
+			}
+		}
+		seen[lower] = name
+
+		if strings.HasPrefix(name, scriptDir) || f.FileInfo().IsDir() {
+			continue
+		}
+		switch mode := f.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			report(false, tr("%s is a symbolic link, which fpm installs as a regular file"), name)
+		case mode&0111 != 0:
+			report(false, tr("%s is marked executable"), name)
+		case executableExts[strings.ToLower(path.Ext(name))]:
+			report(false, tr("%s is a Windows executable"), name)
+		}
+	}
+
+	// An archive whose single top directory repeats the path would be
+	// installed one level too deep
+	if dir != "" && len(top) == 1 && top[path.Base(filepath.ToSlash(dir))] {
+		report(false, tr("everything is inside %s/, which is also the last part of the path, so files would end up in %s/%s"),
+			path.Base(dir), dir, path.Base(dir))
+	}
+
+	fmt.Printf(tr("\n%s: %d file(s), %d error(s), %d warning(s)\n"), archive, countFiles(r.File), errs, warnings)
+	if errs > 0 {
+		exit(1)
+	}
+}
+
+func handleRepo(args []string) {
+	if len(args) == 0 || args[0] != "diff" {
+		fatal(tr("A subcommand is required: diff"))
+	}
+	if len(args) != 3 {
+		fatal(tr("An old and a new index are required"))
+	}
+	handleRepoDiff(readIndexArg(args[1]), readIndexArg(args[2]))
+}
+
+// readIndexArg reads the components of the index in the file or at the URL
+// arg. Duplicate IDs keep their first component, as in getComponents.
+func readIndexArg(arg string) map[string]*Component {
+	var list []*Component
+	var err error
+	if strings.Contains(arg, "://") {
+		source := ""
+		for _, src := range sources() {
+			if src.URL == arg {
+				source = src.Name
+			}
+		}
+		timeout := time.Duration(sourceIntSetting(source, "fetch-timeout")) * time.Second
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		list, _, err = streamIndex(ctx, arg, source, nil)
+		cancel()
+	} else {
+		var f *os.File
+		if f, err = os.Open(arg); err == nil {
+			list, _, err = parseIndex(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		fatal(fmt.Sprintf(tr("Could not read the index %s: %v"), arg, err))
+	}
+
+	m := make(map[string]*Component)
+	for _, c := range list {
+		if _, dup := m[c.ID]; dup {
+			debug(fmt.Sprintf(tr("%s lists %s more than once; the first entry is used"), arg, c.ID))
+			continue
+		}
+		m[c.ID] = c
+	}
+	return m
+}
+
+// handleRepoDiff prints what changed for users between two versions of an
+// index: added and removed components, and new hashes, sizes and
+// dependencies of the others.
+func handleRepoDiff(before, after map[string]*Component) {
+	var added, removed, changed []string
+	for id := range after {
+		if before[id] == nil {
+			added = append(added, id)
+		}
+	}
+	for id := range before {
+		if after[id] == nil {
+			removed = append(removed, id)
+		}
+	}
+	changes := make(map[string][]string)
+	for id, o := range before {
+		n := after[id]
+		if n == nil {
+			continue
+		}
+		var lines []string
+		// An index moving to another algorithm can still list the old hash
+		if o.Hash != n.Hash && !n.MatchesHash(o.TaggedHash()) {
+			lines = append(lines, fmt.Sprintf(tr("hash: %s -> %s"), o.TaggedHash(), n.TaggedHash()))
+		}
+		if o.DownloadSize != n.DownloadSize {
+			lines = append(lines, fmt.Sprintf(tr("download size: %s -> %s"), formatBytes(o.DownloadSize), formatBytes(n.DownloadSize)))
+		}
+		if o.InstallSize != n.InstallSize {
+			lines = append(lines, fmt.Sprintf(tr("install size: %s -> %s"), formatBytes(o.InstallSize), formatBytes(n.InstallSize)))
+		}
+		had, has := make(map[string]bool), make(map[string]bool)
+		for _, d := range o.Depends {
+			had[d] = true
+		}
+		for _, d := range n.Depends {
+			has[d] = true
+		}
+		var deps []string
+		for _, d := range n.Depends {
+			if !had[d] {
+				deps = append(deps, "+"+d)
+			}
+		}
+		for _, d := range o.Depends {
+			if !has[d] {
+				deps = append(deps, "-"+d)
+			}
+		}
+		if len(deps) > 0 {
+			lines = append(lines, fmt.Sprintf(tr("depends: %s"), strings.Join(deps, " ")))
+		}
+		if len(lines) > 0 {
+			changed = append(changed, id)
+			changes[id] = lines
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	if len(added) > 0 {
+		fmt.Printf(tr("Added (%d):\n"), len(added))
+		for _, id := range added {
+			line := fmt.Sprintf("  + %s  %s", id, formatBytes(after[id].InstallSize))
+			for _, from := range after[id].RenamedFrom {
+				if before[from] != nil && after[from] == nil {
+					line += fmt.Sprintf(tr(" (renamed from %s)"), from)
+				}
+			}
+			fmt.Println(line)
+		}
+	}
+	if len(removed) > 0 {
+		fmt.Printf(tr("Removed (%d):\n"), len(removed))
+		for _, id := range removed {
+			fmt.Printf("  - %s\n", id)
+		}
+	}
+	if len(changed) > 0 {
+		fmt.Printf(tr("Changed (%d):\n"), len(changed))
+		for _, id := range changed {
+			fmt.Printf("  ~ %s\n", id)
+			for _, line := range changes[id] {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+	if len(added)+len(removed)+len(changed) > 0 {
+		fmt.Println()
+	}
+	fmt.Printf(tr("%d added, %d removed, %d changed, %d unchanged\n"),
+		len(added), len(removed), len(changed), len(before)-len(removed)-len(changed))
+}
+
+// installedSize returns the total size of the files installed by c.
+func installedSize(c *Component) int64 {
+	files, _ := manifestFiles(c)
+	var size int64
+	for _, line := range files {
+		if rel, ok := localPath(line); ok {
+			if fi, err := storage.Stat(rel); err == nil {
+				size += fi.Size()
+			}
+		}
+	}
+	return size
+}
+
+// checksumPath is where the CRC32 and size of each file installed by c are
+// kept, for verify. The Windows version's info files have no room for them.
+func checksumPath(c *Component) string {
+	return filepath.Join(stateDir(), "checksums", c.ID)
+}
+
+type fileChecksum struct {
+	CRC32 uint32
+	Size  int64
+}
+
+// loadChecksums returns the recorded checksums of the files of c by path
+// relative to the base path, with slashes. Components installed before
+// checksums were recorded fall back to the central directory of their
+// archive, as long as they are up to date.
+func loadChecksums(c *Component) map[string]fileChecksum {
+	sums := make(map[string]fileChecksum)
+	if data, err := ioutil.ReadFile(checksumPath(c)); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			parts := strings.SplitN(line, " ", 3)
+			if len(parts) != 3 {
+				continue
+			}
+			crc, err1 := strconv.ParseUint(parts[0], 16, 32)
+			size, err2 := strconv.ParseInt(parts[1], 10, 64)
+			if err1 == nil && err2 == nil {
+				sums[parts[2]] = fileChecksum{uint32(crc), size}
+			}
+		}
+		return sums
+	}
+
+	if c.Outdated {
+		return sums
+	}
+	files, err := archiveEntries(c)
+	if err != nil {
+		return sums
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, scriptDir) {
+			sums[path.Join(c.Directory, f.Name)] = fileChecksum{f.CRC32, int64(f.UncompressedSize64)}
+		}
+	}
+	return sums
+}
+
+// writeManifest writes the info file recording that c is installed with the
+// given files, relative to the base path.
+func writeManifest(c *Component, files []string) error {
+	// Header: HASH SIZE DEP1 DEP2...
+	header := fmt.Sprintf("%s %d %s", c.TaggedHash(), c.InstallSize, strings.Join(c.Depends, " "))
+	lines := append([]string{header}, files...)
+	if err := storage.WriteFile(filepath.Join("Components", c.ID), []byte(strings.Join(lines, "\n"))); err != nil {
+		return err
+	}
+	if fsyncEnabled() {
+		return storage.Sync("Components")
+	}
+	return nil
+}
+
+// finishTransaction runs the bookkeeping due after components were installed.
+func finishTransaction() {
+	compressCache()
+	pruneCache()
+	saveDedupIndex()
+	saveOwners()
+}
+
+// resolveConflicts checks the selected components against each other and
+// against installed ones. Conflicts within the selection cannot be resolved
+// automatically; installed components that conflict with or are replaced by
+// a selected one are returned to be removed first.
+func resolveConflicts(selected []*Component) []*Component {
+	isSelected := make(map[string]bool)
+	for _, c := range selected {
+		isSelected[c.ID] = true
+	}
+
+	// Few components declare conflicts, so the declarations are followed
+	// instead of comparing every pair, which is slow in large catalogs
+	remove := make(map[*Component]bool)
+	for _, a := range components {
+		if len(a.Conflicts)+len(a.Replaces) == 0 || !isSelected[a.ID] && !a.Downloaded {
+			continue
+		}
+		for _, id := range append(append([]string(nil), a.Conflicts...), a.Replaces...) {
+			for _, b := range findComponents(id) {
+				switch {
+				case b == a:
+				case isSelected[a.ID] && isSelected[b.ID]:
+					fatal(fmt.Sprintf(tr("%s and %s conflict with each other and cannot both be installed"), a.ID, b.ID))
+				case isSelected[a.ID] && b.Downloaded:
+					remove[b] = true
+				case isSelected[b.ID]:
+					remove[a] = true
+				}
+			}
+		}
+	}
+
+	var toRemove []*Component
+	for _, c := range components {
+		if remove[c] {
+			toRemove = append(toRemove, c)
+		}
+	}
+	return toRemove
+}
+
+// conflicting reports whether a and b may not be installed together, either
+// because one declares a conflict with the other or replaces it.
+func conflicting(a, b *Component) bool {
+	return matchesAny(b.ID, a.Conflicts) || matchesAny(b.ID, a.Replaces) ||
+		matchesAny(a.ID, b.Conflicts) || matchesAny(a.ID, b.Replaces)
+}
+
+// matchesAny reports whether id is one of ids or inside one of their
+// categories, following the same rules as findComponents.
+func matchesAny(id string, ids []string) bool {
+	for _, other := range ids {
+		if id == other || strings.HasPrefix(id, other+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func printConflictRemovals(toRemove []*Component, selected []*Component) {
+	if len(toRemove) == 0 {
+		return
+	}
+	fmt.Printf(tr("%d component(s) will be removed to resolve conflicts:\n"), len(toRemove))
+	for _, c := range toRemove {
+		for _, s := range selected {
+			if matchesAny(c.ID, s.Replaces) {
+				fmt.Printf(tr("  %s (replaced by %s)\n"), c.ID, s.ID)
+				break
+			}
+			if conflicting(c, s) {
+				fmt.Printf(tr("  %s (conflicts with %s)\n"), c.ID, s.ID)
+				break
+			}
+		}
+	}
+	fmt.Println()
+}
+
+// measureInstallSizes replaces the install sizes from the repository with the
+// uncompressed size of each archive when exact sizes are enabled, and points
+// out where the repository metadata was wrong.
+func measureInstallSizes(list []*Component) {
+	if !exactSizes && getSetting("exact-sizes") != "on" {
+		return
+	}
+
+	var mu sync.Mutex
+	forEachParallel(list, func(c *Component) {
+		files, err := archiveEntries(c)
+		if err != nil {
+			mu.Lock()
+			warn(fmt.Sprintf(tr("Warning: Could not read the archive of %s: %v"), c.ID, err))
+			mu.Unlock()
+			return
+		}
+		var size int64
+		for _, f := range files {
+			size += int64(f.UncompressedSize64)
+		}
+
+		mu.Lock()
+		if size != c.InstallSize {
+			warn(fmt.Sprintf(tr("Note: %s is listed with an install size of %s, but its archive contains %s"),
+				c.ID, formatBytes(c.InstallSize), formatBytes(size)))
+		}
+		c.InstallSize = size
+		mu.Unlock()
+	})
+}
+
+// archiveEntries returns the central directory of the archive of c, read from
+// the cache if possible or else with HTTP range requests, so that only the end
+// of the archive is transferred.
+func archiveEntries(c *Component) ([]*zip.File, error) {
+	cached := filepath.Join(cacheDir(), archiveName(c))
+	if r, err := zip.OpenReader(cached); err == nil {
+		defer r.Close()
+		return r.File, nil
+	}
+
+	req, err := http.NewRequest("HEAD", c.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorize(req, archiveAuth(c))
+	resp, err := clientFor(c.Source).Do(req)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp, "archive")
+	}
+	if resp.ContentLength <= 0 {
+		return nil, errors.New(tr("the server did not report the archive size"))
+	}
+
+	ra := &httpReaderAt{url: c.URL, source: c.Source, auth: archiveAuth(c), blocks: make(map[int64][]byte)}
+	r, err := zip.NewReader(ra, resp.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	return r.File, nil
+}
+
+// httpReaderAt reads a remote file with HTTP range requests, fetching and
+// keeping whole blocks so that parsing a large central directory takes few
+// requests.
+type httpReaderAt struct {
+	url    string
+	source string
+	auth   string // Source whose credentials are sent, see archiveAuth
+	blocks map[int64][]byte
+}
+
+const httpBlockSize = 1 << 20
+
+func (r *httpReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		index := (off + int64(n)) / httpBlockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		start := off + int64(n) - index*httpBlockSize
+		if start >= int64(len(block)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], block[start:])
+	}
+	return n, nil
+}
+
+func (r *httpReaderAt) block(index int64) ([]byte, error) {
+	if b, ok := r.blocks[index]; ok {
+		return b, nil
+	}
+
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	start := index * httpBlockSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+httpBlockSize-1))
+	authorize(req, r.auth)
+	resp, err := clientFor(r.source).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.New(tr("the server does not support range requests"))
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.blocks[index] = b
+	return b, nil
+}
+
+// extractFilters returns the include and exclude globs for c, combining its
+// include.<id>/exclude.<id> settings with the --include/--exclude flags.
+func extractFilters(c *Component) ([]string, []string) {
+	include := append(strings.Fields(config["include."+c.ID]), includes...)
+	exclude := append(strings.Fields(config["exclude."+c.ID]), excludes...)
+	return include, exclude
+}
+
+// filterEntry reports whether the archive entry name should be extracted.
+// With include globs, only matching entries are; exclude globs always win.
+// Maintainer scripts are never extracted with the other files.
+func filterEntry(name string, include, exclude []string) bool {
+	if strings.HasPrefix(name, scriptDir) {
+		return false
+	}
+	for _, pattern := range exclude {
+		if matchEntry(pattern, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if matchEntry(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEntry matches a glob against an archive entry or any of its parent
+// directories, so "lang" and "lang/*" both cover lang/de/strings.txt. Globs
+// without a slash also match the bare file name anywhere, like "*.pdb".
+func matchEntry(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchArchive returns the path of the archive of c in the cache directory,
+// downloading it unless a verified copy is already cached. Interrupted
+// transfers are retried as configured.
+func fetchArchive(c *Component, e *ReportEntry, j *job) (string, error) {
+	dir := cacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	cached := filepath.Join(dir, archiveName(c))
+	if c.Hash != "" {
+		if _, err := os.Stat(cached); os.IsNotExist(err) {
+			decompressArchive(cached + ".zst")
+		}
+		if verifyArchive(cached, c) == nil {
+			now := time.Now()
+			os.Chtimes(cached, now, now)
+			return cached, nil
+		}
+	}
+
+	if err := os.MkdirAll(stagingDir(), 0755); err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= sourceIntSetting(c.Source, "retries"); attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+
+		tmpFile, err := ioutil.TempFile(stagingDir(), archiveName(c)+".*.part")
+		if err != nil {
+			return "", err
+		}
+		var n int64
+		retry := true
+		if command := getSetting("download-command"); command != "" {
+			tmpFile.Close()
+			n, err = externalDownload(command, c, tmpFile.Name(), j)
+		} else {
+			n, retry, err = httpDownload(c, tmpFile, j)
+			tmpFile.Close()
+		}
+		e.BytesDownloaded += n
+		if err == nil && c.Hash != "" {
+			err = verifyArchive(tmpFile.Name(), c)
+		}
+		if err != nil {
+			os.Remove(tmpFile.Name())
+			lastErr = err
+			if !retry {
+				break
+			}
+			continue
+		}
+		if err := moveFile(tmpFile.Name(), cached); err != nil {
+			os.Remove(tmpFile.Name())
+			return "", err
+		}
+		return cached, nil
+	}
+	return "", lastErr
+}
+
+// httpDownload writes the archive of c to f. Client errors are not worth
+// retrying, which is reported by retry.
+func httpDownload(c *Component, f *os.File, j *job) (n int64, retry bool, err error) {
+	resp, retry, err := requestArchive(c, j)
+	if err != nil {
+		return 0, retry, err
+	}
+	defer resp.Body.Close()
+
+	ui.setSize(j, resp.ContentLength)
+	preallocate(f, resp.ContentLength)
+	n, err = io.Copy(f, &progressReader{r: resp.Body, j: j})
+	if err == nil {
+		err = finishFile(f, n)
+	}
+	return n, true, err
+}
+
+// requestArchive starts the download of the archive of c. On error, retry
+// reports whether trying again could help. While the repository answers that
+// it is busy, the request is repeated as it asks, without using up retries.
+func requestArchive(c *Component, j *job) (resp *http.Response, retry bool, err error) {
+	req, err := http.NewRequest("GET", c.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	authorize(req, archiveAuth(c))
+	deadline := time.Now().Add(maxBusyWait)
+	for {
+		if waited, _ := waitIfBusy(context.Background(), req.URL.Host, j); waited {
+			ui.update(j, tr("downloading"))
+		}
+		resp, err = clientFor(c.Source).Do(req)
+		if err != nil {
+			return nil, true, networkError(err)
+		}
+		wait := retryAfter(resp)
+		if wait == 0 || time.Now().Add(wait).After(deadline) {
+			break
+		}
+		resp.Body.Close()
+		markBusy(req.URL.Host, wait)
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, resp.StatusCode >= 500, statusError(resp, "archive")
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		head := make([]byte, 512)
+		k, _ := io.ReadFull(resp.Body, head)
+		resp.Body.Close()
+		return nil, false, notXMLError(resp, head[:k])
+	}
+	return resp, false, nil
+}
+
+// streamArchive downloads the archive of c and hands each file in it to
+// extract as it arrives, without storing the archive. The archive's
+// checksum can only be verified at the end, so extract must stage files
+// rather than install them.
+func streamArchive(c *Component, j *job, extract func(name string, size int64, r io.Reader) error) (n int64, retry bool, err error) {
+	resp, retry, err := requestArchive(c, j)
+	if err != nil {
+		return 0, retry, err
+	}
+	defer resp.Body.Close()
+
+	ui.setSize(j, resp.ContentLength)
+	ui.update(j, tr("streaming"))
+	sum, err := archiveHash(c)
+	if err != nil {
+		return 0, false, err
+	}
+	pr := &progressReader{r: resp.Body, j: j}
+	br := bufio.NewReaderSize(io.TeeReader(pr, sum), 64<<10)
+
+	if err := readZipStream(br, extract); err != nil {
+		var problem pathProblem
+		return pr.n, !errors.Is(err, errZipStream) && !errors.As(err, &problem), err
+	}
+	// What follows the entries is the central directory
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return pr.n, true, err
+	}
+	if c.Hash != "" {
+		if err := checkHash(c, sum); err != nil {
+			return pr.n, true, err
+		}
+	}
+	return pr.n, false, nil
+}
+
+var errZipStream = errors.New("archive cannot be streamed")
+
+// readZipStream reads a zip file front to back by its local file headers,
+// which is enough for archives whose entries are stored with known sizes or
+// deflated. Each file is passed to extract, and checked against its CRC32
+// once extract has read or skipped it.
+func readZipStream(br *bufio.Reader, extract func(name string, size int64, r io.Reader) error) error {
+	for {
+		var header [30]byte
+		if _, err := io.ReadFull(br, header[:4]); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(header[:4]) != 0x04034b50 {
+			// Central directory or end of archive
+			return nil
+		}
+		if _, err := io.ReadFull(br, header[4:]); err != nil {
+			return err
+		}
+		flags := binary.LittleEndian.Uint16(header[6:])
+		method := binary.LittleEndian.Uint16(header[8:])
+		crc := binary.LittleEndian.Uint32(header[14:])
+		csize := int64(binary.LittleEndian.Uint32(header[18:]))
+		usize := int64(binary.LittleEndian.Uint32(header[22:]))
+		meta := make([]byte, int(binary.LittleEndian.Uint16(header[26:]))+int(binary.LittleEndian.Uint16(header[28:])))
+		if _, err := io.ReadFull(br, meta); err != nil {
+			return err
+		}
+		name := string(meta[:binary.LittleEndian.Uint16(header[26:])])
+		extra := meta[len(name):]
+
+		// Zip64 sizes are in an extra field
+		zip64 := false
+		for len(extra) >= 4 {
+			id, n := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+			if len(extra) < 4+n {
+				break
+			}
+			if id == 1 && n >= 16 {
+				zip64 = true
+				usize = int64(binary.LittleEndian.Uint64(extra[4:]))
+				csize = int64(binary.LittleEndian.Uint64(extra[12:]))
+			}
+			extra = extra[4+n:]
+		}
+
+		if flags&1 != 0 {
+			return fmt.Errorf("%w: %s is encrypted", errZipStream, name)
+		}
+		descriptor := flags&8 != 0
+		if descriptor {
+			usize = 0 // Unknown until the descriptor
+		}
+		var data, limited io.Reader
+		switch {
+		case method == zip.Deflate:
+			// flate reads byte by byte from a bufio.Reader, so it stops
+			// exactly at the end of the entry
+			if descriptor {
+				data = flate.NewReader(br)
+			} else {
+				limited = io.LimitReader(br, csize)
+				data = flate.NewReader(bufio.NewReader(limited))
+			}
+		case method == zip.Store && !descriptor:
+			data = io.LimitReader(br, csize)
+		case method == zip.Store:
+			return fmt.Errorf("%w: %s is stored with its size after the data", errZipStream, name)
+		default:
+			return fmt.Errorf("%w: %s uses compression method %d", errZipStream, name, method)
+		}
+
+		h := crc32.NewIEEE()
+		var err error
+		if !strings.HasSuffix(name, "/") {
+			err = extract(name, usize, io.TeeReader(data, h))
+		}
+		if err == nil {
+			// Whatever extract skipped still counts for the checksum
+			_, err = io.Copy(h, data)
+		}
+		if err != nil {
+			return err
+		}
+		if limited != nil {
+			// Anything after the end of the deflated data
+			if _, err := io.Copy(ioutil.Discard, limited); err != nil {
+				return err
+			}
+		}
+
+		if descriptor {
+			size := 12
+			if zip64 {
+				size = 20
+			}
+			d := make([]byte, size)
+			if _, err := io.ReadFull(br, d[:4]); err != nil {
+				return err
+			}
+			if binary.LittleEndian.Uint32(d) == 0x08074b50 {
+				if _, err := io.ReadFull(br, d[:4]); err != nil {
+					return err
+				}
+			}
+			crc = binary.LittleEndian.Uint32(d)
+			if _, err := io.ReadFull(br, d[4:size]); err != nil {
+				return err
+			}
+		}
+		if h.Sum32() != crc {
+			return fmt.Errorf(tr("%s in the archive is corrupt"), name)
+		}
+	}
+}
+
+// externalDownload runs the download-command setting to fetch the archive of
+// c to output. The template is split into arguments before {url}, {output},
+// {dir} and {file} are substituted, so paths need no quoting. Progress is
+// taken from the size of the output file while the command runs.
+func externalDownload(command string, c *Component, output string, j *job) (int64, error) {
+	var args []string
+	for _, arg := range strings.Fields(command) {
+		arg = strings.NewReplacer(
+			"{url}", c.URL,
+			"{output}", output,
+			"{dir}", filepath.Dir(output),
+			"{file}", filepath.Base(output),
+		).Replace(arg)
+		args = append(args, arg)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	ui.setSize(j, c.DownloadSize)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var reported int64
+	poll := func() {
+		if fi, err := os.Stat(output); err == nil && fi.Size() > reported {
+			ui.add(j, fi.Size()-reported)
+			reported = fi.Size()
+		}
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			poll()
+		case err := <-done:
+			poll()
+			if err != nil {
+				lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+				return reported, fmt.Errorf(tr("%s failed: %v: %s"), args[0], err, lines[len(lines)-1])
+			}
+			return reported, nil
+		}
+	}
+}
+
+// stagingDir holds partial downloads and extracted files until they are
+// complete. It defaults to a directory inside the base path, so that they can
+// be renamed into place atomically.
+func stagingDir() string {
+	if dir := getSetting("staging-dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(stateDir(), "tmp")
+}
+
+// moveFile renames src to dst, falling back to copying when they are on
+// different filesystems. The copy is renamed into place, so dst is never
+// seen incomplete.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	preallocate(out, fi.Size())
+	n, err := io.Copy(out, in)
+	if err == nil {
+		err = finishFile(out, n)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), fi.Mode())
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// preallocate reserves size bytes for f, which is about to be written from
+// the start, so that large files are not fragmented. Filesystems that
+// cannot do this are simply written to as usual.
+func preallocate(f *os.File, size int64) {
+	if size > 0 && getSetting("preallocate") == "on" {
+		syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	}
+}
+
+// finishFile completes a file written with preallocate: it cuts off space
+// reserved beyond the written size and, with fsync on, flushes it to disk.
+func finishFile(f *os.File, written int64) error {
+	if fi, err := f.Stat(); err == nil && fi.Size() > written {
+		if err := f.Truncate(written); err != nil {
+			return err
+		}
+	}
+	if fsyncEnabled() {
+		return f.Sync()
+	}
+	return nil
+}
+
+func fsyncEnabled() bool {
+	return fsyncFlag || getSetting("fsync") == "on"
+}
+
+// --- Storage ---
+
+// Storage is where the files of components are installed: the Flashpoint
+// tree under the base path. Paths are relative to it. Archives are always
+// downloaded and staged on the local filesystem and handed over with Put, so
+// a backend only has to take complete files.
+type Storage interface {
+	// Stat describes the file at rel without following symbolic links.
+	Stat(rel string) (os.FileInfo, error)
+	// Put moves the staged local file src to rel, replacing any file there
+	// and creating the directories leading to it.
+	Put(src, rel string) error
+	// WriteFile replaces the file at rel with data, creating its directory.
+	// A crash must leave either the old or the new contents.
+	WriteFile(rel string, data []byte) error
+	// Remove removes the file or empty directory at rel.
+	Remove(rel string) error
+	// Sync makes the entries of the directory rel durable.
+	Sync(rel string) error
+	// Open opens the file at rel for reading.
+	Open(rel string) (io.ReadCloser, error)
+	// List returns the names of the entries of the directory rel, sorted.
+	List(rel string) ([]string, error)
+	// Local returns the directory of the tree on the local filesystem, or ""
+	// if it is kept elsewhere. Symbolic links, hardlinks and files held open
+	// by running programs only exist in a local tree.
+	Local() string
+}
+
+// storage is the backend the files of components are written to and
+// removed from.
+var storage Storage = localStorage{}
+
+// localStorage is the base path on the local filesystem.
+type localStorage struct{}
+
+func (localStorage) Stat(rel string) (os.FileInfo, error) {
+	return os.Lstat(filepath.Join(basePath, rel))
+}
+
+func (localStorage) Put(src, rel string) error {
+	dst := filepath.Join(basePath, rel)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	return moveFile(src, dst)
+}
+
+func (localStorage) WriteFile(rel string, data []byte) error {
+	dst := filepath.Join(basePath, rel)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	return writeFileAtomic(dst, data, 0644)
+}
+
+func (localStorage) Remove(rel string) error {
+	return os.Remove(filepath.Join(basePath, rel))
+}
+
+func (localStorage) Sync(rel string) error {
+	return syncDir(filepath.Join(basePath, rel))
+}
+
+func (localStorage) Open(rel string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(basePath, rel))
+}
+
+func (localStorage) List(rel string) ([]string, error) {
+	d, err := os.Open(filepath.Join(basePath, rel))
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	sort.Strings(names)
+	return names, err
+}
+
+func (localStorage) Local() string {
+	return basePath
+}
+
+// readStoredFile returns the contents of the file at rel in storage.
+func readStoredFile(rel string) ([]byte, error) {
+	f, err := storage.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// infoFileNames returns the IDs of the installed components, from the info
+// files in the Components directory. Hidden files, such as info files being
+// written, are left out.
+func infoFileNames() ([]string, error) {
+	names, err := storage.List("Components")
+	var ids []string
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if fi, err := storage.Stat(filepath.Join("Components", name)); err == nil && !fi.IsDir() {
+			ids = append(ids, name)
+		}
+	}
+	return ids, err
+}
+
+// syncDir flushes the entries of dir, such as files renamed into it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func cacheDir() string {
+	if dir := getSetting("cache-dir"); dir != "" {
+		return dir
+	}
+	if systemMode() {
+		return systemCacheDir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "fpm")
+	}
+	return filepath.Join(os.TempDir(), "fpm")
+}
+
+func archiveName(c *Component) string {
+	if c.Hash == "" {
+		return c.ID + ".zip"
+	}
+	return c.ID + "-" + strings.ToUpper(c.Hash) + ".zip"
+}
+
+// verifyArchive checks the file at path against the hash of c's version.
+func verifyArchive(path string, c *Component) error {
+	h, err := archiveHash(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	return checkHash(c, h)
+}
+
+// archiveHash returns a hash for verifying the archive of c's version.
+func archiveHash(c *Component) (hash.Hash, error) {
+	newHash, ok := hashAlgorithms[c.HashAlg]
+	if !ok {
+		return nil, fmt.Errorf(tr("unsupported hash algorithm %s"), c.HashAlg)
+	}
+	return newHash(), nil
+}
+
+// checkHash compares the sum of h with the hash of c's version.
+func checkHash(c *Component, h hash.Hash) error {
+	if sum := strings.ToUpper(hex.EncodeToString(h.Sum(nil))); !strings.EqualFold(sum, c.Hash) {
+		return fmt.Errorf(tr("checksum mismatch (expected %s, got %s)"), strings.ToUpper(c.Hash), sum)
+	}
+	return nil
+}
+
+// fileCRC32 returns the CRC32 checksum and size of the file at rel in
+// storage.
+func fileCRC32(rel string) (uint32, int64, error) {
+	f, err := storage.Open(rel)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(h, f)
+	return h.Sum32(), n, err
+}
+
+// cachedArchives lists the archives kept in the cache, compressed or not.
+func cachedArchives() []os.FileInfo {
+	entries, err := ioutil.ReadDir(cacheDir())
+	if err != nil {
+		return nil
+	}
+
+	var archives []os.FileInfo
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.Mode().IsRegular() && (strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".zip.zst")) {
+			archives = append(archives, fi)
+		}
+	}
+	return archives
+}
+
+// archiveComponent returns the component ID in the name of a cached archive,
+// which is followed by the archive's hash.
+func archiveComponent(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".zst"), ".zip")
+	if i := strings.LastIndexByte(name, '-'); i > 0 && hashAlgOf(name[i+1:]) != "" {
+		if _, err := hex.DecodeString(name[i+1:]); err == nil {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// handleVerifyDownloads checks every cached archive against the hash its
+// version was published with, which is part of its name, and deletes the
+// corrupt ones so that rollbacks and snapshot restores can trust the cache.
+// It also reports the cached versions no source offers any more.
+func handleVerifyDownloads() {
+	archives := cachedArchives()
+	if len(archives) == 0 {
+		fmt.Println(tr("No archives are cached"))
+		return
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].Name() < archives[j].Name()
+	})
+	var total int64
+	for _, fi := range archives {
+		total += fi.Size()
+	}
+
+	var corrupt, unverified, gone, old []string
+	var freed int64
+	ui.begin(len(archives), total)
+	for _, fi := range archives {
+		name := fi.Name()
+		id := archiveComponent(name)
+		value := strings.TrimSuffix(strings.TrimSuffix(name, ".zst"), ".zip")[len(id):]
+		j := ui.start(name, tr("verifying"))
+		if value == "" {
+			// Archives of components without a hash are named by ID alone
+			unverified = append(unverified, name)
+			ui.done(j, tr("no hash"))
+			continue
+		}
+		if _, err := exec.LookPath("zstd"); err != nil && strings.HasSuffix(name, ".zst") {
+			unverified = append(unverified, name)
+			ui.done(j, tr("zstd not found"))
+			continue
+		}
+		value = value[1:]
+		v := &Component{ID: id, Hash: value, HashAlg: hashAlgOf(value)}
+		if err := verifyCached(filepath.Join(cacheDir(), name), v, j); err != nil {
+			if os.Remove(filepath.Join(cacheDir(), name)) == nil {
+				freed += fi.Size()
+			}
+			corrupt = append(corrupt, fmt.Sprintf("%s: %v", name, err))
+			ui.done(j, tr("corrupt"))
+			continue
+		}
+		ui.done(j, "")
+
+		offered := false
+		for _, c := range providers[id] {
+			if c.MatchesHash(v.TaggedHash()) {
+				offered = true
+			}
+		}
+		switch {
+		case len(providers[id]) == 0:
+			gone = append(gone, name)
+		case !offered:
+			old = append(old, name)
+		}
+	}
+	ui.end()
+
+	for _, group := range []struct {
+		title string
+		list  []string
+	}{
+		{tr("Corrupt archives, deleted:"), corrupt},
+		{tr("Archives without a hash or compressed without zstd in PATH, not verified:"), unverified},
+		{tr("Versions no source offers any more:"), old},
+		{tr("Archives of components no source offers any more:"), gone},
+	} {
+		if len(group.list) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s\n", group.title)
+		for _, line := range group.list {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	fmt.Printf(tr("\nVerified %d cached archives: %d corrupt"), len(archives)-len(unverified), len(corrupt))
+	if freed > 0 {
+		fmt.Printf(tr(", %s freed"), formatBytes(freed))
+	}
+	fmt.Println()
+}
+
+// verifyCached checks a cached archive, compressed or not, against the hash
+// of c without decompressing it in the cache.
+func verifyCached(path string, c *Component, j *job) error {
+	h, err := archiveHash(c)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = &progressReader{r: f, j: j}
+	if strings.HasSuffix(path, ".zst") {
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = r
+		cmd.Stdout = h
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf(tr("could not decompress: %v"), err)
+		}
+	} else if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	return checkHash(c, h)
+}
+
+// pruneVersions removes all but the newest cache-versions archives of each
+// component and returns the ones left.
+func pruneVersions(archives []os.FileInfo) []os.FileInfo {
+	keep := getIntSetting("cache-versions")
+	if keep <= 0 {
+		return archives
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].ModTime().After(archives[j].ModTime())
+	})
+	count := make(map[string]int)
+	var left []os.FileInfo
+	for _, fi := range archives {
+		id := archiveComponent(fi.Name())
+		count[id]++
+		if count[id] > keep && os.Remove(filepath.Join(cacheDir(), fi.Name())) == nil {
+			continue
+		}
+		left = append(left, fi)
+	}
+	return left
+}
+
+// pruneCache evicts the least recently used archives until the cache fits
+// within cache-max-size.
+func pruneCache() {
+	limit, _ := parseSize(getSetting("cache-max-size"))
+	archives := pruneVersions(cachedArchives())
+
+	var total int64
+	for _, fi := range archives {
+		total += fi.Size()
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].ModTime().Before(archives[j].ModTime())
+	})
+
+	for _, fi := range archives {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(filepath.Join(cacheDir(), fi.Name())); err == nil {
+			total -= fi.Size()
+		}
+	}
+}
+
+// compressCache recompresses the plain archives left in the cache by the
+// current transaction with zstd. Archives are decompressed again by
+// fetchArchive when they are needed.
+func compressCache() {
+	if getSetting("cache-compression") != "zstd" {
+		return
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		warn(tr("Warning: zstd was not found in PATH, kept archives are not compressed"))
+		return
+	}
+
+	level := fmt.Sprintf("-%d", getIntSetting("cache-compression-level"))
+	for _, fi := range cachedArchives() {
+		if !strings.HasSuffix(fi.Name(), ".zip") {
+			continue
+		}
+		name := filepath.Join(cacheDir(), fi.Name())
+		cmd := exec.Command("zstd", "-q", "-f", level, "--rm", name, "-o", name+".zst")
+		if err := cmd.Run(); err != nil {
+			os.Remove(name + ".zst")
+			continue
+		}
+		// Keep the access time for LRU eviction
+		os.Chtimes(name+".zst", fi.ModTime(), fi.ModTime())
+	}
+}
+
+// decompressArchive restores a zstd-compressed cached archive next to it.
+func decompressArchive(compressed string) {
+	fi, err := os.Stat(compressed)
+	if err != nil {
+		return
+	}
+	if _, err := exec.LookPath("zstd"); err != nil {
+		return
+	}
+	target := strings.TrimSuffix(compressed, ".zst")
+	if err := exec.Command("zstd", "-q", "-d", "-f", compressed, "-o", target).Run(); err != nil {
+		os.Remove(target)
+		return
+	}
+	os.Remove(compressed)
+	os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// removeWorkers is the number of files of a component deleted at once.
+const removeWorkers = 8
+
+func removeComponent(c *Component, e *ReportEntry) {
+	j := ui.start(c.ID, tr("removing"))
+
+	files, err := manifestFiles(c)
+	if err == nil {
+		ui.setFiles(j, len(files))
+		queue := make(chan string, removeWorkers*64)
+		go func() {
+			for _, line := range files {
+				queue <- line
+			}
+			close(queue)
+		}()
+
+		// Directories are only pruned once every file is gone, instead of
+		// checking them again after each file.
+		var mu sync.Mutex
+		dirs := make(map[string]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < removeWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for line := range queue {
+					rel, ok := removeFile(c, e, line)
+					ui.addFile(j)
+					if !ok {
+						continue
 					}
-				} else {
-					toUpdate = append(toUpdate, c)
-					for _, dep := range c.Depends {
-						recurse(dep, true)
+					mu.Lock()
+					e.FilesRemoved = append(e.FilesRemoved, line)
+					for dir := filepath.Dir(rel); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+						dirs[dir] = true
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		sort.Strings(e.FilesRemoved)
+		removeEmptyDirs(dirs)
+	}
+
+	storage.Remove(filepath.Join("Components", c.ID))
+	os.Remove(checksumPath(c))
+	os.RemoveAll(scriptsPath(c))
+	ui.done(j, tr("removed"))
+}
+
+// removeFile deletes or trashes the manifest entry line of c, returning its
+// path relative to the base path. It reports false if the file was kept.
+func removeFile(c *Component, e *ReportEntry, line string) (string, bool) {
+	rel, ok := localPath(line)
+	if !ok {
+		ui.warn(fmt.Sprintf(tr("Warning: Not removing %s, which is outside the base path"), line))
+		return "", false
+	}
+	fullPath := filepath.Join(basePath, rel)
+	if !insideBase(filepath.Dir(fullPath)) {
+		ui.warn(fmt.Sprintf(tr("Warning: Not removing %s, which is behind a symbolic link leading outside the base path"), line))
+		return "", false
+	}
+	if !disown(rel, c.ID) {
+		// Another component installed the file since
+		return "", false
+	}
+	if trashBatch != "" && e.reason == "remove" {
+		if _, err := storage.Stat(rel); err == nil {
+			if err := moveToTrash(rel); err != nil {
+				ui.warn(fmt.Sprintf(tr("Warning: Could not move %s to the trash, so it was kept: %v"), line, err))
+				return "", false
+			}
+			audit("trash", line, c.ID, e.reason)
+		}
+	} else {
+		if _, err := storage.Stat(rel); err == nil {
+			audit("delete", line, c.ID, e.reason)
+		}
+		storage.Remove(rel)
+	}
+	return rel, true
+}
+
+// checkInUse refuses to go on if running programs, such as the launcher or
+// the game server, have files of the given installed components open, as
+// they would keep running on deleted files. With force it only warns.
+func checkInUse(list []*Component, force bool) {
+	users := filesInUse(list)
+	if len(users) == 0 {
+		return
+	}
+	fmt.Println(tr("Files of these components are in use:"))
+	for _, c := range list {
+		if len(users[c.ID]) > 0 {
+			fmt.Printf("  %s: %s\n", c.ID, strings.Join(users[c.ID], ", "))
+		}
+	}
+	fmt.Println()
+	if !force {
+		fatal(tr("Close the programs using them first, or add --force to change the files anyway"))
+	}
+	warn(tr("Warning: Changing files that are in use, as --force was given"))
+}
+
+// filesInUse returns the programs that have files of the given components
+// open or mapped, as "name (pid)" by component ID. It reads /proc, so it
+// finds nothing on systems without it, and only sees the processes of other
+// users when run as root.
+func filesInUse(list []*Component) map[string][]string {
+	base := storage.Local()
+	if base == "" {
+		return nil
+	}
+	// The kernel shows paths with symbolic links resolved
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		base = resolved
+	}
+	owner := make(map[string]string)
+	for _, c := range list {
+		files, err := manifestFiles(c)
+		if err != nil {
+			continue
+		}
+		for _, line := range files {
+			if rel, ok := localPath(line); ok {
+				owner[filepath.Join(base, rel)] = c.ID
+			}
+		}
+	}
+	if len(owner) == 0 {
+		return nil
+	}
+
+	procs, _ := ioutil.ReadDir("/proc")
+	users := make(map[string][]string)
+	for _, fi := range procs {
+		pid, err := strconv.Atoi(fi.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		dir := filepath.Join("/proc", fi.Name())
+		var open []string
+		if fds, err := ioutil.ReadDir(filepath.Join(dir, "fd")); err == nil {
+			for _, fd := range fds {
+				if target, err := os.Readlink(filepath.Join(dir, "fd", fd.Name())); err == nil {
+					open = append(open, target)
+				}
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+			open = append(open, target)
+		}
+		if maps, err := ioutil.ReadFile(filepath.Join(dir, "maps")); err == nil {
+			for _, line := range strings.Split(string(maps), "\n") {
+				if i := strings.Index(line, " /"); i >= 0 {
+					open = append(open, strings.TrimSpace(line[i:]))
+				}
+			}
+		}
+
+		seen := make(map[string]bool)
+		for _, p := range open {
+			id := owner[p]
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			name, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+			users[id] = append(users[id], fmt.Sprintf("%s (%d)", strings.TrimSpace(string(name)), pid))
+		}
+	}
+	return users
+}
+
+// trashBatch is the directory files removed by the current remove command
+// are moved to, or "" if they are deleted.
+var trashBatch string
+
+func trashDir() string {
+	if dir := getSetting("trash-dir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(stateDir(), "trash")
+}
+
+// moveToTrash moves the file rel, relative to the base path, to the same
+// path in the current trash batch.
+func moveToTrash(rel string) error {
+	dst := filepath.Join(trashBatch, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return moveFile(filepath.Join(basePath, rel), dst)
+}
+
+// handleTrash lists the batches of removed files in the trash, or deletes
+// them to free their space.
+func handleTrash(args []string) {
+	if len(args) != 1 || args[0] != "list" && args[0] != "empty" {
+		fatal(tr("A subcommand is required: list or empty"))
+	}
+	entries, err := ioutil.ReadDir(trashDir())
+	if err != nil && !os.IsNotExist(err) {
+		fatal(err.Error())
+	}
+
+	var total int64
+	var batches int
+	for _, fi := range entries {
+		if !fi.IsDir() {
+			continue
+		}
+		var size int64
+		files := 0
+		filepath.Walk(filepath.Join(trashDir(), fi.Name()), func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+				files++
+			}
+			return nil
+		})
+		if args[0] == "list" {
+			fmt.Printf(tr("%s  %s files, %s\n"), fi.Name(), formatCount(files), formatBytes(size))
+		}
+		total += size
+		batches++
+	}
+
+	if args[0] == "list" {
+		if batches == 0 {
+			fmt.Println(tr("The trash is empty"))
+		} else {
+			fmt.Printf(tr("\n%d removal(s) in %s, %s in total\n"), batches, trashDir(), formatBytes(total))
+		}
+		return
+	}
+	if batches == 0 {
+		fmt.Println(tr("The trash is empty"))
+		return
+	}
+	if !confirm(fmt.Sprintf(tr("Permanently delete %s of removed files?"), formatBytes(total))) {
+		return
+	}
+	beginTransaction()
+	for _, fi := range entries {
+		if fi.IsDir() {
+			if err := os.RemoveAll(filepath.Join(trashDir(), fi.Name())); err != nil {
+				warn(fmt.Sprintf(tr("Warning: Could not delete %s: %v"), fi.Name(), err))
+			}
+		}
+	}
+	releaseLock()
+	fmt.Printf(tr("Freed %s\n"), formatBytes(total))
+}
+
+// localPath cleans a manifest path and reports whether it stays inside the
+// base path.
+func localPath(rel string) (string, bool) {
+	rel = filepath.Clean(rel)
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// insideBase reports whether dir, with symbolic links resolved, is inside the
+// base path, itself resolved. A dir that does not exist has nothing to
+// remove and counts as inside.
+func insideBase(dir string) bool {
+	local := storage.Local()
+	if local == "" {
+		// There are no symbolic links to leave the tree by
+		return true
+	}
+	base, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return resolved == base || strings.HasPrefix(resolved, base+string(os.PathSeparator))
+}
+
+// removeEmptyDirs removes the given directories, relative to the base path,
+// deepest first, if they are empty. Only directories that held files of the
+// removed component are candidates, so directories shared with other
+// components stay as long as those have files in them. Symbolic links are
+// never followed or removed.
+func removeEmptyDirs(dirs map[string]bool) {
+	var list []string
+	for dir := range dirs {
+		list = append(list, dir)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		di := strings.Count(list[i], string(os.PathSeparator))
+		dj := strings.Count(list[j], string(os.PathSeparator))
+		if di != dj {
+			return di > dj
+		}
+		return list[i] < list[j]
+	})
+
+	for _, dir := range list {
+		fi, err := storage.Stat(dir)
+		if err != nil || !fi.IsDir() || !insideBase(filepath.Dir(filepath.Join(basePath, dir))) {
+			continue
+		}
+		// Removing a directory only succeeds if it is empty
+		storage.Remove(dir)
+	}
+}
+
+// --- Watch ---
+
+// WatchEvent is a line of output of fpm watch. Updates is the number of
+// outdated components at the time of the event.
+type WatchEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	ID       string    `json:"id,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Updates  int       `json:"updates"`
+}
+
+// handleWatch prints the state of every component as JSON lines, then polls
+// the installed components and prints an event whenever one changes state.
+// The index is fetched again every watch-refresh minutes, and whenever
+// another fpm process refreshes it.
+func handleWatch(opts Options) {
+	interval := 2 * time.Second
+	if opts.Has("interval") {
+		value := opts.Value("interval")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			fatal(fmt.Sprintf(tr("Invalid interval %s"), value))
+		}
+		interval = time.Duration(n) * time.Second
+	}
+	refreshEvery := time.Duration(getIntSetting("watch-refresh")) * time.Minute
+	refreshPath := filepath.Join(stateDir(), "last-refresh")
+
+	enc := json.NewEncoder(os.Stdout)
+	emit := func(ev WatchEvent) {
+		ev.Time = time.Now()
+		for _, c := range components {
+			if c.Outdated {
+				ev.Updates++
+			}
+		}
+		enc.Encode(ev)
+	}
+	refreshStamp := func() time.Time {
+		if fi, err := os.Stat(refreshPath); err == nil {
+			return fi.ModTime()
+		}
+		return time.Time{}
+	}
+
+	states := make(map[string]string)
+	for _, c := range components {
+		states[c.ID] = watchState(c)
+		emit(WatchEvent{Event: "state", ID: c.ID, State: states[c.ID]})
+	}
+	lastRefresh := time.Now()
+	stamp := refreshStamp()
+
+	for range time.Tick(interval) {
+		if time.Since(lastRefresh) >= refreshEvery || !refreshStamp().Equal(stamp) {
+			lastRefresh = time.Now()
+			if err := getComponents(); err != nil {
+				emit(WatchEvent{Event: "error", Message: err.Error()})
+			} else {
+				emit(WatchEvent{Event: "refreshed"})
+			}
+			stamp = refreshStamp()
+		} else {
+			forgetInstalled()
+			for _, c := range components {
+				c.Downloaded, c.Outdated, c.Pinned, c.Broken, c.OldSize = false, false, false, false, 0
+				loadState(c)
+			}
+			checkInstalled()
+		}
+
+		seen := make(map[string]bool)
+		for _, c := range components {
+			seen[c.ID] = true
+			state := watchState(c)
+			if prev, ok := states[c.ID]; !ok || prev != state {
+				emit(WatchEvent{Event: "changed", ID: c.ID, State: state, Previous: prev})
+				states[c.ID] = state
+			}
+		}
+		for id, prev := range states {
+			if !seen[id] {
+				emit(WatchEvent{Event: "changed", ID: id, State: "unlisted", Previous: prev})
+				delete(states, id)
+			}
+		}
+	}
+}
+
+// watchState names the state of c in fpm watch events.
+func watchState(c *Component) string {
+	switch {
+	case !c.Downloaded:
+		return "available"
+	case c.Broken:
+		return "broken"
+	case c.Outdated:
+		return "outdated"
+	}
+	return "installed"
+}
+
+// --- Shell ---
+
+// shellExit is raised by exit in the shell to end the current command.
+type shellExit struct {
+	code int
+}
+
+var (
+	inShell     bool
+	shellEditor *lineEditor
+)
+
+// handleShell runs commands read from a prompt against the components loaded
+// once at startup, until exit or end of input. refresh loads them again.
+func handleShell() {
+	if inShell {
+		fmt.Println(tr("The shell is already running"))
+		return
+	}
+	inShell = true
+	defer func() { inShell = false }()
+
+	shellEditor = newLineEditor(filepath.Join(stateDir(), "shell-history"))
+	defer shellEditor.saveHistory()
+	fmt.Println(tr("Enter commands without \"fpm\"; help lists them, exit leaves the shell"))
+
+	for {
+		line, err := shellEditor.readLine("fpm> ", true)
+		if err != nil {
+			fmt.Println()
+			return
+		}
+		words, err := splitWords(line)
+		if err != nil {
+			fmt.Printf(tr("Error: %s\n"), err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "exit", "quit":
+			return
+		case "history":
+			for i, h := range shellEditor.history {
+				fmt.Printf("%4d  %s\n", i+1, h)
+			}
+		case "refresh":
+			if err := getComponents(); err != nil {
+				fmt.Printf(tr("Error: %s\n"), fmt.Sprintf(tr("Could not fetch components: %v"), err))
+			}
+		default:
+			runShellCommand(words)
+		}
+	}
+}
+
+// splitWords splits a shell command line into words the way sh does for
+// quotes and backslashes, so that note <id> "needed for X" gives the note
+// without the quotes. Variables and globs are not expanded.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			// Inside double quotes a backslash only escapes these
+			if quote == '"' && !strings.ContainsRune("\"\\$`", r) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf(tr("unterminated %c quote"), quote)
+	}
+	if escaped {
+		word.WriteRune('\\')
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runShellCommand runs a command line in the shell. Global flags only apply
+// to the command they are given with, and errors end the command but not
+// the shell. A --report given with the command is written when it ends; one
+// given for the whole shell collects every command and is written on exit.
+func runShellCommand(words []string) {
+	saved := []interface{}{assumeYes, assumeNo, exactSizes, checkFiles, sizeUnits, curlDebug, includes, excludes, streamArchives, fsyncFlag, debugOutput, statusFile, allLocales, report}
+	defer func() {
+		r := recover()
+		if r != nil {
+			if _, ok := r.(shellExit); !ok {
+				panic(r)
+			}
+			releaseLock()
+		}
+
+		outer := saved[13].(*Report)
+		if report != outer {
+			writeReport()
+		} else if outer != nil {
+			// A failed command does not fail the shell
+			outer.mu.Lock()
+			outer.ExitCode, outer.Error = 0, ""
+			outer.mu.Unlock()
+		}
+		assumeYes, assumeNo, exactSizes, checkFiles = saved[0].(bool), saved[1].(bool), saved[2].(bool), saved[3].(bool)
+		sizeUnits, curlDebug = saved[4].(string), saved[5].(bool)
+		includes, excludes = saved[6].([]string), saved[7].([]string)
+		streamArchives, fsyncFlag, debugOutput = saved[8].(bool), saved[9].(bool), saved[10].(bool)
+		statusFile = saved[11].(*os.File)
+		allLocales, report = saved[12].(bool), outer
+		transactionChanges = make(map[string][]string)
+		transactionFailed = false
+	}()
+
+	args := parseGlobalFlags(words)
+	if len(args) > 0 && args[0] == "shell" {
+		fmt.Println(tr("The shell is already running"))
+		return
+	}
+	runCommand(args)
+}
+
+// shellCompletions returns the words that can complete the last one in
+// line: command names first, then components, categories and groups.
+func shellCompletions(line string) []string {
+	var words []string
+	if len(strings.Fields(line)) == 0 || !strings.Contains(strings.TrimLeft(line, " "), " ") {
+		words = append(words, commands...)
+		words = append(words, "exit", "history", "refresh")
+		for name := range builtinAliases {
+			words = append(words, name)
+		}
+		for k := range config {
+			if strings.HasPrefix(k, "alias.") {
+				words = append(words, strings.TrimPrefix(k, "alias."))
+			}
+		}
+	} else {
+		word := line[strings.LastIndex(line, " ")+1:]
+		for _, c := range componentsWithPrefix(word) {
+			words = append(words, c.ID)
+		}
+		for _, cat := range categories {
+			words = append(words, cat.ID)
+		}
+		for k := range config {
+			if matchKey("group.*", k) {
+				words = append(words, "@"+strings.TrimPrefix(k, "group."))
+			}
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+// lineEditor reads lines with history and tab completion when standard
+// input is a terminal, and plain lines otherwise.
+type lineEditor struct {
+	in          *bufio.Reader
+	tty         bool
+	history     []string
+	historyPath string
+}
+
+const maxShellHistory = 500
+
+func newLineEditor(historyPath string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), tty: isTerminal(os.Stdin) && isTerminal(os.Stdout), historyPath: historyPath}
+	if data, err := ioutil.ReadFile(historyPath); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				e.history = append(e.history, line)
+			}
+		}
+	}
+	return e
+}
+
+func (e *lineEditor) saveHistory() {
+	if len(e.history) > maxShellHistory {
+		e.history = e.history[len(e.history)-maxShellHistory:]
+	}
+	if makeStateDir(filepath.Dir(e.historyPath)) != nil {
+		return
+	}
+	ioutil.WriteFile(e.historyPath, []byte(strings.Join(e.history, "\n")+"\n"), 0644)
+}
+
+// readLine shows prompt and reads a line, adding it to the history if
+// remember is set. It returns io.EOF at the end of input or on Ctrl-D.
+func (e *lineEditor) readLine(prompt string, remember bool) (string, error) {
+	if !e.tty {
+		fmt.Print(prompt)
+		line, err := e.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		e.remember(line, remember)
+		return line, nil
+	}
+
+	old, err := makeRaw(os.Stdin.Fd())
+	if err != nil {
+		e.tty = false
+		return e.readLine(prompt, remember)
+	}
+	defer restoreTerminal(os.Stdin.Fd(), old)
+
+	var buf []rune
+	pos := 0
+	hist := len(e.history)
+	redraw := func() {
+		fmt.Printf("\r%s%s\x1b[K", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Printf("\x1b[%dD", n)
+		}
+	}
+	setLine := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+	}
+	redraw()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			line := strings.TrimSpace(string(buf))
+			e.remember(line, remember)
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			setLine("")
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 21: // Ctrl-U
+			buf = buf[pos:]
+			pos = 0
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case '\t':
+			e.complete(&buf, &pos, prompt)
+		case 27: // Escape sequences for the arrow keys
+			if b, _ := e.in.ReadByte(); b != '[' {
+				continue
+			}
+			b, _ := e.in.ReadByte()
+			switch b {
+			case 'A':
+				if remember && hist > 0 {
+					hist--
+					setLine(e.history[hist])
+				}
+			case 'B':
+				if remember && hist < len(e.history) {
+					hist++
+					if hist == len(e.history) {
+						setLine("")
+					} else {
+						setLine(e.history[hist])
 					}
 				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(buf)
+			case '3':
+				if b, _ := e.in.ReadByte(); b == '~' && pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+func (e *lineEditor) remember(line string, ok bool) {
+	if ok && line != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+	}
+}
+
+// complete extends the word before the cursor to the longest prefix shared
+// by its completions, listing them if that does not extend it.
+func (e *lineEditor) complete(buf *[]rune, pos *int, prompt string) {
+	line := string((*buf)[:*pos])
+	start := strings.LastIndex(line, " ") + 1
+	word := line[start:]
+
+	var matches []string
+	for _, w := range shellCompletions(line) {
+		if strings.HasPrefix(w, word) {
+			matches = append(matches, w)
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	insert := common[len(word):]
+	if len(matches) == 1 {
+		insert += " "
+	}
+	if insert == "" {
+		fmt.Printf("\r\n%s\r\n", strings.Join(matches, "  "))
+		return
+	}
+	rest := append([]rune(insert), (*buf)[*pos:]...)
+	*buf = append((*buf)[:*pos], rest...)
+	*pos += len([]rune(insert))
+}
+
+// makeRaw switches the terminal to raw mode, returning the previous state
+// for restoreTerminal. Output processing stays on, so \n still works.
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	var old syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCGETS), uintptr(unsafe.Pointer(&old))); errno != 0 {
+		return nil, errno
+	}
+	raw := old
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(&raw))); errno != 0 {
+		return nil, errno
+	}
+	return &old, nil
+}
+
+func restoreTerminal(fd uintptr, state *syscall.Termios) {
+	syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TCSETS), uintptr(unsafe.Pointer(state)))
+}
+
+// --- Progress ---
+
+// progress renders the state of concurrently running jobs. On a terminal it
+// owns the last lines of the screen, redrawing one line per active job and an
+// aggregate bar below the regular output. Otherwise every state change is
+// printed as a line of its own, so parallel jobs cannot garble each other.
+// While jobs run, all output must go through log.
+//
+// With --status-fd, every change is also written to that file descriptor as
+// a line of colon-separated fields, for wrappers that show progress their
+// own way:
+//
+//	status:<component>:<state>
+//	done:<component>:<message>
+//	progress:<percent>:<finished>:<total>
+//	warning:<message>
+type progress struct {
+	mu         sync.Mutex
+	tty        bool
+	active     bool
+	jobs       []*job
+	pending    []string
+	drawn      int
+	lastDraw   time.Time
+	total      int
+	finished   int
+	totalBytes int64
+	doneBytes  int64
+	percent    int // Last percentage written to the status file
+}
+
+type job struct {
+	id     string
+	status string
+	bytes  int64
+	size   int64
+
+	// Extraction progress, shown instead of bytes once files is set
+	files, totalFiles int
+	extractStart      time.Time
+}
+
+var ui = &progress{tty: isTerminal(os.Stdout)}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// begin starts an aggregate bar covering the given number of jobs and bytes.
+func (p *progress) begin(jobs int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = true
+	p.total, p.finished = jobs, 0
+	p.totalBytes, p.doneBytes = bytes, 0
+	p.percent = -1
+	p.writeProgress()
+	p.redraw(true)
+}
+
+func (p *progress) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = false
+	p.redraw(true)
+}
+
+func (p *progress) start(id string, status string) *job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j := &job{id: id, status: status}
+	p.jobs = append(p.jobs, j)
+	writeStatus("status:%s:%s", id, status)
+	if !p.tty {
+		fmt.Printf("%s: %s\n", id, status)
+	}
+	p.redraw(true)
+	return j
+}
+
+func (p *progress) update(j *job, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j.status = status
+	writeStatus("status:%s:%s", j.id, status)
+	if !p.tty {
+		fmt.Printf("%s: %s\n", j.id, status)
+	}
+	p.redraw(true)
+}
+
+func (p *progress) setSize(j *job, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j.size = size
+}
+
+// setFiles starts counting extracted files for j. total is 0 if unknown.
+func (p *progress) setFiles(j *job, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j.files, j.totalFiles = 0, total
+	j.extractStart = time.Now()
+}
+
+func (p *progress) addFile(j *job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j.files++
+	p.redraw(false)
+}
+
+func (p *progress) add(j *job, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	j.bytes += n
+	p.doneBytes += n
+	p.writeProgress()
+	p.redraw(false)
+}
+
+// done removes j from the display, logging msg for it unless msg is empty.
+func (p *progress) done(j *job, msg string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, other := range p.jobs {
+		if other == j {
+			p.jobs = append(p.jobs[:i], p.jobs[i+1:]...)
+			break
+		}
+	}
+	p.finished++
+	writeStatus("done:%s:%s", j.id, msg)
+	p.writeProgress()
+	if msg != "" {
+		p.println(fmt.Sprintf("%s: %s", j.id, msg))
+	}
+	p.redraw(true)
+}
+
+// log prints a line above the progress display.
+func (p *progress) log(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.println(line)
+	p.redraw(true)
+}
+
+// warn shows a warning between the progress lines on a terminal, and on
+// stderr otherwise, like the warn function.
+func (p *progress) warn(line string) {
+	report.warn(line)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writeStatus("warning:%s", line)
+	if !p.tty {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	p.println(line)
+	p.redraw(true)
+}
+
+// writeProgress writes the overall percentage to the status file when it
+// changes, by bytes if the total is known and by jobs otherwise.
+func (p *progress) writeProgress() {
+	if statusFile == nil || !p.active || p.total == 0 {
+		return
+	}
+	percent := 100 * p.finished / p.total
+	if p.totalBytes > 0 {
+		percent = int(100 * p.doneBytes / p.totalBytes)
+		if percent > 100 {
+			percent = 100
+		}
+	}
+	if percent != p.percent {
+		p.percent = percent
+		writeStatus("progress:%d:%d:%d", percent, p.finished, p.total)
+	}
+}
+
+// writeStatus writes a line to the file given with --status-fd, if any.
+func writeStatus(format string, args ...interface{}) {
+	if statusFile != nil {
+		fmt.Fprintf(statusFile, format+"\n", args...)
+	}
+}
+
+func (p *progress) println(line string) {
+	if p.tty {
+		p.pending = append(p.pending, line)
+	} else {
+		fmt.Println(line)
+	}
+}
+
+// redraw replaces the lines drawn last time. Unforced redraws, i.e. byte
+// counts, are limited to ten per second.
+func (p *progress) redraw(force bool) {
+	if !p.tty || (!force && time.Since(p.lastDraw) < 100*time.Millisecond) {
+		return
+	}
+	p.lastDraw = time.Now()
+
+	var b strings.Builder
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA\x1b[J", p.drawn)
+	}
+	for _, line := range p.pending {
+		b.WriteString(line + "\n")
+	}
+	p.pending = nil
+
+	width := terminalWidth() - 1
+	p.drawn = 0
+	for _, j := range p.jobs {
+		line := fmt.Sprintf("  %-30s %s", j.id, j.status)
+		if j.files > 0 {
+			line += "  " + formatCount(j.files)
+			if j.totalFiles > 0 {
+				line += " / " + formatCount(j.totalFiles)
+			}
+			line += tr(" files")
+			elapsed := time.Since(j.extractStart)
+			if j.totalFiles > j.files && elapsed > 2*time.Second {
+				left := elapsed * time.Duration(j.totalFiles-j.files) / time.Duration(j.files)
+				line += fmt.Sprintf(tr(", about %s left"), left.Round(time.Second))
+			}
+		}
+		// Streamed archives download and extract at once
+		if j.bytes > 0 && (j.files == 0 || j.totalFiles == 0) {
+			line += "  " + formatBytes(j.bytes)
+			if j.size > 0 {
+				line += " / " + formatBytes(j.size)
+			}
+		}
+		b.WriteString(truncate(line, width) + "\n")
+		p.drawn++
+	}
+	if p.active && p.total > 0 {
+		const barWidth = 30
+		filled := barWidth * p.finished / p.total
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled)
+		line := fmt.Sprintf("[%s] %d/%d  %s", bar, p.finished, p.total, formatBytes(p.doneBytes))
+		if p.totalBytes > 0 {
+			line += " / " + formatBytes(p.totalBytes)
+		}
+		b.WriteString(truncate(line, width) + "\n")
+		p.drawn++
+	}
+	fmt.Print(b.String())
+}
+
+func truncate(s string, width int) string {
+	if width > 0 && len(s) > width {
+		return s[:width]
+	}
+	return s
+}
+
+func terminalWidth() int {
+	var ws struct{ Row, Col, X, Y uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Col == 0 {
+		return 80
+	}
+	return int(ws.Col)
+}
+
+// progressReader reports the bytes read through it to a job.
+type progressReader struct {
+	r io.Reader
+	j *job
+	n int64
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.n += int64(n)
+		ui.add(pr.j, int64(n))
+	}
+	return n, err
+}
+
+// --- Local Components ---
+
+// localSource is the source of components installed from an archive URL
+// given to download rather than from an index.
+const localSource = "local"
+
+// LocalComponent is the record kept of a component installed from a URL, in
+// place of its entry in an index.
+type LocalComponent struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Directory   string    `json:"path"`
+	InstallSize int64     `json:"install_size"`
+	Added       time.Time `json:"added"`
+}
+
+func localComponentsPath() string {
+	return filepath.Join(stateDir(), "local.json")
+}
+
+// loadLocalComponents adds the recorded local components to the component
+// list. Components of the same ID in a source take precedence.
+func loadLocalComponents() {
+	data, err := ioutil.ReadFile(localComponentsPath())
+	if err != nil {
+		return
+	}
+	var records []LocalComponent
+	if err := json.Unmarshal(data, &records); err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not read %s: %v"), localComponentsPath(), err))
+		return
+	}
+	var list []*Component
+	for _, r := range records {
+		if _, exists := compMap[r.ID]; exists {
+			continue
+		}
+		c := &Component{
+			ID:          r.ID,
+			Title:       r.ID,
+			Description: r.URL,
+			URL:         r.URL,
+			Directory:   r.Directory,
+			InstallSize: r.InstallSize,
+			LastUpdated: r.Added,
+			HashAlg:     defaultHashAlg,
+			Source:      localSource,
+			Kind:        "optional",
+		}
+		loadState(c)
+		list = append(list, c)
+	}
+	addLocalComponents(list)
+}
+
+// newLocalComponent returns a component for the archive at rawURL, to be
+// installed into dir under the given ID, or one taken from the file name.
+func newLocalComponent(rawURL, id, dir string) *Component {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		fatal(fmt.Sprintf(tr("Invalid URL %s"), rawURL))
+	}
+	if id == "" {
+		id = strings.ToLower(strings.TrimSuffix(path.Base(u.Path), ".zip"))
+	}
+	if id == "" || id == "." || id == "/" || strings.ContainsAny(id, "/\\ \t") || strings.HasPrefix(id, ".") {
+		fatal(fmt.Sprintf(tr("Invalid component ID %s; give one with --id"), id))
+	}
+	if dir == "" {
+		fatal(tr("A directory to install the archive into is required; give it with --dir"))
+	}
+	rel, ok := localPath(filepath.FromSlash(dir))
+	if !ok {
+		fatal(fmt.Sprintf(tr("%s is outside the base path"), dir))
+	}
+	if c, exists := compMap[id]; exists {
+		if c.Source != localSource {
+			fatal(fmt.Sprintf(tr("Component %s is provided by source %s; choose another ID with --id"), id, c.Source))
+		}
+		if c.Downloaded {
+			fatal(fmt.Sprintf(tr("Component %s is already installed from %s"), id, c.URL))
+		}
+	}
+
+	c := &Component{
+		ID:          id,
+		Title:       id,
+		Description: rawURL,
+		URL:         rawURL,
+		Directory:   filepath.ToSlash(rel),
+		LastUpdated: time.Now(),
+		HashAlg:     defaultHashAlg,
+		Source:      localSource,
+		Kind:        "optional",
+	}
+	// The size is only an estimate to confirm, read from the archive's end
+	if files, err := archiveEntries(c); err == nil {
+		for _, f := range files {
+			c.InstallSize += int64(f.UncompressedSize64)
+		}
+	}
+	return c
+}
+
+// addLocalComponents adds local components to the component list, replacing
+// those of the same ID.
+func addLocalComponents(list []*Component) {
+	for _, c := range list {
+		if old, exists := compMap[c.ID]; exists {
+			for i := range components {
+				if components[i] == old {
+					components[i] = c
+				}
+			}
+		} else {
+			components = append(components, c)
+		}
+		compMap[c.ID] = c
+		providers[c.ID] = []*Component{c}
+	}
+	forgetIDIndex()
+}
+
+// forgetLocalComponents drops the local components among list that are not
+// installed, after they were removed or failed to install, as they have no
+// source to be downloaded from again without their URL.
+func forgetLocalComponents(list []*Component) {
+	forgotten := false
+	for _, c := range list {
+		if c.Source != localSource || !installTime(c).IsZero() {
+			continue
+		}
+		delete(compMap, c.ID)
+		delete(providers, c.ID)
+		for i := range components {
+			if components[i] == c {
+				components = append(components[:i], components[i+1:]...)
+				break
+			}
+		}
+		forgotten = true
+	}
+	forgetIDIndex()
+	if forgotten {
+		saveLocalComponents()
+	}
+}
+
+// saveLocalComponents records the local components in the component list.
+func saveLocalComponents() {
+	var records []LocalComponent
+	for _, c := range components {
+		if c.Source == localSource {
+			records = append(records, LocalComponent{c.ID, c.URL, c.Directory, c.InstallSize, c.LastUpdated})
+		}
+	}
+	if len(records) == 0 {
+		os.Remove(localComponentsPath())
+		return
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(stateDir(), 0755)
+	if err := writeFileAtomic(localComponentsPath(), data, 0644); err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not save %s: %v"), localComponentsPath(), err))
+	}
+}
+
+// --- File Ownership ---
+
+var (
+	ownersMu     sync.Mutex
+	owners       map[string]string // Component ID by installed path, relative to the base path
+	ownersLoaded bool
+)
+
+func ownersPath() string {
+	return filepath.Join(stateDir(), "owners")
+}
+
+// loadOwners reads the "component path" lines of the ownership index, or
+// builds it from the info files if there is none yet or it is older than
+// they are. The caller must hold ownersMu.
+func loadOwners() {
+	if ownersLoaded {
+		return
+	}
+	ownersLoaded = true
+	owners = make(map[string]string)
+
+	// The index is saved when a transaction finishes, so a crash or error
+	// before then leaves it behind the info files. Writing or removing one
+	// renames within Components, which updates the directory's time.
+	current := false
+	if fi, err := os.Stat(ownersPath()); err == nil {
+		dir, err := storage.Stat("Components")
+		current = err != nil || fi.ModTime().After(dir.ModTime())
+	}
+	if data, err := ioutil.ReadFile(ownersPath()); current && err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) == 2 {
+				owners[parts[1]] = parts[0]
 			}
 		}
+		return
+	}
+
+	ids, _ := infoFileNames()
+	for _, id := range ids {
+		files, err := manifestFiles(&Component{ID: id})
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			owners[filepath.Clean(f)] = id
+		}
+	}
+}
+
+func saveOwners() {
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	if !ownersLoaded {
+		return
+	}
+
+	lines := make([]string, 0, len(owners))
+	for p, id := range owners {
+		lines = append(lines, id+" "+p)
+	}
+	sort.Strings(lines)
+	os.MkdirAll(stateDir(), 0755)
+	if err := writeFileAtomic(ownersPath(), []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		warn(tr("Warning: Could not write the file ownership index"))
+	}
+}
+
+// fileOwner returns the component that installed rel, or "".
+func fileOwner(rel string) string {
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	loadOwners()
+	return owners[filepath.Clean(rel)]
+}
+
+// setOwner records that id installed rel, returning the previous owner if
+// it was another component.
+func setOwner(rel, id string) string {
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	loadOwners()
+	rel = filepath.Clean(rel)
+	prev := owners[rel]
+	owners[rel] = id
+	if prev == id {
+		return ""
+	}
+	return prev
+}
+
+// disown forgets that id installed rel. It reports false if rel belongs to
+// another component, which must then keep the file.
+func disown(rel, id string) bool {
+	ownersMu.Lock()
+	defer ownersMu.Unlock()
+	loadOwners()
+	rel = filepath.Clean(rel)
+	if owner, ok := owners[rel]; ok && owner != id {
+		return false
+	}
+	delete(owners, rel)
+	return true
+}
+
+// handleOwner prints the component that installed each of the given files.
+func handleOwner(args []string) {
+	for _, arg := range args {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			fatal(err.Error())
+		}
+		rel, err := filepath.Rel(basePath, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			fmt.Printf(tr("%s is outside the base path\n"), arg)
+			continue
+		}
+		if owner := fileOwner(rel); owner != "" {
+			fmt.Printf("%s: %s\n", arg, owner)
+		} else {
+			fmt.Printf(tr("%s does not belong to any component\n"), arg)
+		}
+	}
+}
 
-		for _, arg := range args {
-			recurse(arg, false)
+// --- Deduplication ---
+
+// dedupEntry is a file known to have a given content hash. The size and
+// modification time detect files changed in place since they were indexed.
+type dedupEntry struct {
+	Path    string
+	Size    int64
+	ModTime int64
+}
+
+var (
+	dedupMu     sync.Mutex
+	dedupIndex  map[string]dedupEntry
+	dedupFiles  int
+	dedupSaved  int64
+	dedupLoaded bool
+)
+
+// dedupEnabled reports whether files are to be hardlinked, which is only
+// possible in a local tree.
+func dedupEnabled() bool {
+	return getSetting("dedup") == "on" && storage.Local() != ""
+}
+
+func dedupMinSize() int64 {
+	n, _ := parseSize(getSetting("dedup-min-size"))
+	return n
+}
+
+func dedupIndexPath() string {
+	return filepath.Join(stateDir(), "dedup")
+}
+
+// loadDedupIndex reads the "hash size mtime path" lines of the index.
+// The caller must hold dedupMu.
+func loadDedupIndex() {
+	if dedupLoaded {
+		return
+	}
+	dedupLoaded = true
+	dedupIndex = make(map[string]dedupEntry)
+
+	data, err := ioutil.ReadFile(dedupIndexPath())
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, " ", 4)
+		if len(parts) != 4 {
+			continue
 		}
+		size, _ := strconv.ParseInt(parts[1], 10, 64)
+		mtime, _ := strconv.ParseInt(parts[2], 10, 64)
+		dedupIndex[parts[0]] = dedupEntry{Path: parts[3], Size: size, ModTime: mtime}
+	}
+}
 
-	} else {
-		// Update all
-		for _, c := range components {
-			if c.Downloaded && c.Outdated {
-				toUpdate = append(toUpdate, c)
+func saveDedupIndex() {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if !dedupLoaded {
+		return
+	}
+
+	var lines []string
+	for sum, entry := range dedupIndex {
+		lines = append(lines, fmt.Sprintf("%s %d %d %s", sum, entry.Size, entry.ModTime, entry.Path))
+	}
+	sort.Strings(lines)
+	os.MkdirAll(stateDir(), 0755)
+	if err := writeFileAtomic(dedupIndexPath(), []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		warn(tr("Warning: Could not write deduplication index"))
+	}
+
+	if dedupFiles > 0 {
+		fmt.Printf(tr("Deduplicated %d files, saving %s\n"), dedupFiles, formatBytes(dedupSaved))
+	}
+}
+
+// dedupFile replaces the freshly extracted file at fpath with a hardlink to an
+// identical file elsewhere in the base path, or indexes it if there is none.
+// Removing a component later only unlinks its own names, so files shared with
+// other components survive.
+func dedupFile(fpath string, sum string, size int64, owner string) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	loadDedupIndex()
+
+	relPath, err := filepath.Rel(basePath, fpath)
+	if err != nil {
+		return
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return
+	}
+
+	if entry, ok := dedupIndex[sum]; ok && entry.Path != relPath {
+		existing := filepath.Join(basePath, entry.Path)
+		efi, err := os.Stat(existing)
+		if err == nil && efi.Size() == entry.Size && efi.ModTime().Unix() == entry.ModTime {
+			if os.SameFile(fi, efi) {
+				return
 			}
-			if strings.HasPrefix(c.ID, "core-") && !c.Downloaded {
-				toDownload = append(toDownload, c)
+			tmp := fpath + ".fpm-link"
+			os.Remove(tmp)
+			if os.Link(existing, tmp) == nil {
+				if os.Rename(tmp, fpath) == nil {
+					audit("overwrite", relPath, owner, "dedup")
+					dedupFiles++
+					dedupSaved += size
+					return
+				}
+				os.Remove(tmp)
 			}
 		}
 	}
 
-	toUpdate = unique(toUpdate)
-	toDownload = unique(toDownload)
+	dedupIndex[sum] = dedupEntry{Path: relPath, Size: size, ModTime: fi.ModTime().Unix()}
+}
+
+// --- Plans ---
+
+// Plan is a confirmed operation, saved before it is executed so that an
+// interrupted run (power loss, OOM) can be continued by `fpm resume` without
+// resolving and confirming everything again.
+type Plan struct {
+	Command string      `json:"command"`
+	Created time.Time   `json:"created"`
+	Steps   []*PlanStep `json:"steps"`
+
+	mu sync.Mutex
+}
+
+// PlanStep is a single remove, update or download of a component.
+type PlanStep struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Done   bool   `json:"done"`
+}
 
-	if len(toUpdate) == 0 && len(toDownload) == 0 {
-		fmt.Println("No components to update")
+func newPlan(command string, removes, updates, downloads []*Component) *Plan {
+	plan := &Plan{Command: command, Created: time.Now()}
+	add := func(list []*Component, action string) {
+		for _, c := range list {
+			plan.Steps = append(plan.Steps, &PlanStep{ID: c.ID, Action: action})
+		}
+	}
+	add(removes, "remove")
+	add(updates, "update")
+	add(downloads, "download")
+	return plan
+}
+
+func planPath() string {
+	return filepath.Join(stateDir(), "plan")
+}
+
+func loadPlan() (*Plan, error) {
+	data, err := ioutil.ReadFile(planPath())
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// save writes the plan atomically, so a crash never leaves a truncated plan.
+func (plan *Plan) save() {
+	plan.mu.Lock()
+	defer plan.mu.Unlock()
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
 		return
 	}
+	os.MkdirAll(stateDir(), 0755)
+	writeFileAtomic(planPath(), data, 0644)
+}
 
-	var dlSize, changeSize int64
+func (plan *Plan) complete(st *PlanStep) {
+	plan.mu.Lock()
+	st.Done = true
+	plan.mu.Unlock()
+	plan.save()
+}
 
-	if len(toUpdate) > 0 {
-		fmt.Println(len(toUpdate), "component(s) will be updated:")
-		for _, c := range toUpdate {
-			fmt.Printf("  %s\n", c.ID)
-			dlSize += c.DownloadSize
-			changeSize += (c.InstallSize - c.OldSize)
+// succeeded returns how many of list have had their step done.
+func (plan *Plan) succeeded(list []*Component) int {
+	ids := make(map[string]bool, len(list))
+	for _, c := range list {
+		ids[c.ID] = true
+	}
+	n := 0
+	for _, st := range plan.Steps {
+		if st.Done && ids[st.ID] {
+			n++
 		}
-		fmt.Println()
 	}
+	return n
+}
 
-	if len(toDownload) > 0 {
-		fmt.Println(len(toDownload), "component(s) will be downloaded:")
-		for _, c := range toDownload {
-			fmt.Printf("  %s\n", c.ID)
+// executePlan runs the steps of plan that are not done yet: removals first,
+// then updates and downloads in parallel, and returns how many failed. The
+// plan stays on disk until every step has succeeded, so failed steps can be
+// retried with `fpm resume`.
+func executePlan(plan *Plan) int {
+	if old, err := loadPlan(); err == nil && !old.Created.Equal(plan.Created) {
+		warn(fmt.Sprintf(tr("Warning: Discarding an interrupted %s operation from %s"),
+			old.Command, formatTime(old.Created)))
+	}
+	plan.save()
+
+	steps := make(map[*Component]*PlanStep)
+	var removes, updates, downloads []*Component
+	var dlSize int64
+	for _, st := range plan.Steps {
+		if st.Done {
+			continue
+		}
+		c, exists := compMap[st.ID]
+		if !exists {
+			warn(fmt.Sprintf(tr("Component %s no longer exists and will be skipped"), st.ID))
+			continue
+		}
+		steps[c] = st
+		switch st.Action {
+		case "remove":
+			removes = append(removes, c)
+		case "update":
+			updates = append(updates, c)
+			dlSize += c.DownloadSize
+		case "download":
+			downloads = append(downloads, c)
 			dlSize += c.DownloadSize
-			changeSize += c.InstallSize
 		}
-		fmt.Println()
 	}
 
-	fmt.Printf("Estimated download size: %s\n", formatBytes(dlSize))
-	fmt.Printf("Estimated changed size:  %s\n\n", formatBytes(changeSize))
+	if len(updates)+len(downloads) > 0 {
+		waitForWindow()
+	}
 
-	if !confirm("Is this OK?") {
-		return
+	var preRemove []scriptRun
+	for _, c := range removes {
+		preRemove = append(preRemove, scriptRun{c, "remove"})
 	}
+	runScripts("pre-remove", preRemove)
+
+	var mu sync.Mutex
+	failed := 0
+	var installed []scriptRun
+	run := func(c *Component, action string, failure string) {
+		e := report.begin(c, action)
+		if action == "remove" && plan.Command != "remove" && plan.Command != "snapshot" {
+			e.reason = "conflict"
+		}
+		var err error
+		switch action {
+		case "remove":
+			removeComponent(c, e)
+			c.Downloaded = false
+		case "update":
+			// The installed version stays until the new one is ready
+			err = downloadComponent(c, e, func() {
+				removeComponent(c, e)
+				c.Downloaded = false
+			})
+		default:
+			err = downloadComponent(c, e, nil)
+		}
+		e.finish(err)
 
-	for _, c := range toUpdate {
-		removeComponent(c)
-		if err := downloadComponent(c); err != nil {
-			fmt.Printf("Failed to update %s: %v\n", c.ID, err)
+		mu.Lock()
+		if err != nil {
+			ui.log(fmt.Sprintf(failure, c.ID, err))
+			failed++
+			transactionFailed = true
+			mu.Unlock()
+			return
 		}
+		transactionChanges[action] = append(transactionChanges[action], c.ID)
+		if action != "remove" {
+			installed = append(installed, scriptRun{c, action})
+		}
+		mu.Unlock()
+		plan.complete(steps[c])
 	}
-	for _, c := range toDownload {
-		if err := downloadComponent(c); err != nil {
-			fmt.Printf("Failed to download %s: %v\n", c.ID, err)
+
+	ui.begin(len(removes)+len(updates)+len(downloads), dlSize)
+	for _, c := range removes {
+		run(c, "remove", "")
+	}
+	forEachParallel(updates, func(c *Component) {
+		run(c, "update", tr("Failed to update %s: %v"))
+	})
+	forEachParallel(downloads, func(c *Component) {
+		run(c, "download", tr("Failed to download %s: %v"))
+	})
+	ui.end()
+	finishTransaction()
+	runScripts("post-install", installed)
+
+	if failed > 0 {
+		fmt.Printf(tr("%d step(s) failed; run fpm resume to retry them\n"), failed)
+	} else {
+		os.Remove(planPath())
+	}
+	return failed
+}
+
+// untilWindow returns how long after now the download-window opens, or 0 if
+// it is open or not set.
+func untilWindow(now time.Time) time.Duration {
+	window := getSetting("download-window")
+	if window == "" {
+		return 0
+	}
+	var bounds []time.Duration
+	for _, part := range strings.Split(window, "-") {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return 0
 		}
+		bounds = append(bounds, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
 	}
+	start, end := bounds[0], bounds[1]
 
-	msg := fmt.Sprintf("\nSuccessfully updated %d components", len(toUpdate))
-	if len(toDownload) > 0 {
-		msg += fmt.Sprintf(" and downloaded %d components", len(toDownload))
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	day := now.Sub(midnight)
+	if start < end && day >= start && day < end || start > end && (day >= start || day < end) {
+		return 0
 	}
-	fmt.Println(msg)
+	wait := start - day
+	if wait < 0 {
+		wait += 24 * time.Hour
+	}
+	return wait
 }
 
-// --- Helpers ---
+// waitForWindow holds back an unattended transaction that downloads until
+// the download-window opens, keeping the lock so it runs before anything
+// queued after it. Someone at the terminal is only told, since they just
+// confirmed the transaction.
+func waitForWindow() {
+	wait := untilWindow(time.Now())
+	if wait == 0 {
+		return
+	}
+	if !assumeYes && isTerminal(os.Stdin) {
+		warn(fmt.Sprintf(tr("Note: Downloading outside the download window %s"), getSetting("download-window")))
+		return
+	}
+	fmt.Printf(tr("Waiting for the download window %s, which opens at %s\n"), getSetting("download-window"), formatTime(time.Now().Add(wait)))
+	time.Sleep(wait)
+}
 
-func initConfig() {
-	// Set defaults
-	ex, _ := os.Executable()
-	basePath = filepath.Clean(filepath.Join(filepath.Dir(ex), ".."))
-	sourceURL = defaultSource
+// --- Post-Transaction Command ---
 
-	data, err := ioutil.ReadFile(configFile)
+var (
+	transactionChanges = make(map[string][]string) // Component IDs by action
+	transactionFailed  bool
+)
+
+// runPostTransaction runs the post-transaction setting once a transaction
+// changed something and nothing failed. It runs after the lock is released,
+// so the command may call fpm itself. The environment tells it what changed:
+// FPM_COMMAND, FPM_BASE_PATH and space-separated component IDs in
+// FPM_DOWNLOADED, FPM_UPDATED, FPM_REMOVED and FPM_ROLLED_BACK.
+func runPostTransaction(command string) {
+	hook := getSetting("post-transaction")
+	if hook == "" || transactionFailed || len(transactionChanges) == 0 || getSetting("hooks") == "off" {
+		return
+	}
+
+	err := runHook("post-transaction", []string{"sh", "-c", hook},
+		"FPM_COMMAND="+command,
+		"FPM_DOWNLOADED="+strings.Join(transactionChanges["download"], " "),
+		"FPM_UPDATED="+strings.Join(transactionChanges["update"], " "),
+		"FPM_REMOVED="+strings.Join(transactionChanges["remove"], " "),
+		"FPM_ROLLED_BACK="+strings.Join(transactionChanges["rollback"], " "),
+	)
+	if err != nil {
+		warn(fmt.Sprintf(tr("Warning: The post-transaction command failed: %v"), err))
+	}
+}
+
+// hookEnv lists the variables passed on to hooks from fpm's environment.
+// Anything else, such as credentials, is withheld.
+var hookEnv = []string{"PATH", "HOME", "USER", "LANG", "LC_ALL", "LC_MESSAGES", "TERM", "TMPDIR"}
+
+const maxHookOutput = 64 << 10
+
+// runHook runs a maintainer script or the post-transaction command in the
+// base path, with a reduced environment plus FPM_BASE_PATH and env, no
+// standard input and the hook-timeout setting as time limit. Its output is
+// shown and kept in the report.
+func runHook(name string, args []string, env ...string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = basePath
+	for _, key := range hookEnv {
+		if v, ok := os.LookupEnv(key); ok {
+			cmd.Env = append(cmd.Env, key+"="+v)
+		}
+	}
+	cmd.Env = append(cmd.Env, "FPM_BASE_PATH="+basePath)
+	cmd.Env = append(cmd.Env, env...)
+
+	var output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	// A process group of its own lets a timeout kill whatever it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	run := &HookRun{Name: name, Command: strings.Join(args, " ")}
+	started := time.Now()
+	err := cmd.Start()
 	if err == nil {
-		lines := strings.Split(string(data), "\n")
-		if len(lines) > 0 && strings.TrimSpace(lines[0]) != "" {
-			basePath = strings.TrimSpace(lines[0])
+		timeout := time.Duration(getIntSetting("hook-timeout")) * time.Second
+		timer := time.AfterFunc(timeout, func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		err = cmd.Wait()
+		if !timer.Stop() {
+			err = fmt.Errorf(tr("killed after %s"), timeout)
 		}
-		if len(lines) > 1 && strings.TrimSpace(lines[1]) != "" {
-			sourceURL = strings.TrimSpace(lines[1])
+	}
+
+	run.DurationSeconds = time.Since(started).Seconds()
+	run.Output = output.String()
+	if len(run.Output) > maxHookOutput {
+		run.Output = run.Output[len(run.Output)-maxHookOutput:]
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	report.hook(run)
+	return err
+}
+
+// --- Maintainer Scripts ---
+
+// scriptDir holds the maintainer scripts in a component archive. They are
+// kept in <path>/.fpm/scripts/<id> rather than installed, so that pre-remove
+// is still available when the component is removed.
+const scriptDir = "fpm-hooks/"
+
+// scriptRun is a component whose script is due, with the FPM_ACTION passed
+// to the script: download, update, rollback or remove.
+type scriptRun struct {
+	c      *Component
+	action string
+}
+
+func scriptsPath(c *Component) string {
+	return filepath.Join(stateDir(), "scripts", c.ID)
+}
+
+// saveScripts replaces the kept maintainer scripts of c with those in its
+// archive.
+func saveScripts(c *Component, files map[string][]byte) error {
+	dir := scriptsPath(c)
+	os.RemoveAll(dir)
+	for name, data := range files {
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, scriptDir)))
+		if !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return fmt.Errorf(tr("illegal file path: %s"), name)
+		}
+		os.MkdirAll(filepath.Dir(target), 0755)
+		if err := ioutil.WriteFile(target, data, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScripts runs the given script (post-install or pre-remove) of each
+// component that has one. They only run with maintainer-scripts = on and
+// once the user agreed to the list shown; --yes agrees.
+func runScripts(script string, runs []scriptRun) {
+	var due []scriptRun
+	for _, r := range runs {
+		if _, err := os.Stat(filepath.Join(scriptsPath(r.c), script)); err == nil {
+			due = append(due, r)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	var ids []string
+	for _, r := range due {
+		ids = append(ids, r.c.ID)
+	}
+	if getSetting("hooks") == "off" {
+		warn(fmt.Sprintf(tr("Skipping the %s scripts of %s, as hooks are off"), script, strings.Join(ids, ", ")))
+		return
+	}
+	if getSetting("maintainer-scripts") != "on" {
+		warn(fmt.Sprintf(tr("Skipping the %s scripts of %s; set maintainer-scripts = on to be offered to run them"), script, strings.Join(ids, ", ")))
+		return
+	}
+	fmt.Printf(tr("\nThe following components include a %s script:\n"), script)
+	for _, r := range due {
+		fmt.Printf("  %s (%s)\n", r.c.ID, filepath.Join(scriptsPath(r.c), script))
+	}
+	if !confirm(tr("Run these scripts?")) {
+		return
+	}
+
+	for _, r := range due {
+		err := runHook(r.c.ID+" "+script, []string{filepath.Join(scriptsPath(r.c), script)},
+			"FPM_COMPONENT="+r.c.ID,
+			"FPM_COMPONENT_DIR="+filepath.Join(basePath, filepath.FromSlash(r.c.Directory)),
+			"FPM_ACTION="+r.action,
+		)
+		if err != nil {
+			warn(fmt.Sprintf(tr("Warning: The %s script of %s failed: %v"), script, r.c.ID, err))
+		}
+	}
+}
+
+// --- Reports ---
+
+// Report is the JSON document written by --report after download, update and
+// remove, for audit trails in managed deployments. A command that fails still
+// writes it, with the error it ended with.
+type Report struct {
+	Path       string         `json:"-"`
+	Command    string         `json:"command"`
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	ExitCode   int            `json:"exit_code"`
+	Error      string         `json:"error,omitempty"`
+	Components []*ReportEntry `json:"components"`
+	Warnings   []string       `json:"warnings,omitempty"`
+	Hooks      []*HookRun     `json:"hooks,omitempty"`
+
+	mu sync.Mutex
+}
+
+// HookRun records a maintainer script or post-transaction command run.
+type HookRun struct {
+	Name            string  `json:"name"`
+	Command         string  `json:"command"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Output          string  `json:"output"`
+	Error           string  `json:"error,omitempty"`
+}
+
+func (r *Report) hook(run *HookRun) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Hooks = append(r.Hooks, run)
+	r.mu.Unlock()
+}
+
+// warn records a warning. Like begin, it may be called on a nil Report.
+func (r *Report) warn(msg string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Warnings = append(r.Warnings, msg)
+	r.mu.Unlock()
+}
+
+// fail records the error that ends the command. Like begin, it may be called
+// on a nil Report.
+func (r *Report) fail(msg string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if r.Error == "" {
+		r.Error = msg
+	}
+	r.mu.Unlock()
+}
+
+// ReportEntry records what happened to a single component.
+type ReportEntry struct {
+	ID              string   `json:"id"`
+	Action          string   `json:"action"`
+	BytesDownloaded int64    `json:"bytes_downloaded"`
+	FilesWritten    []string `json:"files_written,omitempty"`
+	FilesRemoved    []string `json:"files_removed,omitempty"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	Error           string   `json:"error,omitempty"`
+
+	started time.Time
+	reason  string
+}
+
+// begin starts recording an action on c. It may be called on a nil Report,
+// in which case the entry is simply not kept.
+func (r *Report) begin(c *Component, action string) *ReportEntry {
+	e := &ReportEntry{ID: c.ID, Action: action, started: time.Now(), reason: action}
+	if r != nil {
+		r.mu.Lock()
+		r.Components = append(r.Components, e)
+		r.mu.Unlock()
+	}
+	return e
+}
+
+func (e *ReportEntry) finish(err error) {
+	e.DurationSeconds = time.Since(e.started).Seconds()
+	if err != nil {
+		e.Error = err.Error()
+	}
+}
+
+func (r *Report) write() error {
+	r.Finished = time.Now()
+	if r.Components == nil {
+		r.Components = []*ReportEntry{}
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// A pipe or device, such as /dev/stdout, cannot be replaced
+	if fi, err := os.Stat(r.Path); err == nil && !fi.Mode().IsRegular() {
+		return ioutil.WriteFile(r.Path, data, 0644)
+	}
+	return writeFileAtomic(r.Path, data, 0644)
+}
+
+// writeReport writes the report asked for with --report, once the command
+// has finished or is about to exit. It is written only once.
+func writeReport() {
+	r := report
+	if r == nil {
+		return
+	}
+	report = nil
+	if err := r.write(); err != nil {
+		warn(fmt.Sprintf(tr("Warning: Could not write report: %v"), err))
+	}
+}
+
+// --- Audit Log ---
+
+// AuditEntry is a line of the audit log. Unlike reports, the log is always
+// kept and only ever appended to, so admins of shared machines can tell what
+// fpm changed on disk and when.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Path      string    `json:"path"`
+	Component string    `json:"component"`
+	Reason    string    `json:"reason"`
+	PID       int       `json:"pid"`
+}
+
+var (
+	auditMu     sync.Mutex
+	auditFailed bool
+)
+
+func auditPath() string {
+	if p := getSetting("audit-log"); p != "" {
+		return p
+	}
+	return filepath.Join(stateDir(), "audit.log")
+}
+
+// audit records that the file at path, relative to the base path, owned by
+// component is about to be deleted or overwritten for the given reason.
+func audit(action, path, component, reason string) {
+	line, _ := json.Marshal(AuditEntry{
+		Time:      time.Now(),
+		Action:    action,
+		Path:      filepath.ToSlash(path),
+		Component: component,
+		Reason:    reason,
+		PID:       os.Getpid(),
+	})
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	os.MkdirAll(filepath.Dir(auditPath()), 0755)
+	f, err := os.OpenFile(auditPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
 		}
-	} else {
-		writeConfig()
+	}
+	if err != nil && !auditFailed {
+		auditFailed = true
+		ui.warn(fmt.Sprintf(tr("Warning: Could not write to the audit log: %v"), err))
 	}
 }
 
-func writeConfig() {
-	content := fmt.Sprintf("%s\n%s", basePath, sourceURL)
-	if err := ioutil.WriteFile(configFile, []byte(content), 0644); err != nil {
-		fmt.Println("Warning: Could not write to fpm.cfg")
-	}
+// --- State & Locking ---
+
+// baseMissing reports whether the base path does not exist, as when the
+// drive it is on is not mounted.
+func baseMissing() bool {
+	_, err := os.Stat(basePath)
+	return os.IsNotExist(err)
 }
 
-func getComponents() error {
-	resp, err := client.Get(sourceURL)
+// writeFileAtomic replaces the file at path with data. The data is written to
+// a hidden file beside it and flushed to disk before it is renamed over path,
+// so a crash cannot leave a truncated file, such as an info file missing
+// the files to remove. Hidden files in the Components directory are not
+// taken for components. A symbolic link at path, e.g. to an fpm.cfg kept
+// elsewhere, is followed rather than replaced.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("status code %d", resp.StatusCode)
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
 	}
-
-	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		os.Remove(tmp)
 	}
+	return err
+}
 
-	var root xmlNode
-	if err := xml.Unmarshal(data, &root); err != nil {
-		return err
+// makeStateDir creates dir inside the state directory for commands that
+// only read the installation. It fails rather than create a missing base
+// path, which would leave the mount point of an unmounted drive looking
+// like an installation.
+func makeStateDir(dir string) error {
+	if !systemMode() && baseMissing() {
+		return fmt.Errorf(tr("the base path %s does not exist"), basePath)
 	}
+	return os.MkdirAll(dir, 0755)
+}
 
-	// Extract Repo URL from root list attribute
-	repoURL := ""
-	for _, attr := range root.Attrs {
-		if attr.Name.Local == "url" {
-			repoURL = attr.Value
-			if !strings.HasSuffix(repoURL, "/") {
-				repoURL += "/"
-			}
-			break
-		}
+// stateDir holds fpm's own bookkeeping inside the base path, next to the
+// Components directory shared with the Windows version. In system mode it is
+// kept in /var/lib/fpm, as /opt should not change at runtime.
+func stateDir() string {
+	if systemMode() {
+		return systemStateDir
 	}
-
-	components = []*Component{}
-	compMap = make(map[string]*Component)
-	parseNodes(root.Nodes, "", repoURL)
-	return nil
+	return filepath.Join(basePath, ".fpm")
 }
 
-// parseNodes now recursively handles 'category' tags to correctly build the ID path
-func parseNodes(nodes []xmlNode, parentID string, repoURL string) {
-	for _, node := range nodes {
-		name := node.XMLName.Local
-		
-		// Ensure we process categories, components, and nested lists
-		if name == "component" || name == "category" || name == "list" {
-			id := getAttr(node, "id")
-			fullID := id
-
-			// Append parentID if exists (e.g. core-server-gamezip)
-			if parentID != "" && id != "" {
-				fullID = parentID + "-" + id
-			} else if parentID != "" {
-				fullID = parentID
-			}
+func lockPath() string {
+	return filepath.Join(stateDir(), "lock")
+}
 
-			if name == "component" {
-				c := &Component{
-					ID:           fullID,
-					Title:        getAttr(node, "title"),
-					Description:  getAttr(node, "description"),
-					Directory:    getAttr(node, "path"),
-					Hash:         getAttr(node, "hash"),
-					URL:          repoURL + fullID + ".zip",
-				}
-
-				if val, err := strconv.ParseInt(getAttr(node, "date-modified"), 10, 64); err == nil {
-					c.LastUpdated = time.Unix(val, 0).Format("2006-01-02 15:04:05")
-				}
-				if val, err := strconv.ParseInt(getAttr(node, "download-size"), 10, 64); err == nil {
-					c.DownloadSize = val
-				}
-				if val, err := strconv.ParseInt(getAttr(node, "install-size"), 10, 64); err == nil {
-					c.InstallSize = val
-				}
-				depStr := getAttr(node, "depends")
-				if depStr != "" {
-					c.Depends = strings.Split(depStr, " ")
-				}
-
-				// Check local state
-				infoPath := filepath.Join(basePath, "Components", c.ID)
-				if _, err := os.Stat(infoPath); err == nil {
-					c.Downloaded = true
-
-					// Read header
-					f, err := os.Open(infoPath)
-					if err == nil {
-						scanner := bufio.NewScanner(f)
-						if scanner.Scan() {
-							headerParts := strings.Split(scanner.Text(), " ")
-							if len(headerParts) >= 2 {
-								if headerParts[0] != c.Hash {
-									c.Outdated = true
-									c.OldSize, _ = strconv.ParseInt(headerParts[1], 10, 64)
-								}
-							}
-						}
-						f.Close()
-					}
-				}
+// beginTransaction prepares a command that modifies the installation. It
+// fails before anything is touched if the base path is not writable, e.g. on
+// shared machines where read-only commands should still work.
+func beginTransaction() {
+	checkBasePath()
 
-				components = append(components, c)
-				compMap[c.ID] = c
+	// Installing into the directory an unmounted drive is usually mounted on
+	// would fill the wrong disk and hide the real installation
+	if baseMissing() && !(systemMode() && basePath == systemBasePath) {
+		fatal(fmt.Sprintf(tr("The base path %s does not exist. If it is on a drive that is not mounted, mount it and try again; "+
+			"for a new installation, create it first (mkdir -p %s) or choose another with fpm config set path <dir>"), basePath, basePath))
+	}
+	dirs := []string{basePath, filepath.Join(basePath, "Components")}
+	if systemMode() {
+		dirs = append(dirs, stateDir())
+	}
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			if systemMode() && os.IsNotExist(err) && os.MkdirAll(dir, 0755) != nil {
+				fatal(fmt.Sprintf(tr("Could not create %s. Changing the system installation requires root; "+
+					"only read-only commands such as list, info and status are available"), dir))
 			}
-
-			// Recurse for nested lists or categories
-			parseNodes(node.Nodes, fullID, repoURL)
+			continue
+		}
+		f, err := ioutil.TempFile(dir, ".fpm-write-test-*")
+		if err != nil && systemMode() {
+			fatal(fmt.Sprintf(tr("%s is not writable. Changing the system installation requires root (or write access to %s); "+
+				"only read-only commands such as list, info and status are available"), dir, dir))
+		}
+		if err != nil {
+			fatal(fmt.Sprintf(tr("%s is not writable. Only read-only commands such as list, info and status are available; "+
+				"run fpm as a user with write access or choose another base path"), dir))
 		}
+		f.Close()
+		os.Remove(f.Name())
 	}
-}
+	acquireLock()
 
-func getAttr(node xmlNode, name string) string {
-	for _, attr := range node.Attrs {
-		if attr.Name.Local == name {
-			return attr.Value
+	// Anything left in the staging directory belongs to a run that died; with
+	// the lock held it is safe to clean up.
+	if entries, err := ioutil.ReadDir(stagingDir()); err == nil {
+		for _, fi := range entries {
+			os.RemoveAll(filepath.Join(stagingDir(), fi.Name()))
 		}
 	}
-	return ""
 }
 
-func resolveQueue(args []string, criteria func(*Component) bool) []*Component {
-	var queue []*Component
-	visited := make(map[string]bool)
-
-	var add func(string)
-	add = func(id string) {
-		matches := findComponents(id)
-		if len(matches) == 0 {
-			fmt.Printf("Component or category %s does not exist\n", id)
+// acquireLock makes sure only one fpm process modifies the installation at a
+// time. The lock file holds the owner's PID, so a lock left behind by a
+// process that died is taken over.
+func acquireLock() {
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return
+	}
+	for {
+		f, err := os.OpenFile(lockPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d", os.Getpid())
+			f.Close()
 			return
 		}
-
-		for _, c := range matches {
-			if visited[c.ID] {
-				continue
-			}
-			visited[c.ID] = true
-
-			if criteria(c) {
-				queue = append(queue, c)
-				for _, dep := range c.Depends {
-					add(dep)
-				}
-			}
+		if !os.IsExist(err) {
+			return
 		}
-	}
-
-	if len(args) == 0 {
-		// All components
-		for _, c := range components {
-			add(c.ID)
+		if pid := lockHolder(); pid != 0 {
+			fatal(fmt.Sprintf(tr("Another fpm process (PID %d) is modifying the installation"), pid))
 		}
-	} else {
-		for _, arg := range args {
-			add(arg)
+		if err := os.Remove(lockPath()); err != nil && !os.IsNotExist(err) {
+			return
 		}
 	}
-
-	return unique(queue)
 }
 
-func findComponents(id string) []*Component {
-	var matches []*Component
-	for _, c := range components {
-		if c.ID == id || strings.HasPrefix(c.ID, id+"-") {
-			matches = append(matches, c)
-		}
+func releaseLock() {
+	if lockHolder() == os.Getpid() {
+		os.Remove(lockPath())
 	}
-	return matches
 }
 
-func unique(slice []*Component) []*Component {
-	keys := make(map[string]bool)
-	list := []*Component{}
-	for _, entry := range slice {
-		if _, value := keys[entry.ID]; !value {
-			keys[entry.ID] = true
-			list = append(list, entry)
-		}
+// lockHolder returns the PID of the live process holding the lock, or 0.
+func lockHolder() int {
+	data, err := ioutil.ReadFile(lockPath())
+	if err != nil {
+		return 0
 	}
-	return list
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if p, err := os.FindProcess(pid); err != nil || p.Signal(syscall.Signal(0)) != nil {
+		return 0
+	}
+	return pid
 }
 
-func downloadComponent(c *Component) error {
-	if c.InstallSize == 0 {
-		return nil
-	}
+// --- Localization ---
 
-	fmt.Printf("Downloading %s... ", c.ID)
+// catalog maps English messages to their translation in the active language.
+var catalog map[string]string
 
-	resp, err := client.Get(c.URL)
-	if err != nil {
-		return err
+// tr returns the translation of msg, or msg itself if there is none. Messages
+// are keyed by their English text, gettext style, so format verbs must be kept
+// (or reordered with explicit indexes such as %[2]s) by translators.
+func tr(msg string) string {
+	if t := catalog[msg]; t != "" {
+		return t
 	}
-	defer resp.Body.Close()
+	return msg
+}
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("http status %d", resp.StatusCode)
+// initLocale loads the catalog for the configured language, falling back to
+// the POSIX locale environment. Catalogs are gettext .po files named after the
+// language (de.po, pt_BR.po) in any of the locale directories.
+func initLocale() {
+	lang := getSetting("language")
+	if lang == "auto" {
+		for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+			if lang = os.Getenv(env); lang != "" {
+				break
+			}
+		}
 	}
 
-	// Create temp file for zip
-	tmpFile, err := ioutil.TempFile("", "fpm-*.zip")
-	if err != nil {
-		return err
+	// de_DE.UTF-8@euro -> de_DE, de
+	if i := strings.IndexAny(lang, ".@"); i >= 0 {
+		lang = lang[:i]
+	}
+	if lang == "" || lang == "C" || lang == "POSIX" || lang == "auto" {
+		return
+	}
+	names := []string{lang}
+	if i := strings.IndexByte(lang, '_'); i > 0 {
+		names = append(names, lang[:i])
 	}
-	defer os.Remove(tmpFile.Name())
 
-	_, err = io.Copy(tmpFile, resp.Body)
-	if err != nil {
-		return err
+	for _, name := range names {
+		for _, dir := range localeDirs() {
+			if cat, err := loadCatalog(filepath.Join(dir, name+".po")); err == nil {
+				catalog = cat
+				return
+			}
+		}
 	}
-	tmpFile.Close()
+}
 
-	fmt.Print("Extracting... ")
+func localeDirs() []string {
+	var dirs []string
+	if dir := os.Getenv("FPM_LOCALE_DIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, "fpm", "locales"))
+	}
+	if ex, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Join(filepath.Dir(ex), "locales"))
+	}
+	return dirs
+}
 
-	// Extract
-	r, err := zip.OpenReader(tmpFile.Name())
+// loadCatalog parses the msgid/msgstr pairs of a .po file. Plural forms and
+// contexts are not used by fpm and are ignored.
+func loadCatalog(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer r.Close()
-
-	installedFiles := []string{}
-	// Header: HASH SIZE DEP1 DEP2...
-	header := fmt.Sprintf("%s %d %s", c.Hash, c.InstallSize, strings.Join(c.Depends, " "))
-	installedFiles = append(installedFiles, header)
 
-	destDir := filepath.Join(basePath, filepath.FromSlash(c.Directory))
-	os.MkdirAll(destDir, 0755)
+	cat := make(map[string]string)
+	var id, str *string
+	var msgid, msgstr string
+	flush := func() {
+		if msgid != "" && msgstr != "" {
+			cat[msgid] = msgstr
+		}
+		msgid, msgstr = "", ""
+		id, str = nil, nil
+	}
 
-	for _, f := range r.File {
-		if f.FileInfo().IsDir() {
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		var target **string
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "msgid "):
+			flush()
+			id = &msgid
+			line = strings.TrimPrefix(line, "msgid ")
+			target = &id
+		case strings.HasPrefix(line, "msgstr "):
+			str = &msgstr
+			line = strings.TrimPrefix(line, "msgstr ")
+			target = &str
+		case strings.HasPrefix(line, "\""):
+			// Continuation of the previous string
+			if str != nil {
+				target = &str
+			} else {
+				target = &id
+			}
+		default:
 			continue
 		}
 
-		fpath := filepath.Join(destDir, filepath.FromSlash(f.Name))
-
-		// Zip Slip check
-		if !strings.HasPrefix(fpath, filepath.Clean(destDir)+string(os.PathSeparator)) {
-			return fmt.Errorf("illegal file path: %s", fpath)
+		text, err := strconv.Unquote(strings.TrimSpace(line))
+		if err != nil || *target == nil {
+			return nil, fmt.Errorf(tr("%s:%d: malformed entry"), path, n+1)
 		}
+		**target += text
+	}
+	flush()
+	return cat, nil
+}
 
-		os.MkdirAll(filepath.Dir(fpath), 0755)
+// httpGet performs a GET request, retrying network errors and server-side
+// failures as configured.
+func httpGet(ctx context.Context, url string, source string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorize(req, source)
 
-		rc, err := f.Open()
-		if err != nil {
-			return err
+	var lastErr error
+	deadline := time.Now().Add(maxBusyWait)
+	for attempt := 0; attempt <= sourceIntSetting(source, "retries"); attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Duration(attempt) * time.Second):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
-
-		outFile, err := os.Create(fpath)
+		if _, err := waitIfBusy(ctx, req.URL.Host, nil); err != nil {
+			return nil, err
+		}
+		resp, err := clientFor(source).Do(req)
 		if err != nil {
-			rc.Close()
-			return err
+			lastErr = networkError(err)
+			continue
+		}
+		if wait := retryAfter(resp); wait > 0 && time.Now().Add(wait).Before(deadline) {
+			resp.Body.Close()
+			warn(fmt.Sprintf(tr("Repository %s is busy, retrying in %s"), req.URL.Host, wait.Round(time.Second)))
+			markBusy(req.URL.Host, wait)
+			lastErr = statusError(resp, "index")
+			// Waiting as asked does not use up a retry
+			attempt--
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			resp.Body.Close()
+			lastErr = statusError(resp, "index")
+			continue
 		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
 
-		_, err = io.Copy(outFile, rc)
-		outFile.Close()
-		rc.Close()
+// archiveAuth returns the source whose credentials are sent with requests for
+// the archive of c. An archive the index places on another host than the
+// repository gets none, as that host must not learn them; it can still be
+// given credentials in ~/.netrc.
+func archiveAuth(c *Component) string {
+	if c.Offsite {
+		return ""
+	}
+	return c.Source
+}
 
-		// Record relative path for info file
-		relPath := filepath.Join(filepath.FromSlash(c.Directory), filepath.FromSlash(f.Name))
-		installedFiles = append(installedFiles, relPath)
+// authorize adds the credentials of the named source to req: a bearer token,
+// or basic authentication from its settings, the system keyring or netrc.
+func authorize(req *http.Request, source string) {
+	prefix := "source." + source + "."
+	user := config[prefix+"user"]
+	password := config[prefix+"password"]
+	token := config[prefix+"token"]
+
+	if password == "" && token == "" && config[prefix+"keyring"] == "on" {
+		secret := keyringSecret(source)
+		if user != "" {
+			password = secret
+		} else {
+			token = secret
+		}
+	}
+
+	switch {
+	case token != "":
+		req.Header.Set("Authorization", "Bearer "+token)
+	case user != "":
+		req.SetBasicAuth(user, password)
+	default:
+		if login, pass, ok := netrcLookup(req.URL.Hostname()); ok {
+			req.SetBasicAuth(login, pass)
+		}
 	}
+}
 
-	// Write info file
-	infoDir := filepath.Join(basePath, "Components")
-	os.MkdirAll(infoDir, 0755)
+var (
+	keyringMu      sync.Mutex
+	keyringSecrets = make(map[string]string)
+)
 
-	err = ioutil.WriteFile(filepath.Join(infoDir, c.ID), []byte(strings.Join(installedFiles, "\n")), 0644)
+// keyringSecret looks up the secret stored for a source with
+// `secret-tool store --label=fpm service fpm source <name>`.
+func keyringSecret(source string) string {
+	keyringMu.Lock()
+	defer keyringMu.Unlock()
+	if secret, ok := keyringSecrets[source]; ok {
+		return secret
+	}
+	out, err := exec.Command("secret-tool", "lookup", "service", "fpm", "source", source).Output()
 	if err != nil {
-		fmt.Println("Warning: Could not write component info file")
+		warn(fmt.Sprintf(tr("Warning: Could not read the keyring entry for source %s: %v"), source, err))
 	}
-
-	fmt.Println("done!")
-	return nil
+	secret := strings.TrimSpace(string(out))
+	keyringSecrets[source] = secret
+	return secret
 }
 
-func removeComponent(c *Component) {
-	fmt.Printf("   Removing %s... ", c.ID)
+var (
+	netrcOnce    sync.Once
+	netrcEntries map[string][2]string
+)
 
-	infoPath := filepath.Join(basePath, "Components", c.ID)
-	data, err := ioutil.ReadFile(infoPath)
-	if err == nil {
-		lines := strings.Split(string(data), "\n")
-		// Skip header (index 0)
-		for i := 1; i < len(lines); i++ {
-			line := strings.TrimSpace(lines[i])
-			if line == "" {
-				continue
+// netrcLookup returns the login and password for host from the netrc file,
+// falling back to its "default" entry.
+func netrcLookup(host string) (string, string, bool) {
+	netrcOnce.Do(func() {
+		netrcEntries = make(map[string][2]string)
+		path := getSetting("netrc")
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return
 			}
-			fullPath := filepath.Join(basePath, line)
-			fullDelete(fullPath)
+			path = filepath.Join(home, ".netrc")
 		}
-	}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(string(data))
+		machine := ""
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine":
+				if i+1 < len(fields) {
+					i++
+					machine = fields[i]
+				}
+			case "default":
+				machine = ""
+			case "login", "password":
+				if i+1 < len(fields) {
+					entry := netrcEntries[machine]
+					if fields[i] == "login" {
+						entry[0] = fields[i+1]
+					} else {
+						entry[1] = fields[i+1]
+					}
+					netrcEntries[machine] = entry
+					i++
+				}
+			case "macdef":
+				// Macros run until the next blank line, which Fields has lost;
+				// they are rare enough in practice to stop parsing here.
+				return
+			}
+		}
+	})
 
-	fullDelete(infoPath)
-	fmt.Println("done!")
+	entry, ok := netrcEntries[host]
+	if !ok {
+		entry, ok = netrcEntries[""]
+	}
+	return entry[0], entry[1], ok && entry[0] != ""
 }
 
-func fullDelete(path string) {
-	err := os.Remove(path)
-	if err != nil && !os.IsNotExist(err) {
-		// If it's a directory (from C# logic generic handler), try removing
-		// but specifically C# logic does explicit file delete then folder cleanup
-		return
+// forEachParallel calls fn for every component, running up to the configured
+// number of calls concurrently.
+func forEachParallel(list []*Component, fn func(*Component)) {
+	queue := make(chan *Component)
+	var wg sync.WaitGroup
+	for i := 0; i < getIntSetting("concurrency"); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range queue {
+				fn(c)
+			}
+		}()
 	}
+	for _, c := range list {
+		queue <- c
+	}
+	close(queue)
+	wg.Wait()
+}
 
-	// Clean up empty directories upwards
-	dir := filepath.Dir(path)
-	absBase, _ := filepath.Abs(basePath)
-	absDir, _ := filepath.Abs(dir)
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
 
-	for absDir != absBase && strings.HasPrefix(absDir, absBase) {
-		f, err := os.Open(absDir)
-		if err != nil {
-			break
+func colorize(s string, code string) string {
+	switch getSetting("color") {
+	case "never":
+		return s
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" {
+			return s
 		}
-		_, err = f.Readdirnames(1) // check if empty
-		f.Close()
-
-		if err == io.EOF { // Empty
-			os.Remove(absDir)
-			absDir = filepath.Dir(absDir)
-		} else {
-			break
+		if !isTerminal(os.Stdout) {
+			return s
 		}
 	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
 }
 
+// formatBytes formats a size in the configured units. With "bytes", the
+// plain number is printed so scripts need not parse units.
 func formatBytes(b int64) string {
-	const unit = 1024
-	if b < unit {
-		return fmt.Sprintf("%d B", b)
+	units := sizeUnits
+	if units == "" {
+		units = getSetting("size-units")
 	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
+
+	unit, prefixes := int64(1024), "KMGTPE"
+	switch units {
+	case "bytes":
+		return strconv.FormatInt(b, 10)
+	case "si":
+		unit, prefixes = 1000, "kMGTPE"
+	}
+	if b < unit && b > -unit {
+		return fmt.Sprintf(tr("%d B"), b)
+	}
+	div, exp := unit, 0
+	for n := b / unit; n >= unit || n <= -unit; n /= unit {
 		div *= unit
 		exp++
 	}
-	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+	return fmt.Sprintf(tr("%.1f %cB"), float64(b)/float64(div), prefixes[exp])
+}
+
+// formatCount formats n with thousands separators, as in 312,000. The
+// separator is not translated, as counts also appear in output parsed by
+// scripts.
+func formatCount(n int) string {
+	digits := strconv.Itoa(n)
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(",")
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// formatTime formats t in local time or, with date-format = iso, as ISO 8601
+// in UTC. The zero time, e.g. a component without a date, is left empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	if getSetting("date-format") == "iso" {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
 }
 
+// confirm asks a yes/no question. Pressing Enter, or letting the configured
+// timeout expire, gives the default answer; without a default, a timeout
+// counts as "no". If stdin is closed there is nobody to ask, and the answer
+// is "no" as well.
 func confirm(msg string) bool {
-	reader := bufio.NewReader(os.Stdin)
+	if assumeYes {
+		return true
+	}
+	if assumeNo {
+		fmt.Printf("%s %s: %s\n", msg, tr("[y/n]"), tr("n"))
+		return false
+	}
+
+	def := getSetting("confirm-default")
+	hint := "[y/n]"
+	if def == "yes" {
+		hint = "[Y/n]"
+	} else if def == "no" {
+		hint = "[y/N]"
+	}
+	timeout := time.Duration(getIntSetting("confirm-timeout")) * time.Second
+
 	for {
-		fmt.Printf("%s [y/n]: ", msg)
-		response, _ := reader.ReadString('\n')
+		fmt.Printf("%s %s: ", msg, tr(hint))
+		response, err := readAnswer(timeout)
+		if err == errTimeout {
+			fmt.Println()
+			return def == "yes"
+		}
+		if err != nil {
+			// Closed input never says yes; --yes is needed to proceed unattended
+			fmt.Println()
+			return false
+		}
+
 		response = strings.ToLower(strings.TrimSpace(response))
-		if response == "y" {
+		switch response {
+		case "y", "yes", tr("y"), tr("yes"):
 			return true
-		}
-		if response == "n" {
+		case "n", "no", tr("n"), tr("no"):
 			return false
+		case "":
+			if def != "none" {
+				return def == "yes"
+			}
+		}
+	}
+}
+
+var (
+	errTimeout = errors.New("timed out")
+	stdinOnce  sync.Once
+	stdinLines chan string
+	stdinUsed  bool // Standard input held the component list, see readStdinList
+)
+
+// readAnswer reads a line from stdin. It returns io.EOF once stdin is closed
+// and errTimeout if no line arrives in time (a zero timeout waits forever).
+// A single reader goroutine is shared so no input is lost between prompts.
+func readAnswer(timeout time.Duration) (string, error) {
+	if inShell {
+		// The shell owns standard input; answers are read like commands
+		return shellEditor.readLine("", false)
+	}
+	stdinOnce.Do(func() {
+		stdinLines = make(chan string)
+		go func() {
+			var in io.Reader = os.Stdin
+			if stdinUsed {
+				// Ask on the terminal instead, if there is one
+				if tty, err := os.Open("/dev/tty"); err == nil {
+					in = tty
+				}
+			}
+			reader := bufio.NewReader(in)
+			for {
+				line, err := reader.ReadString('\n')
+				if line != "" {
+					stdinLines <- line
+				}
+				if err != nil {
+					close(stdinLines)
+					return
+				}
+			}
+		}()
+	})
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case line, ok := <-stdinLines:
+		if !ok {
+			return "", io.EOF
 		}
+		return line, nil
+	case <-expired:
+		return "", errTimeout
+	}
+}
+
+// warn prints a warning or a notice about skipped components to stderr, so
+// that stdout only holds results, and adds it to the report.
+func warn(msg string) {
+	report.warn(msg)
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// debug prints a diagnostic to standard error when --debug is given.
+func debug(msg string) {
+	if debugOutput {
+		fmt.Fprintln(os.Stderr, "debug: "+msg)
 	}
 }
 
 func fatal(msg string) {
-	fmt.Printf("Error: %s\n", msg)
-	os.Exit(1)
+	fmt.Printf(tr("Error: %s\n"), msg)
+	report.fail(msg)
+	exit(1)
+}
+
+// exit ends the process, or in the shell only the current command. The
+// report is written first, so that failed runs are recorded as well.
+func exit(code int) {
+	if report != nil {
+		report.mu.Lock()
+		report.ExitCode = code
+		report.mu.Unlock()
+	}
+	if inShell {
+		panic(shellExit{code})
+	}
+	writeReport()
+	os.Exit(code)
 }
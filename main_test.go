@@ -0,0 +1,540 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// fixture is a component served by a testRepo: its ID as fpm shows it, the
+// element's attributes besides id, hash and sizes, and its archive entries.
+type fixture struct {
+	Category string
+	ID       string
+	Attrs    string
+	Files    map[string]string
+}
+
+// testRepo is a fake repository serving a components.xml built from
+// fixtures and their archives, generated on the fly.
+type testRepo struct {
+	*httptest.Server
+	mu       sync.Mutex
+	index    []byte
+	archives map[string][]byte
+}
+
+func newTestRepo(t testing.TB, fixtures []fixture) *testRepo {
+	r := &testRepo{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if req.URL.Path == "/components.xml" {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write(r.index)
+			return
+		}
+		data, ok := r.archives[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, req.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(r.Close)
+	r.serve(fixtures)
+	return r
+}
+
+// serve replaces what the repository offers, e.g. with newer versions.
+func (r *testRepo) serve(fixtures []fixture) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.archives = make(map[string][]byte)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<list url=\"%s/components/\">\n", r.URL)
+	category := ""
+	for _, f := range fixtures {
+		if f.Category != category {
+			if category != "" {
+				b.WriteString(" </category>\n")
+			}
+			if f.Category != "" {
+				fmt.Fprintf(&b, " <category id=%q title=%q>\n", f.Category, f.Category)
+			}
+			category = f.Category
+		}
+		var installSize int
+		for _, content := range f.Files {
+			installSize += len(content)
+		}
+		id := f.ID
+		if f.Category != "" {
+			id = strings.TrimPrefix(f.ID, f.Category+"-")
+		}
+		attrs := fmt.Sprintf("id=%q install-size=\"%d\" %s", id, installSize, f.Attrs)
+		if len(f.Files) > 0 {
+			data := zipFiles(f.Files)
+			r.archives["/components/"+f.ID+".zip"] = data
+			attrs += fmt.Sprintf(" download-size=\"%d\" hash=\"%08X\"", len(data), crc32.ChecksumIEEE(data))
+		}
+		fmt.Fprintf(&b, "  <component %s/>\n", attrs)
+	}
+	if category != "" {
+		b.WriteString(" </category>\n")
+	}
+	b.WriteString(" <profile id=\"minimal\" title=\"Minimal\" components=\"core\"/>\n</list>\n")
+	r.index = []byte(b.String())
+}
+
+// zipFiles builds an archive of files, the same bytes every time.
+func zipFiles(files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			panic(err)
+		}
+		io.WriteString(w, files[name])
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// catalog1 is the repository most tests start from.
+var catalog1 = []fixture{
+	{"core", "core-launcher", `path="Launcher"`, map[string]string{
+		"Launcher.exe":       "launcher v1",
+		"resources/app.asar": "app v1",
+	}},
+	{"core", "core-database", `path="Data" depends="core-launcher"`, map[string]string{
+		"flashpoint.sqlite": "database v1",
+	}},
+	{"extra", "extra-ruffle", `path="Data/Ruffle" depends="core-database"`, map[string]string{
+		"ruffle.bin":  "ruffle v1",
+		"lang/de.txt": "Hallo",
+		"lang/fr.txt": "Bonjour",
+	}},
+	{"extra", "extra-flash", `path="Data/Flash"`, map[string]string{
+		"flashplayer.bin": "flash v1",
+	}},
+	{"extra", "extra-bundle", `depends="extra-ruffle extra-flash"`, nil},
+}
+
+// catalog2 changes core-launcher's files, and extra-ruffle's files and
+// dependencies.
+var catalog2 = []fixture{
+	{"core", "core-launcher", `path="Launcher"`, map[string]string{
+		"Launcher.exe":         "launcher v2",
+		"resources/extra.asar": "extra v2",
+	}},
+	catalog1[1],
+	{"extra", "extra-ruffle", `path="Data/Ruffle" depends="core-database extra-flash"`, map[string]string{
+		"ruffle.bin":  "ruffle v2",
+		"lang/de.txt": "Hallo",
+	}},
+	catalog1[3],
+	catalog1[4],
+}
+
+// testEnv is an installation in a temporary directory using a testRepo.
+type testEnv struct {
+	t    *testing.T
+	dir  string
+	base string
+	repo *testRepo
+}
+
+// newTestEnv points fpm at a fresh Flashpoint tree and repo, with settings
+// that keep it from touching anything outside the temporary directory.
+func newTestEnv(t *testing.T, repo *testRepo) *testEnv {
+	dir := t.TempDir()
+	e := &testEnv{t: t, dir: dir, base: filepath.Join(dir, "Flashpoint"), repo: repo}
+	if err := os.MkdirAll(filepath.Join(e.base, "Data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := strings.Join([]string{
+		e.base,
+		repo.URL + "/components.xml",
+		"cache-dir = " + filepath.Join(dir, "cache"),
+		"color = never",
+		"concurrency = 1",
+		"index-ttl = 0",
+		"version = 1",
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, "fpm.cfg"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfigFile := configFile
+	configFile = filepath.Join(dir, "fpm.cfg")
+	inShell = true
+	t.Cleanup(func() {
+		configFile = oldConfigFile
+		inShell = false
+		resetState()
+	})
+	initConfig()
+	return e
+}
+
+// resetState forgets what fpm loaded, as if each command were run by a new
+// process.
+func resetState() {
+	components, categories, compMap, providers, profiles = nil, nil, nil, nil, nil
+	forgetInstalled()
+	forgetIDIndex()
+	pinnedOnce, annotationsOnce = sync.Once{}, sync.Once{}
+	ownersMu.Lock()
+	owners, ownersLoaded = nil, false
+	ownersMu.Unlock()
+	dedupMu.Lock()
+	dedupIndex, dedupLoaded = nil, false
+	dedupMu.Unlock()
+}
+
+// run runs an fpm command line and returns its standard output and error,
+// with the temporary paths and the repository URL replaced by placeholders.
+func (e *testEnv) run(args ...string) string {
+	e.t.Helper()
+	resetState()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	runShellCommand(args)
+	os.Stdout, os.Stderr = stdout, stderr
+	w.Close()
+
+	return e.placeholders(<-out)
+}
+
+var timestamp = regexp.MustCompile(`\d{4}-\d\d-\d\d \d\d:\d\d(:\d\d)?`)
+
+// placeholders replaces the temporary paths, the repository URL and the
+// times shown in s.
+func (e *testEnv) placeholders(s string) string {
+	s = strings.Replace(s, e.base, "$BASE", -1)
+	s = strings.Replace(s, e.repo.URL, "$REPO", -1)
+	return timestamp.ReplaceAllString(s, "$$TIME")
+}
+
+// tree lists the files under the base path with their contents, leaving out
+// fpm's own state directory.
+func (e *testEnv) tree() string {
+	var b strings.Builder
+	filepath.Walk(e.base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			e.t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(e.base, p)
+		switch {
+		case rel == ".":
+		case rel == ".fpm":
+			return filepath.SkipDir
+		case fi.IsDir():
+			fmt.Fprintf(&b, "%s/\n", filepath.ToSlash(rel))
+		default:
+			data, _ := ioutil.ReadFile(p)
+			content := strings.Replace(strings.TrimRight(string(data), "\n"), "\n", "\n    ", -1)
+			fmt.Fprintf(&b, "%s\n    %s\n", filepath.ToSlash(rel), content)
+		}
+		return nil
+	})
+	return b.String()
+}
+
+// checkGolden compares got with testdata/<test name>.golden, or rewrites the
+// file with go test -update.
+func checkGolden(t *testing.T, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", strings.Replace(t.Name(), "/", "_", -1)+".golden")
+	if *updateGolden {
+		os.MkdirAll("testdata", 0755)
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -update to create it", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %s:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+// transcript runs each command line and returns them with their output.
+func (e *testEnv) transcript(lines ...[]string) string {
+	var b strings.Builder
+	for _, args := range lines {
+		fmt.Fprintf(&b, "$ fpm %s\n%s\n", e.placeholders(strings.Join(args, " ")), e.run(args...))
+	}
+	return b.String()
+}
+
+func TestPlan(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	checkGolden(t, e.transcript(
+		[]string{"--assume-no", "download", "extra-ruffle"},
+		[]string{"--assume-no", "download", "--tree", "extra-bundle"},
+		[]string{"--assume-no", "download", "@minimal"},
+		[]string{"--assume-no", "download", "extra-*"},
+	))
+}
+
+func TestExtract(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	e.run("-y", "download", "extra-ruffle")
+	checkGolden(t, e.tree()+"\n"+e.transcript([]string{"list", "downloaded"}))
+}
+
+func TestRemove(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	e.run("-y", "download", "extra-ruffle", "extra-flash")
+	e.run("-y", "remove", "extra-ruffle", "core-database")
+	checkGolden(t, e.tree()+"\n"+e.transcript([]string{"list", "downloaded"}))
+}
+
+func TestUpdate(t *testing.T) {
+	repo := newTestRepo(t, catalog1)
+	e := newTestEnv(t, repo)
+	e.run("-y", "download", "extra-ruffle")
+	repo.serve(catalog2)
+	before := e.transcript([]string{"list", "updates"}, []string{"-y", "update"})
+	checkGolden(t, before+e.tree()+"\n"+e.transcript([]string{"list", "updates"}))
+
+	// extra-ruffle's new version depends on extra-flash
+	if !strings.Contains(e.run("list", "downloaded"), "* extra-flash") {
+		t.Error("updating all left a new dependency uninstalled")
+	}
+}
+
+// sharedDirs are two components installing into the same nested directory.
+var sharedDirs = []fixture{
+	{"extra", "extra-one", `path="Data"`, map[string]string{
+		"Plugins/shared/a.bin": "a",
+		"Plugins/one.txt":      "one",
+	}},
+	{"extra", "extra-two", `path="Data"`, map[string]string{
+		"Plugins/shared/b.bin": "b",
+	}},
+}
+
+func TestRemoveSharedDirs(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, sharedDirs))
+	e.run("-y", "download", "extra-one", "extra-two")
+	got := e.transcript([]string{"-y", "remove", "extra-one"}) + e.tree()
+	got += "\n" + e.transcript([]string{"-y", "remove", "extra-two"}) + e.tree()
+	checkGolden(t, got)
+}
+
+// TestRemoveSymlinkedBase removes components from a base path that is a
+// symbolic link, and from a directory in it that links outside the tree,
+// whose files fpm must leave alone.
+func TestRemoveSymlinkedBase(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, sharedDirs))
+	real := filepath.Join(e.dir, "real")
+	if err := os.Rename(e.base, real); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(real, e.base); err != nil {
+		t.Fatal(err)
+	}
+	e.run("-y", "download", "extra-one", "extra-two")
+
+	// The shared directory is moved elsewhere, e.g. to another drive
+	outside := filepath.Join(e.dir, "outside")
+	if err := os.Rename(filepath.Join(real, "Data", "Plugins", "shared"), outside); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(real, "Data", "Plugins", "shared")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := e.transcript([]string{"-y", "remove", "extra-one", "extra-two"})
+	e.base = real
+	got += e.tree()
+	checkGolden(t, got)
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if _, err := os.Stat(filepath.Join(outside, name)); err != nil {
+			t.Errorf("a file outside the tree was removed: %v", err)
+		}
+	}
+	if fi, err := os.Lstat(filepath.Join(e.dir, "Flashpoint")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the base path is no longer a symbolic link: %v", err)
+	}
+}
+
+func TestPurgeKeepsAuditLog(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	e.run("-y", "download", "extra-flash")
+	out := e.run("-y", "purge")
+	if !strings.Contains(out, "The audit log $BASE/.fpm/audit.log is kept") {
+		t.Errorf("purge does not say the audit log is kept:\n%s", out)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(e.base, ".fpm", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"reason":"purge"`) {
+		t.Errorf("the audit log does not record the purge:\n%s", data)
+	}
+	infos, _ := ioutil.ReadDir(filepath.Join(e.base, ".fpm"))
+	if len(infos) != 1 {
+		t.Errorf("the state directory holds %d entries besides the audit log", len(infos)-1)
+	}
+}
+
+// TestShellReport checks that a report given with a command in the shell is
+// written when that command ends, even if it fails, and not carried over.
+func TestShellReport(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	path := filepath.Join(e.dir, "report.json")
+	e.run("--report", path, "--all-locales", "info", "core-launcher", "extra-flash")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Command != "info" || r.ExitCode != 1 || !strings.Contains(r.Error, "Only one component") {
+		t.Errorf("report of a failed command: %s", data)
+	}
+
+	os.Remove(path)
+	e.run("-y", "download", "extra-flash")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the report was written for a later command: %v", err)
+	}
+	if report != nil || allLocales {
+		t.Error("global flags of a shell command outlived it")
+	}
+}
+
+// TestFailedStep downloads a component whose archive is refused along with
+// others, which must only be counted if they succeeded.
+func TestFailedStep(t *testing.T) {
+	repo := newTestRepo(t, catalog1)
+	repo.replaceArchive("extra-flash", zipEntries([]string{"a.bin", "a.bin"}, zip.Deflate))
+	e := newTestEnv(t, repo)
+	path := filepath.Join(e.base, "report.json")
+	got := e.transcript([]string{"-y", "--report", path, "download", "extra-ruffle", "extra-flash"})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, got+fmt.Sprintf("exit code %d\n", r.ExitCode))
+}
+
+// TestStaleOwners removes a component after another one took over one of
+// its files without the ownership index being saved, as after a crash.
+func TestStaleOwners(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	e.run("-y", "download", "extra-ruffle")
+
+	manifest := " 0 \nData/Ruffle/ruffle.bin"
+	if err := ioutil.WriteFile(filepath.Join(e.base, "Components", "extra-taker"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(e.base, ".fpm", "owners"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	e.run("-y", "remove", "extra-ruffle")
+	if _, err := os.Stat(filepath.Join(e.base, "Data", "Ruffle", "ruffle.bin")); err != nil {
+		t.Errorf("a file of another component was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(e.base, "Data", "Ruffle", "lang", "de.txt")); !os.IsNotExist(err) {
+		t.Errorf("a file of the removed component was kept: %v", err)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`note extra-flash "needed for X"`, []string{"note", "extra-flash", "needed for X"}},
+		{`  list   downloaded `, []string{"list", "downloaded"}},
+		{`note a 'it''s' b`, []string{"note", "a", "its", "b"}},
+		{`note a "say \"hi\" \n"`, []string{"note", "a", `say "hi" \n`}},
+		{`note a it\'s\ fine`, []string{"note", "a", "it's fine"}},
+		{`note a '' ""`, []string{"note", "a", "", ""}},
+		{`note a 'back\slash'`, []string{"note", "a", `back\slash`}},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got, err := splitWords(tt.line)
+		if err != nil {
+			t.Errorf("splitWords(%q): %v", tt.line, err)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("splitWords(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	for _, line := range []string{`note a "open`, `note a 'open`} {
+		if _, err := splitWords(line); err == nil {
+			t.Errorf("splitWords(%q) accepted an unterminated quote", line)
+		}
+	}
+}
+
+// TestStreamFallback streams an archive whose stored entry only gives its
+// size after the data, which needs the central directory to read.
+func TestStreamFallback(t *testing.T) {
+	repo := newTestRepo(t, catalog1)
+	repo.replaceArchive("extra-flash", zipEntries([]string{"a.bin"}, zip.Store))
+	e := newTestEnv(t, repo)
+	checkGolden(t, e.transcript([]string{"-y", "--stream", "download", "extra-flash"})+e.tree())
+}
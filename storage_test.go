@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memStorage keeps the tree in memory, to check that fpm reaches the files
+// of components only through storage.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+
+	// failPut makes Put fail for this path, as a full disk would
+	failPut string
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string][]byte), dirs: map[string]bool{".": true}}
+}
+
+// key turns rel into the form the maps are keyed by.
+func (m *memStorage) key(rel string) string {
+	return path.Clean(filepath.ToSlash(rel))
+}
+
+// mkdirs creates the directories leading to the file at key.
+func (m *memStorage) mkdirs(key string) {
+	for dir := path.Dir(key); !m.dirs[dir]; dir = path.Dir(dir) {
+		m.dirs[dir] = true
+	}
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (m *memStorage) Stat(rel string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := m.key(rel)
+	if data, ok := m.files[k]; ok {
+		return memFileInfo{name: path.Base(k), size: int64(len(data))}, nil
+	}
+	if m.dirs[k] {
+		return memFileInfo{name: path.Base(k), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: rel, Err: os.ErrNotExist}
+}
+
+func (m *memStorage) Put(src, rel string) error {
+	if m.key(rel) == m.failPut {
+		return &os.PathError{Op: "rename", Path: rel, Err: syscall.ENOSPC}
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := m.WriteFile(rel, data); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (m *memStorage) WriteFile(rel string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := m.key(rel)
+	m.mkdirs(k)
+	m.files[k] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memStorage) Remove(rel string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := m.key(rel)
+	if _, ok := m.files[k]; ok {
+		delete(m.files, k)
+		return nil
+	}
+	if !m.dirs[k] {
+		return &os.PathError{Op: "remove", Path: rel, Err: os.ErrNotExist}
+	}
+	if len(m.children(k)) > 0 {
+		return &os.PathError{Op: "remove", Path: rel, Err: os.ErrExist}
+	}
+	delete(m.dirs, k)
+	return nil
+}
+
+func (m *memStorage) Sync(rel string) error {
+	return nil
+}
+
+func (m *memStorage) Open(rel string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[m.key(rel)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memStorage) List(rel string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := m.key(rel)
+	if !m.dirs[k] {
+		return nil, &os.PathError{Op: "open", Path: rel, Err: os.ErrNotExist}
+	}
+	return m.children(k), nil
+}
+
+func (m *memStorage) Local() string {
+	return ""
+}
+
+// children returns the names of the entries of the directory dir, sorted.
+func (m *memStorage) children(dir string) []string {
+	var names []string
+	add := func(p string) {
+		if p != dir && path.Dir(p) == dir {
+			names = append(names, path.Base(p))
+		}
+	}
+	for p := range m.files {
+		add(p)
+	}
+	for p := range m.dirs {
+		add(p)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tree lists the files in m with their contents, like testEnv.tree.
+func (m *memStorage) tree() string {
+	var lines []string
+	for p := range m.dirs {
+		if p != "." {
+			lines = append(lines, p+"/")
+		}
+	}
+	for p, data := range m.files {
+		if !strings.HasPrefix(p, "Components/") {
+			lines = append(lines, p+"\n    "+string(data))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestMemStorage(t *testing.T) {
+	e := newTestEnv(t, newTestRepo(t, catalog1))
+	mem := newMemStorage()
+	old := storage
+	storage = mem
+	t.Cleanup(func() { storage = old })
+
+	e.run("-y", "download", "extra-ruffle")
+	got := mem.tree() + "\n" + e.transcript(
+		[]string{"list", "downloaded"},
+		[]string{"verify", "extra-ruffle"},
+	)
+	e.run("-y", "remove", "extra-ruffle", "core-database", "core-launcher")
+	got += mem.tree()
+	checkGolden(t, got)
+
+	// Nothing but fpm's own state may reach the disk
+	if tree := e.tree(); tree != "Data/\n" {
+		t.Errorf("files were written to the base path:\n%s", tree)
+	}
+}
+
+// TestPutFails updates a component while the disk fills up. The files placed
+// before must be recorded, and resuming must install it again.
+func TestPutFails(t *testing.T) {
+	repo := newTestRepo(t, catalog1)
+	e := newTestEnv(t, repo)
+	mem := newMemStorage()
+	old := storage
+	storage = mem
+	t.Cleanup(func() { storage = old })
+
+	e.run("-y", "download", "extra-ruffle")
+	repo.serve(catalog2)
+	mem.failPut = "Data/Ruffle/ruffle.bin"
+	got := e.transcript([]string{"-y", "update", "extra-ruffle"})
+	got += "Components/extra-ruffle\n    " + string(mem.files["Components/extra-ruffle"]) + "\n\n"
+	mem.failPut = ""
+	got += e.transcript([]string{"list", "updates"}, []string{"-y", "resume"})
+	checkGolden(t, got+mem.tree())
+}